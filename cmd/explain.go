@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/jtblin/kube2iam/server"
+)
+
+// runExplain runs the explain command, printing how the role of a pod given by IP or namespace/name is looked up
+// and authorized by the kube2iam server of its node.
+func runExplain(args []string) error {
+	fs := pflag.NewFlagSet("explain", pflag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s explain [flags] <pod IP | namespace/name>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	address := fs.String("server", "http://localhost:8181", "Address of the kube2iam server running on the node of the pod")
+	token := fs.String("token", os.Getenv("KUBE2IAM_EXPLAIN_TOKEN"), "Token configured with --explain-token on the kube2iam server (default $KUBE2IAM_EXPLAIN_TOKEN)")
+	output := fs.StringP("output", "o", "text", "Output format (text/json)")
+	timeout := fs.Duration("timeout", 10*time.Second, "Timeout of the request to the kube2iam server")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("explain expects a single pod IP or namespace/name")
+	}
+
+	query := url.Values{}
+	if parts := strings.SplitN(fs.Arg(0), "/", 2); len(parts) == 2 {
+		query.Set("namespace", parts[0])
+		query.Set("name", parts[1])
+	} else {
+		query.Set("ip", fs.Arg(0))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*address, "/")+"/explain?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("explain request failed with status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if *output == "json" {
+		_, err := os.Stdout.Write(body)
+		return err
+	}
+	explanation := &server.ExplainResponse{}
+	if err := json.Unmarshal(body, explanation); err != nil {
+		return err
+	}
+	printExplanation(os.Stdout, explanation)
+	return nil
+}
+
+// printExplanation writes the trace of an explanation in a human readable form.
+func printExplanation(out io.Writer, e *server.ExplainResponse) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Pod:\t%s/%s (%s)\n", e.Namespace, e.Pod, e.IP)
+	if e.RoleSource == "" {
+		fmt.Fprintf(w, "Role:\tnone\n")
+	} else {
+		source := e.RoleSource
+		if e.RoleAnnotation != "" {
+			source = fmt.Sprintf("%s annotation %s", e.RoleSource, e.RoleAnnotation)
+		}
+		fmt.Fprintf(w, "Role source:\t%s\n", source)
+		fmt.Fprintf(w, "Role:\t%s\n", e.RawRole)
+		fmt.Fprintf(w, "Normalized ARN:\t%s (valid: %t)\n", e.Role, e.ValidARN)
+	}
+	if e.Authorizer != "" {
+		fmt.Fprintf(w, "Authorizer:\t%s\n", e.Authorizer)
+	}
+	fmt.Fprintf(w, "Allowed:\t%t\n", e.Allowed)
+	if e.Audited {
+		fmt.Fprintf(w, "Audited:\tcredentials are issued in audit mode\n")
+	}
+	fmt.Fprintf(w, "Reason:\t%s\n", e.Reason)
+	externalID := e.ExternalIDSource
+	if externalID == "" {
+		externalID = "none"
+	}
+	fmt.Fprintf(w, "External ID:\t%s\n", externalID)
+	if e.Cache != nil {
+		if e.Cache.Cached {
+			fmt.Fprintf(w, "Cache:\tcached until %s (expires at %s, stale: %t, prefetched: %t)\n", e.Cache.Expires, e.Cache.Expiration, e.Cache.Stale, e.Cache.Prefetched)
+		} else {
+			fmt.Fprintf(w, "Cache:\tnot cached\n")
+		}
+	}
+	w.Flush()
+
+	if len(e.Checks) > 0 {
+		fmt.Fprintln(out, "\nPatterns:")
+		w = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SOURCE\tPATTERN\tMATCHED")
+		for _, check := range e.Checks {
+			matched := fmt.Sprintf("%t", check.Matched)
+			if check.Skipped != "" {
+				matched = "skipped: " + check.Skipped
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", check.Source, check.Pattern, matched)
+		}
+		w.Flush()
+	}
+	for _, invalid := range e.InvalidPatterns {
+		fmt.Fprintf(out, "Ignored invalid pattern: %s\n", invalid)
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
@@ -17,39 +22,87 @@ func addFlags(s *server.Server, fs *pflag.FlagSet) {
 	fs.StringVar(&s.APIServer, "api-server", s.APIServer, "Endpoint for the api server")
 	fs.StringVar(&s.APIToken, "api-token", s.APIToken, "Token to authenticate with the api server")
 	fs.StringVar(&s.AppPort, "app-port", s.AppPort, "Kube2iam server http port")
+	fs.StringVar(&s.ContainerCredentialsPort, "container-credentials-port", s.ContainerCredentialsPort, "Container credentials (AWS_CONTAINER_CREDENTIALS_FULL_URI) http port, disabled if empty")
+	fs.StringVar(&s.ContainerCredentialsToken, "container-credentials-token", s.ContainerCredentialsToken, "Token expected in the Authorization header of container credentials requests (AWS_CONTAINER_AUTHORIZATION_TOKEN)")
+	fs.StringVar(&s.ExplainToken, "explain-token", s.ExplainToken, "Bearer token required by the /explain endpoint tracing the role of pods, disabled if empty")
 	fs.StringVar(&s.MetricsPort, "metrics-port", s.MetricsPort, "Metrics server http port (default: same as kube2iam server port)")
 	fs.StringVar(&s.BaseRoleARN, "base-role-arn", s.BaseRoleARN, "Base role ARN")
 	fs.BoolVar(&s.Debug, "debug", s.Debug, "Enable debug features")
 	fs.StringVar(&s.DefaultIAMRole, "default-role", s.DefaultIAMRole, "Fallback role to use when annotation is not set")
 	fs.StringVar(&s.IAMRoleKey, "iam-role-key", s.IAMRoleKey, "Pod annotation key used to retrieve the IAM role")
+	fs.StringVar(&s.ServiceAccountRoleKey, "service-account-role-key", s.ServiceAccountRoleKey, "Service account annotation key used to retrieve the IAM role when the pod annotation is not set, e.g. eks.amazonaws.com/role-arn (disabled if empty)")
+	fs.StringSliceVar(&s.SessionTags, "session-tag", s.SessionTags, "STS session tag to set from pod metadata, in the form key=source where source is namespace, pod-name, service-account or label:<label key> (can be repeated)")
+	fs.StringSliceVar(&s.TransitiveSessionTags, "transitive-session-tag", s.TransitiveSessionTags, "Session tag key that persists through role chaining (can be repeated)")
 	fs.StringVar(&s.IAMExternalID, "iam-external-id", s.IAMExternalID, "Pod annotation key used to retrieve the IAM ExternalId")
+	fs.StringVar(&s.SessionPolicyKey, "session-policy-key", s.SessionPolicyKey, "Pod annotation key used to retrieve an inline session policy (disabled if empty)")
+	fs.StringVar(&s.SessionPolicyARNsKey, "session-policy-arns-key", s.SessionPolicyARNsKey, "Pod annotation key used to retrieve a JSON array of managed session policy ARNs (disabled if empty)")
 	fs.DurationVar(&s.IAMRoleSessionTTL, "iam-role-session-ttl", s.IAMRoleSessionTTL, "TTL for the assume role session")
+	fs.IntVar(&s.IAMCacheMaxEntries, "iam-cache-max-entries", s.IAMCacheMaxEntries, "Maximum number of credentials held in the cache")
+	fs.DurationVar(&s.IAMCacheRefreshWindow, "iam-cache-refresh-window", s.IAMCacheRefreshWindow, "Renew cached credentials still in use this long before they expire from the cache (0 disables background renewal)")
+	fs.IntVar(&s.PrefetchWorkers, "prefetch-workers", s.PrefetchWorkers, "Number of workers prefetching the credentials of pods getting an IP on the node (0 disables prefetching)")
 	fs.BoolVar(&s.Insecure, "insecure", false, "Kubernetes server should be accessed without verifying the TLS. Testing only")
 	fs.StringVar(&s.MetadataAddress, "metadata-addr", s.MetadataAddress, "Address for the ec2 metadata")
+	fs.StringVar(&s.MetadataAddressIPv6, "metadata-addr-ipv6", s.MetadataAddressIPv6, "IPv6 address for the ec2 metadata")
 	fs.BoolVar(&s.AddIPTablesRule, "iptables", false, "Add iptables rule (also requires --host-ip)")
+	fs.StringVar(&s.IPTablesBackend, "iptables-backend", s.IPTablesBackend, "Backend programming the iptables rule (auto/iptables/nftables), auto uses the backend already holding the rules of the host")
+	fs.BoolVar(&s.RemoveIPTablesRule, "iptables-cleanup", false, "Remove the iptables rule on shutdown, pods can reach the EC2 metadata API until kube2iam restarts")
+	fs.DurationVar(&s.IPTablesReconcileInterval, "iptables-reconcile-interval", s.IPTablesReconcileInterval, "Interval at which the iptables rule is verified and restored if missing (0 disables verification)")
+	fs.DurationVar(&s.ShutdownGracePeriod, "shutdown-grace-period", s.ShutdownGracePeriod, "Max time to wait for in-flight requests to complete on shutdown")
 	fs.BoolVar(&s.AutoDiscoverBaseArn, "auto-discover-base-arn", false, "Queries EC2 Metadata to determine the base ARN")
 	fs.BoolVar(&s.AutoDiscoverDefaultRole, "auto-discover-default-role", false, "Queries EC2 Metadata to determine the default Iam Role and base ARN, cannot be used with --default-role, overwrites any previous setting for --base-role-arn")
-	fs.StringVar(&s.HostInterface, "host-interface", "docker0", "Host interface for proxying AWS metadata")
+	fs.BoolVar(&s.IMDSv2Required, "imdsv2-required", false, "Reject metadata requests that do not present a valid IMDSv2 session token")
+	fs.IntVar(&s.IMDSv2HopLimit, "imdsv2-hop-limit", s.IMDSv2HopLimit, "IP hop limit of IMDSv2 token responses, the connection is closed after them, 0 leaves the system default")
+	fs.StringSliceVar(&s.HostInterfaces, "host-interface", []string{"docker0"}, "Host interface or interface pattern (e.g. eni+) for proxying AWS metadata (can be repeated or comma separated)")
 	fs.BoolVar(&s.NamespaceRestriction, "namespace-restrictions", false, "Enable namespace restrictions")
+	fs.BoolVar(&s.NamespaceRestrictionAudit, "namespace-restrictions-audit", false, "Log and count the requests namespace restrictions would deny but still issue credentials (requires --namespace-restrictions)")
+	fs.BoolVar(&s.IAMRoleBindings, "iam-role-bindings", false, "Use IAMRoleBinding resources instead of the namespace annotation for namespace restrictions (requires --namespace-restrictions)")
 	fs.StringVar(&s.NamespaceRestrictionFormat, "namespace-restriction-format", s.NamespaceRestrictionFormat, "Namespace Restriction Format (glob/regexp)")
+	fs.StringVar(&s.AuthorizationPolicyFile, "authorization-policy-file", "", "Authorize roles with the rules of a policy file, read once on startup, instead of the namespace annotation or IAMRoleBindings (requires --namespace-restrictions)")
 	fs.StringVar(&s.NamespaceKey, "namespace-key", s.NamespaceKey, "Namespace annotation key used to retrieve the IAM roles allowed (value in annotation should be json array)")
+	fs.StringVar(&s.NamespaceDefaultRoleKey, "namespace-default-role-key", s.NamespaceDefaultRoleKey, "Namespace annotation key used to retrieve the fallback role of the pods of the namespace, subject to namespace restrictions (disabled if empty)")
+	fs.StringVar(&s.NamespaceDeniedKey, "namespace-denied-key", s.NamespaceDeniedKey, "Namespace annotation key used to retrieve the IAM roles denied, taking precedence over the roles allowed and the default role (value in annotation should be json array)")
 	fs.DurationVar(&s.CacheResyncPeriod, "cache-resync-period", s.CacheResyncPeriod, "Kubernetes caches resync period")
 	fs.BoolVar(&s.ResolveDupIPs, "resolve-duplicate-cache-ips", false, "Queries the k8s api server to find the source of truth when the pod cache contains multiple pods with the same IP")
 	fs.StringVar(&s.HostIP, "host-ip", s.HostIP, "IP address of host")
+	fs.StringVar(&s.HostIPv6, "host-ipv6", s.HostIPv6, "IPv6 address of host, adds an ip6tables rule for the IPv6 ec2 metadata address when set with --iptables")
 	fs.StringVar(&s.NodeName, "node", s.NodeName, "Name of the node where kube2iam is running")
-	fs.DurationVar(&s.BackoffMaxInterval, "backoff-max-interval", s.BackoffMaxInterval, "Max interval for backoff when querying for role.")
-	fs.DurationVar(&s.BackoffMaxElapsedTime, "backoff-max-elapsed-time", s.BackoffMaxElapsedTime, "Max elapsed time for backoff when querying for role.")
+	fs.DurationVar(&s.PodLookupTimeout, "pod-lookup-timeout", s.PodLookupTimeout, "Max time to wait for a pod to be indexed when querying for role.")
+	// Kept for backward compatibility, pod lookups wait for the pod informer instead of polling
+	fs.DurationVar(&s.PodLookupTimeout, "backoff-max-elapsed-time", s.PodLookupTimeout, "Max elapsed time for backoff when querying for role.")
+	fs.MarkDeprecated("backoff-max-elapsed-time", "use --pod-lookup-timeout instead")
+	var backoffMaxInterval time.Duration
+	fs.DurationVar(&backoffMaxInterval, "backoff-max-interval", backoffMaxInterval, "Max interval for backoff when querying for role.")
+	fs.MarkDeprecated("backoff-max-interval", "pod lookups no longer poll")
 	fs.StringVar(&s.LogFormat, "log-format", s.LogFormat, "Log format (text/json)")
 	fs.StringVar(&s.LogLevel, "log-level", s.LogLevel, "Log level")
 	fs.BoolVar(&s.UseRegionalStsEndpoint, "use-regional-sts-endpoint", false, "use the regional sts endpoint if AWS_REGION is set")
+	fs.Float64Var(&s.RateLimit, "rate-limit", s.RateLimit, "Requests per second allowed from each pod IP to the metadata and credentials endpoints, 0 disables the limit")
+	fs.IntVar(&s.RateLimitBurst, "rate-limit-burst", s.RateLimitBurst, "Requests allowed in a burst from each pod IP above --rate-limit")
+	fs.Float64Var(&s.GlobalRateLimit, "global-rate-limit", s.GlobalRateLimit, "Requests per second allowed from all pods to the metadata and credentials endpoints, 0 disables the limit")
+	fs.IntVar(&s.GlobalRateLimitBurst, "global-rate-limit-burst", s.GlobalRateLimitBurst, "Requests allowed in a burst from all pods above --global-rate-limit")
+	fs.BoolVar(&s.RecordEvents, "record-events", s.RecordEvents, "Record events on pods denied their role or failing to assume it and on invalid role patterns (requires permissions to create events)")
 	fs.BoolVar(&s.Verbose, "verbose", false, "Verbose")
 	fs.BoolVar(&s.Version, "version", false, "Print the version and exits")
 }
 
 func main() {
 	s := server.NewServer()
+	args := os.Args[1:]
+	// kube2iam explain queries a running kube2iam server instead of starting one
+	if len(args) > 0 && args[0] == "explain" {
+		if err := runExplain(args[1:]); err != nil {
+			log.Fatalf("%s", err)
+		}
+		return
+	}
+	// kube2iam webhook runs the validating admission webhook instead of the metadata proxy
+	webhook := len(args) > 0 && args[0] == "webhook"
+	if webhook {
+		args = args[1:]
+		addWebhookFlags(s, pflag.CommandLine)
+	}
 	addFlags(s, pflag.CommandLine)
-	pflag.Parse()
+	pflag.CommandLine.Parse(args)
 
 	logLevel, err := log.ParseLevel(s.LogLevel)
 	if err != nil {
@@ -108,13 +161,75 @@ func main() {
 		log.Infof("Using instance IAMRole %s%s as default", s.BaseRoleARN, s.DefaultIAMRole)
 	}
 
+	if s.IAMRoleBindings && !s.NamespaceRestriction {
+		log.Fatal("--iam-role-bindings requires --namespace-restrictions")
+	}
+
+	if s.NamespaceRestrictionAudit && !s.NamespaceRestriction {
+		log.Fatal("--namespace-restrictions-audit requires --namespace-restrictions")
+	}
+
+	if s.AuthorizationPolicyFile != "" && !s.NamespaceRestriction {
+		log.Fatal("--authorization-policy-file requires --namespace-restrictions")
+	}
+
+	if (s.RateLimit > 0 && s.RateLimitBurst < 1) || (s.GlobalRateLimit > 0 && s.GlobalRateLimitBurst < 1) {
+		log.Fatal("--rate-limit-burst and --global-rate-limit-burst must be at least 1 when their limit is set")
+	}
+
+	if webhook && (s.WebhookTLSCertFile == "" || s.WebhookTLSKeyFile == "") {
+		log.Fatal("webhook requires --tls-cert-file and --tls-private-key-file")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		log.Infof("Received %s, shutting down", sig)
+		cancel()
+	}()
+
+	if webhook {
+		if err := s.RunWebhook(ctx, s.APIServer, s.APIToken, s.Insecure); err != nil {
+			log.Fatalf("%s", err)
+		}
+		log.Info("Shutdown complete")
+		return
+	}
+
+	var ipt *iptables.Manager
 	if s.AddIPTablesRule {
-		if err := iptables.AddRule(s.AppPort, s.MetadataAddress, s.HostInterface, s.HostIP); err != nil {
+		var rules []iptables.Rule
+		for _, hostInterface := range s.HostInterfaces {
+			rules = append(rules, iptables.Rule{AppPort: s.AppPort, MetadataAddress: s.MetadataAddress, HostInterface: hostInterface, HostIP: s.HostIP})
+			if s.HostIPv6 != "" {
+				rules = append(rules, iptables.Rule{AppPort: s.AppPort, MetadataAddress: s.MetadataAddressIPv6, HostInterface: hostInterface, HostIP: s.HostIPv6})
+			}
+		}
+		if ipt, err = iptables.NewManager(s.IPTablesBackend, rules); err != nil {
+			log.Fatalf("%s", err)
+		}
+		if _, err := ipt.Ensure(); err != nil {
 			log.Fatalf("%s", err)
 		}
+		if s.IPTablesReconcileInterval > 0 {
+			go ipt.Run(s.IPTablesReconcileInterval, ctx.Done())
+		}
 	}
 
-	if err := s.Run(s.APIServer, s.APIToken, s.NodeName, s.Insecure); err != nil {
-		log.Fatalf("%s", err)
+	runErr := s.Run(ctx, s.APIServer, s.APIToken, s.NodeName, s.Insecure)
+	if runErr != nil {
+		log.Errorf("%s", runErr)
+	}
+
+	if ipt != nil && s.RemoveIPTablesRule {
+		if err := ipt.Cleanup(); err != nil {
+			log.Errorf("Error removing iptables rules: %+v", err)
+		}
+	}
+	if runErr != nil {
+		os.Exit(1)
 	}
+	log.Info("Shutdown complete")
 }
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"github.com/spf13/pflag"
+
+	"github.com/jtblin/kube2iam/server"
+)
+
+// addWebhookFlags adds the command line flags of the webhook command.
+func addWebhookFlags(s *server.Server, fs *pflag.FlagSet) {
+	fs.StringVar(&s.WebhookPort, "webhook-port", s.WebhookPort, "Admission webhook https port")
+	fs.StringVar(&s.WebhookTLSCertFile, "tls-cert-file", s.WebhookTLSCertFile, "File containing the x509 certificate of the admission webhook")
+	fs.StringVar(&s.WebhookTLSKeyFile, "tls-private-key-file", s.WebhookTLSKeyFile, "File containing the x509 private key matching --tls-cert-file")
+	fs.BoolVar(&s.WebhookWarnOnly, "warn-only", false, "Admit pods that won't be given their role with a warning instead of rejecting them")
+}
@@ -3,16 +3,11 @@ module github.com/jtblin/kube2iam
 go 1.14
 
 require (
-	github.com/aws/aws-sdk-go v1.8.7
+	github.com/aws/aws-sdk-go v1.35.37
 	github.com/beorn7/perks v0.0.0-20160804104726-4c0e84591b9a // indirect
-	github.com/cenk/backoff v1.0.1-0.20160904140958-8edc80b07f38
-	github.com/coreos/go-iptables v0.1.0
-	github.com/go-ini/ini v0.0.0-20151119163333-2e44421e256d // indirect
+	github.com/coreos/go-iptables v0.6.0
 	github.com/gorilla/context v1.1.1 // indirect
 	github.com/gorilla/mux v0.0.0-20160920230813-757bef944d0f
-	github.com/jmespath/go-jmespath v0.0.0-20151117175822-3433f3ea46d9 // indirect
-	github.com/karlseguin/ccache v2.0.1-0.20160708030345-2f6b517f7bea+incompatible
-	github.com/karlseguin/expect v1.0.1 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/prometheus/client_golang v0.9.0-pre1
 	github.com/prometheus/client_model v0.0.0-20171117100541-99fa1f4be8e5 // indirect
@@ -20,14 +15,12 @@ require (
 	github.com/prometheus/procfs v0.0.0-20180310141954-54d17b57dd7d // indirect
 	github.com/ryanuber/go-glob v0.0.0-20170128012129-256dc444b735
 	github.com/sirupsen/logrus v1.0.6
-	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/spf13/pflag v1.0.5
-	github.com/wsxiaoys/terminal v0.0.0-20160513160801-0940f3fc43a0 // indirect
-	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550 // indirect
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
 	gopkg.in/airbrake/gobrake.v2 v2.0.9 // indirect
 	gopkg.in/gemnasium/logrus-airbrake-hook.v2 v2.1.2 // indirect
-	gopkg.in/karlseguin/expect.v1 v1.0.1 // indirect
 	k8s.io/api v0.17.3
 	k8s.io/apimachinery v0.17.3
 	k8s.io/client-go v0.17.3
+	sigs.k8s.io/yaml v1.1.0
 )
@@ -0,0 +1,394 @@
+package iam
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jtblin/kube2iam/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultCacheMaxEntries is the default maximum number of credentials held by the cache.
+	DefaultCacheMaxEntries = 10000
+
+	cachePurgeInterval = time.Minute
+
+	// Credentials are never served from the cache when they expire within this margin.
+	credentialsExpiryMargin = 5 * time.Minute
+)
+
+// cacheEntry holds the credentials of an assume role request.
+type cacheEntry struct {
+	key         string
+	roleARN     string
+	sessionName string
+	credentials *Credentials
+	// expires is when the credentials stop being served from the cache.
+	expires time.Time
+	// validUntil is when the credentials expire at STS, minus a safety margin.
+	validUntil time.Time
+	refreshAt  time.Time
+	lastUsed   time.Time
+	ttl        time.Duration
+	fetch      func() (*Credentials, error)
+	refreshing bool
+	// prefetched is set until the first request served by credentials obtained ahead of time.
+	prefetched bool
+	// hits counts the requests served from the cache since the entry was created.
+	hits    int
+	element *list.Element
+}
+
+// inflightCall is an assume role request in progress, shared by concurrent callers requesting the same credentials.
+type inflightCall struct {
+	done        chan struct{}
+	credentials *Credentials
+	err         error
+}
+
+// credentialCache is a size bounded LRU cache of credentials keyed on the full assume role request.
+type credentialCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*cacheEntry
+	lru        *list.List
+	inflight   map[string]*inflightCall
+	nextPurge  time.Time
+	now        func() time.Time
+	// Credentials used since their last refresh are renewed this long before they stop being served.
+	refreshWindow time.Duration
+}
+
+func newCredentialCache(maxEntries int) *credentialCache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultCacheMaxEntries
+	}
+	return &credentialCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*cacheEntry),
+		lru:        list.New(),
+		inflight:   make(map[string]*inflightCall),
+		now:        time.Now,
+	}
+}
+
+// credentialCacheKey returns the cache key of an assume role request. Every parameter
+// that changes the resulting credentials must be part of the key.
+func credentialCacheKey(roleARN, externalID, sessionName string, opts *SessionOptions) string {
+	h := sha256.New()
+	for _, part := range []string{roleARN, externalID, sessionName, opts.cacheKey()} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get returns the credentials cached for key, if present and not expired.
+func (c *credentialCache) Get(key string) (*Credentials, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(key)
+}
+
+func (c *credentialCache) get(key string) (*Credentials, bool) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	now := c.now()
+	if now.After(entry.validUntil) {
+		c.remove(entry, metrics.IamCacheEvictionExpired)
+		return nil, false
+	}
+	if now.After(entry.expires) {
+		// Keep the entry around, its credentials can still be served if they can't be renewed
+		return nil, false
+	}
+	entry.lastUsed = now
+	entry.hits++
+	c.lru.MoveToFront(entry.element)
+	if entry.prefetched {
+		metrics.IamPrefetchHitCount.WithLabelValues(entry.roleARN).Inc()
+		entry.prefetched = false
+	}
+	return entry.credentials, true
+}
+
+// stale returns the credentials cached for key that are no longer served from the cache but are still valid.
+func (c *credentialCache) stale(key string) (*Credentials, bool) {
+	entry, ok := c.entries[key]
+	if !ok || c.now().After(entry.validUntil) {
+		return nil, false
+	}
+	entry.lastUsed = c.now()
+	return entry.credentials, true
+}
+
+// Set caches credentials for key for the duration of ttl, evicting the least recently used
+// entries when the cache is full. fetch is used to renew the credentials in the background.
+func (c *credentialCache) Set(key, roleARN, sessionName string, credentials *Credentials, ttl time.Duration, fetch func() (*Credentials, error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, roleARN, sessionName, credentials, ttl, fetch)
+}
+
+func (c *credentialCache) set(key, roleARN, sessionName string, credentials *Credentials, ttl time.Duration, fetch func() (*Credentials, error)) {
+	now := c.now()
+	if now.After(c.nextPurge) {
+		c.purgeExpired(now)
+		c.nextPurge = now.Add(cachePurgeInterval)
+	}
+
+	entry, ok := c.entries[key]
+	if !ok {
+		for c.lru.Len() >= c.maxEntries {
+			c.remove(c.lru.Back().Value.(*cacheEntry), metrics.IamCacheEvictionCapacity)
+		}
+		entry = &cacheEntry{key: key, roleARN: roleARN, sessionName: sessionName, lastUsed: now}
+		entry.element = c.lru.PushFront(entry)
+		c.entries[key] = entry
+		metrics.IamCacheEntries.Set(float64(len(c.entries)))
+	} else {
+		c.lru.MoveToFront(entry.element)
+	}
+
+	entry.credentials = credentials
+	entry.ttl = ttl
+	entry.fetch = fetch
+	entry.expires = now.Add(ttl)
+	entry.validUntil = entry.expires
+	if expiration, err := time.Parse(credentialsTimeFormat, credentials.Expiration); err == nil {
+		entry.validUntil = expiration.Add(-credentialsExpiryMargin)
+	}
+	entry.refreshAt = c.nextRefresh(now, ttl)
+}
+
+// nextRefresh returns when credentials cached at now for the duration of ttl should be renewed.
+// A random jitter spreads the renewal of credentials cached at the same time.
+func (c *credentialCache) nextRefresh(now time.Time, ttl time.Duration) time.Time {
+	window := c.refreshWindow
+	if window > ttl/2 {
+		window = ttl / 2
+	}
+	if window <= 0 {
+		return time.Time{}
+	}
+	jitter := time.Duration(rand.Int63n(int64(window)/2 + 1))
+	return now.Add(ttl - window - jitter)
+}
+
+// Fetch returns the credentials cached for key, calling fetch to obtain them on a cache miss.
+// Concurrent misses for the same key share a single call to fetch. Credentials that are no longer
+// served from the cache but are still valid are returned when fetch fails.
+func (c *credentialCache) Fetch(key, roleARN, sessionName string, ttl time.Duration, fetch func() (*Credentials, error)) (*Credentials, bool, error) {
+	c.mu.Lock()
+	if credentials, ok := c.get(key); ok {
+		c.mu.Unlock()
+		return credentials, true, nil
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.credentials, false, call.err
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	call.credentials, call.err = fetch()
+
+	c.mu.Lock()
+	if call.err == nil {
+		c.set(key, roleARN, sessionName, call.credentials, ttl, fetch)
+	} else if credentials, ok := c.stale(key); ok {
+		log.Warnf("Serving cached credentials for %s after error renewing them: %+v", roleARN, call.err)
+		call.credentials, call.err = credentials, nil
+	}
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(call.done)
+	return call.credentials, false, call.err
+}
+
+// Prefetch caches the credentials for key ahead of their first request, unless they are already cached.
+func (c *credentialCache) Prefetch(key, roleARN, sessionName string, ttl time.Duration, fetch func() (*Credentials, error)) error {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	cached := ok && c.now().Before(entry.expires)
+	c.mu.Unlock()
+	if cached {
+		return nil
+	}
+
+	_, hit, err := c.Fetch(key, roleARN, sessionName, ttl, fetch)
+	if err != nil || hit {
+		return err
+	}
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok {
+		entry.prefetched = true
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// refreshTask is an entry due for renewal along with the function renewing it, copied while holding the lock
+// as the entry may be updated while it is being renewed.
+type refreshTask struct {
+	entry *cacheEntry
+	fetch func() (*Credentials, error)
+}
+
+// dueForRefresh returns the recently used entries that are due for renewal.
+func (c *credentialCache) dueForRefresh() []refreshTask {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	var due []refreshTask
+	for _, entry := range c.entries {
+		if entry.refreshing || entry.refreshAt.IsZero() || now.Before(entry.refreshAt) {
+			continue
+		}
+		if now.Sub(entry.lastUsed) > 2*entry.ttl {
+			// Not used for the lifetime of the credentials handed out, let it expire
+			continue
+		}
+		entry.refreshing = true
+		due = append(due, refreshTask{entry: entry, fetch: entry.fetch})
+	}
+	return due
+}
+
+// refresh renews the credentials of the entry of task. On failure the current credentials keep being
+// served for as long as they are valid and renewal is retried on the next run.
+func (c *credentialCache) refresh(task refreshTask) {
+	credentials, err := task.fetch()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := task.entry
+	entry.refreshing = false
+	if c.entries[entry.key] != entry {
+		// Evicted while being renewed
+		return
+	}
+	if err != nil {
+		metrics.IamCacheRefreshCount.WithLabelValues(metrics.IamResultFailure).Inc()
+		log.Errorf("Error renewing cached credentials for %s: %+v", entry.roleARN, err)
+		if entry.validUntil.After(entry.expires) {
+			entry.expires = entry.validUntil
+		}
+		return
+	}
+	metrics.IamCacheRefreshCount.WithLabelValues(metrics.IamResultSuccess).Inc()
+	c.set(entry.key, entry.roleARN, entry.sessionName, credentials, entry.ttl, entry.fetch)
+}
+
+// runRefresher renews the credentials due for renewal every interval until stopCh is closed.
+func (c *credentialCache) runRefresher(interval time.Duration, concurrency int, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	sem := make(chan struct{}, concurrency)
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		for _, task := range c.dueForRefresh() {
+			sem <- struct{}{}
+			go func(task refreshTask) {
+				defer func() { <-sem }()
+				c.refresh(task)
+			}(task)
+		}
+	}
+}
+
+// CacheStatus describes the credentials cached for an assume role request, without the credentials themselves.
+type CacheStatus struct {
+	Cached      bool   `json:"cached"`
+	Role        string `json:"role,omitempty"`
+	SessionName string `json:"sessionName,omitempty"`
+	// Stale is set when the credentials are no longer served from the cache but can still be served if they
+	// can't be renewed.
+	Stale bool `json:"stale,omitempty"`
+	// Expires is when the credentials stop being served from the cache and Expiration when they expire at STS.
+	Expires    string `json:"expires,omitempty"`
+	Expiration string `json:"expiration,omitempty"`
+	RefreshAt  string `json:"refreshAt,omitempty"`
+	LastUsed   string `json:"lastUsed,omitempty"`
+	Hits       int    `json:"hits"`
+	Prefetched bool   `json:"prefetched,omitempty"`
+}
+
+// Status returns the status of the credentials cached for key, it doesn't count as a use of the entry.
+func (c *credentialCache) Status(key string) CacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	now := c.now()
+	if !ok || now.After(entry.validUntil) {
+		return CacheStatus{}
+	}
+	return entry.status(now)
+}
+
+// Entries returns the status of the valid credentials in the cache, most recently used first.
+func (c *credentialCache) Entries() []CacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	entries := make([]CacheStatus, 0, len(c.entries))
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		if entry := e.Value.(*cacheEntry); !now.After(entry.validUntil) {
+			entries = append(entries, entry.status(now))
+		}
+	}
+	return entries
+}
+
+func (entry *cacheEntry) status(now time.Time) CacheStatus {
+	status := CacheStatus{
+		Cached:      true,
+		Role:        entry.roleARN,
+		SessionName: entry.sessionName,
+		Stale:       now.After(entry.expires),
+		Expires:     entry.expires.UTC().Format(credentialsTimeFormat),
+		Expiration:  entry.credentials.Expiration,
+		LastUsed:    entry.lastUsed.UTC().Format(credentialsTimeFormat),
+		Hits:        entry.hits,
+		Prefetched:  entry.prefetched,
+	}
+	if !entry.refreshAt.IsZero() {
+		status.RefreshAt = entry.refreshAt.UTC().Format(credentialsTimeFormat)
+	}
+	return status
+}
+
+// Len returns the number of cached entries, including expired entries not purged yet.
+func (c *credentialCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func (c *credentialCache) purgeExpired(now time.Time) {
+	for _, entry := range c.entries {
+		if now.After(entry.validUntil) {
+			c.remove(entry, metrics.IamCacheEvictionExpired)
+		}
+	}
+}
+
+func (c *credentialCache) remove(entry *cacheEntry, reason string) {
+	c.lru.Remove(entry.element)
+	delete(c.entries, entry.key)
+	metrics.IamCacheEvictionCount.WithLabelValues(reason).Inc()
+	metrics.IamCacheEntries.Set(float64(len(c.entries)))
+}
@@ -0,0 +1,294 @@
+package iam
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCredentialCacheKey(t *testing.T) {
+	base := credentialCacheKey("arn:aws:iam::123456789012:role/a", "", "session", nil)
+	var keyTests = []struct {
+		test string
+		key  string
+	}{
+		{
+			test: "Different role",
+			key:  credentialCacheKey("arn:aws:iam::123456789012:role/b", "", "session", nil),
+		},
+		{
+			test: "Different external ID",
+			key:  credentialCacheKey("arn:aws:iam::123456789012:role/a", "external-id", "session", nil),
+		},
+		{
+			test: "Different session name",
+			key:  credentialCacheKey("arn:aws:iam::123456789012:role/a", "", "other-session", nil),
+		},
+		{
+			test: "Different session options",
+			key:  credentialCacheKey("arn:aws:iam::123456789012:role/a", "", "session", &SessionOptions{Policy: "{}"}),
+		},
+		{
+			test: "Parameters shifted between fields",
+			key:  credentialCacheKey("arn:aws:iam::123456789012:role/", "a", "session", nil),
+		},
+	}
+
+	for _, tt := range keyTests {
+		t.Run(tt.test, func(t *testing.T) {
+			if tt.key == base {
+				t.Errorf("Expected key to differ from %s", base)
+			}
+		})
+	}
+}
+
+func TestCredentialCacheExpiry(t *testing.T) {
+	now := time.Now()
+	c := newCredentialCache(10)
+	c.now = func() time.Time { return now }
+
+	c.Set("a", "role", "session", &Credentials{AccessKeyID: "a"}, time.Minute, nil)
+	if credentials, ok := c.Get("a"); !ok || credentials.AccessKeyID != "a" {
+		t.Errorf("Expected credentials for a but received %+v", credentials)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.Get("a"); ok {
+		t.Error("Expected credentials for a to be expired")
+	}
+	if c.Len() != 0 {
+		t.Errorf("Expected expired entry to be removed but cache has %d entries", c.Len())
+	}
+}
+
+func TestCredentialCacheCapacity(t *testing.T) {
+	c := newCredentialCache(2)
+	c.Set("a", "role", "session", &Credentials{AccessKeyID: "a"}, time.Minute, nil)
+	c.Set("b", "role", "session", &Credentials{AccessKeyID: "b"}, time.Minute, nil)
+	// Use a so that b is the least recently used entry
+	c.Get("a")
+	c.Set("c", "role", "session", &Credentials{AccessKeyID: "c"}, time.Minute, nil)
+
+	if c.Len() != 2 {
+		t.Errorf("Expected 2 entries but cache has %d", c.Len())
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Error("Expected least recently used entry b to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("Expected entry %s to be cached", key)
+		}
+	}
+}
+
+func TestCredentialCacheFetch(t *testing.T) {
+	c := newCredentialCache(10)
+	var calls int32
+	release := make(chan struct{})
+	fetch := func() (*Credentials, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &Credentials{AccessKeyID: "a"}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := c.Fetch("a", "role", "session", time.Minute, fetch); err != nil {
+				t.Errorf("Didn't expect error but recieved %s", err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("Expected concurrent fetches to be shared but fetch was called %d times", calls)
+	}
+	if _, hit, _ := c.Fetch("a", "role", "session", time.Minute, fetch); !hit {
+		t.Error("Expected cache hit")
+	}
+
+	_, _, err := c.Fetch("b", "role", "session", time.Minute, func() (*Credentials, error) {
+		return nil, errors.New("AccessDenied")
+	})
+	if err == nil {
+		t.Error("Expected error however didn't recieve one")
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Error("Expected errors not to be cached")
+	}
+}
+
+func TestCredentialCacheRefresh(t *testing.T) {
+	now := time.Now()
+	c := newCredentialCache(10)
+	c.now = func() time.Time { return now }
+	c.refreshWindow = 5 * time.Minute
+
+	var fail bool
+	fetch := func() (*Credentials, error) {
+		if fail {
+			return nil, errors.New("Throttling")
+		}
+		return &Credentials{AccessKeyID: "renewed"}, nil
+	}
+	credentials := &Credentials{
+		AccessKeyID: "a",
+		Expiration:  now.Add(30 * time.Minute).UTC().Format(credentialsTimeFormat),
+	}
+	c.Set("used", "role", "session", credentials, 15*time.Minute, fetch)
+	c.Set("unused", "role", "session", credentials, 15*time.Minute, fetch)
+
+	if due := c.dueForRefresh(); len(due) != 0 {
+		t.Errorf("Expected no entry due for refresh but recieved %d", len(due))
+	}
+
+	// Past the refresh window, the unused entry has not been requested since well before that
+	now = now.Add(14 * time.Minute)
+	c.entries["unused"].lastUsed = now.Add(-time.Hour)
+	c.Get("used")
+	due := c.dueForRefresh()
+	if len(due) != 1 || due[0].entry.key != "used" {
+		t.Fatalf("Expected only the used entry to be due for refresh but recieved %+v", due)
+	}
+
+	fail = true
+	c.refresh(due[0])
+	now = now.Add(2 * time.Minute)
+	if cached, ok := c.Get("used"); !ok || cached.AccessKeyID != "a" {
+		t.Errorf("Expected old credentials to be served after failed refresh but recieved %+v", cached)
+	}
+
+	fail = false
+	due = c.dueForRefresh()
+	if len(due) != 1 {
+		t.Fatalf("Expected failed refresh to be retried but recieved %d entries", len(due))
+	}
+	c.refresh(due[0])
+	if cached, ok := c.Get("used"); !ok || cached.AccessKeyID != "renewed" {
+		t.Errorf("Expected renewed credentials but recieved %+v", cached)
+	}
+}
+
+func TestCredentialCacheRefreshWhileSet(t *testing.T) {
+	now := time.Now()
+	c := newCredentialCache(10)
+	c.now = func() time.Time { return now }
+	c.refreshWindow = 5 * time.Minute
+
+	fetch := func() (*Credentials, error) {
+		return &Credentials{AccessKeyID: "renewed"}, nil
+	}
+	c.Set("a", "role", "session", &Credentials{AccessKeyID: "a"}, 15*time.Minute, fetch)
+	now = now.Add(14 * time.Minute)
+	c.Get("a")
+	due := c.dueForRefresh()
+	if len(due) != 1 {
+		t.Fatalf("Expected the entry to be due for refresh but recieved %d entries", len(due))
+	}
+
+	// The entry is updated by a request while being renewed, which is reported by the race detector
+	// unless the renewal uses the fetch function copied by dueForRefresh.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.refresh(due[0])
+	}()
+	c.Set("a", "role", "session", &Credentials{AccessKeyID: "b"}, 15*time.Minute, fetch)
+	<-done
+	if _, ok := c.Get("a"); !ok {
+		t.Error("Expected the entry to still be cached")
+	}
+}
+
+func TestCredentialCachePrefetch(t *testing.T) {
+	c := newCredentialCache(10)
+	var calls int32
+	fetch := func() (*Credentials, error) {
+		atomic.AddInt32(&calls, 1)
+		return &Credentials{AccessKeyID: "a"}, nil
+	}
+
+	if err := c.Prefetch("a", "role", "session", time.Minute, fetch); err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	if !c.entries["a"].prefetched {
+		t.Error("Expected entry to be marked as prefetched")
+	}
+	if err := c.Prefetch("a", "role", "session", time.Minute, fetch); err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected cached credentials not to be prefetched again but fetch was called %d times", calls)
+	}
+
+	if _, hit, _ := c.Fetch("a", "role", "session", time.Minute, fetch); !hit {
+		t.Error("Expected cache hit")
+	}
+	if c.entries["a"].prefetched {
+		t.Error("Expected prefetched flag to be cleared by the first request")
+	}
+
+	if err := c.Prefetch("b", "role", "session", time.Minute, func() (*Credentials, error) {
+		return nil, errors.New("AccessDenied")
+	}); err == nil {
+		t.Error("Expected error however didn't recieve one")
+	}
+}
+
+func TestCredentialCacheStatus(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newCredentialCache(10)
+	c.now = func() time.Time { return now }
+
+	if status := c.Status("a"); status.Cached {
+		t.Errorf("Expected no cached credentials but recieved %+v", status)
+	}
+
+	c.Set("a", "role", "session", &Credentials{AccessKeyID: "a", Expiration: "2020-01-01T01:00:00Z"}, 15*time.Minute, nil)
+	status := c.Status("a")
+	if !status.Cached || status.Stale || status.Expires != "2020-01-01T00:15:00Z" || status.Expiration != "2020-01-01T01:00:00Z" {
+		t.Errorf("Expected cached credentials expiring at 2020-01-01T00:15:00Z but recieved %+v", status)
+	}
+
+	now = now.Add(30 * time.Minute)
+	c.Status("a")
+	if status = c.Status("a"); !status.Cached || !status.Stale {
+		t.Errorf("Expected stale credentials but recieved %+v", status)
+	}
+	if status.LastUsed != "2020-01-01T00:00:00Z" {
+		t.Errorf("Expected status not to count as a use but recieved %+v", status)
+	}
+
+	now = now.Add(time.Hour)
+	if status := c.Status("a"); status.Cached {
+		t.Errorf("Expected expired credentials not to be reported but recieved %+v", status)
+	}
+}
+
+func TestCredentialCacheEntries(t *testing.T) {
+	c := newCredentialCache(10)
+	c.Set("a", "role-a", "session-a", &Credentials{AccessKeyID: "a", SecretAccessKey: "secret"}, time.Minute, nil)
+	c.Set("b", "role-b", "session-b", &Credentials{AccessKeyID: "b", SecretAccessKey: "secret"}, time.Minute, nil)
+	c.Get("a")
+	c.Get("a")
+
+	entries := c.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries but recieved %+v", entries)
+	}
+	if entries[0].Role != "role-a" || entries[0].SessionName != "session-a" || entries[0].Hits != 2 {
+		t.Errorf("Expected most recently used entry role-a with 2 hits but recieved %+v", entries[0])
+	}
+	if entries[1].Role != "role-b" || entries[1].Hits != 0 {
+		t.Errorf("Expected entry role-b without hits but recieved %+v", entries[1])
+	}
+}
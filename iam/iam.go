@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"hash/fnv"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -14,14 +15,16 @@ import (
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"github.com/jtblin/kube2iam/metrics"
-	"github.com/karlseguin/ccache"
 )
 
-var cache = ccache.New(ccache.Configure())
-
 const (
-	maxSessNameLength = 64
+	maxSessNameLength     = 64
+	credentialsTimeFormat = "2006-01-02T15:04:05Z"
+
+	refresherInterval    = 10 * time.Second
+	refresherConcurrency = 10
 )
 
 // Client represents an IAM client.
@@ -29,6 +32,42 @@ type Client struct {
 	BaseARN             string
 	Endpoint            string
 	UseRegionalEndpoint bool
+	// TransitiveTagKeys lists the session tag keys that persist when the assumed role assumes another role.
+	TransitiveTagKeys []string
+	// STS assumes the roles, a client of the regional or global endpoint is created for each request when nil.
+	STS   stsiface.STSAPI
+	cache *credentialCache
+}
+
+// SessionOptions holds the optional parameters of an assumed role session.
+type SessionOptions struct {
+	// Tags are passed as STS session tags.
+	Tags map[string]string
+	// Policy is an inline session policy scoping down the permissions of the role.
+	Policy string
+	// PolicyARNs are managed session policies scoping down the permissions of the role.
+	PolicyARNs []string
+}
+
+// cacheKey returns a representation of the options that differs whenever the resulting credentials differ.
+func (o *SessionOptions) cacheKey() string {
+	if o == nil || (len(o.Tags) == 0 && o.Policy == "" && len(o.PolicyARNs) == 0) {
+		return ""
+	}
+	keys := make([]string, 0, len(o.Tags))
+	for k := range o.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%q=%q;", k, o.Tags[k])
+	}
+	// The whole policy is part of the key as the cache hashes it, the order of managed policies doesn't matter
+	policyARNs := append([]string(nil), o.PolicyARNs...)
+	sort.Strings(policyARNs)
+	fmt.Fprintf(&b, "policy=%q;arns=%q", o.Policy, policyARNs)
+	return b.String()
 }
 
 // Credentials represent the security Credentials response.
@@ -77,6 +116,12 @@ func sessionName(roleARN, remoteIP string) string {
 	return fmt.Sprintf("%.[2]*[1]s", name, maxSessNameLength)
 }
 
+// ErrorCode returns the AWS error code of an error returned by AssumeRole, or UnknownError if the error
+// wasn't returned by AWS.
+func ErrorCode(err error) string {
+	return getIAMCode(err)
+}
+
 // Helper to format IAM return codes for metric labeling
 func getIAMCode(err error) string {
 	if err != nil {
@@ -126,12 +171,68 @@ func (iam *Client) EndpointFor(service, region string, optFns ...func(*endpoints
 	return endpoints.DefaultResolver().EndpointFor(service, region, optFns...)
 }
 
+// sessionTags converts session tags to their STS representation, along with the transitive tag keys
+// that are part of the tags.
+func (iam *Client) sessionTags(tags map[string]string) ([]*sts.Tag, []*string) {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	stsTags := make([]*sts.Tag, 0, len(keys))
+	for _, k := range keys {
+		stsTags = append(stsTags, &sts.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+
+	var transitiveKeys []*string
+	for _, k := range iam.TransitiveTagKeys {
+		if _, ok := tags[k]; ok {
+			transitiveKeys = append(transitiveKeys, aws.String(k))
+		}
+	}
+	return stsTags, transitiveKeys
+}
+
 // AssumeRole returns an IAM role Credentials using AWS STS.
-func (iam *Client) AssumeRole(roleARN, externalID string, remoteIP string, sessionTTL time.Duration) (*Credentials, error) {
-	hitCache := true
-	item, err := cache.Fetch(roleARN, sessionTTL, func() (interface{}, error) {
-		hitCache = false
+func (iam *Client) AssumeRole(roleARN, externalID string, remoteIP string, sessionTTL time.Duration, opts *SessionOptions) (*Credentials, error) {
+	roleSessionName := sessionName(roleARN, remoteIP)
+	key := credentialCacheKey(roleARN, externalID, roleSessionName, opts)
+	credentials, hitCache, err := iam.cache.Fetch(key, roleARN, roleSessionName, sessionTTL, iam.assumeRoleFunc(roleARN, externalID, roleSessionName, sessionTTL, opts))
+	if hitCache {
+		metrics.IamCacheHitCount.WithLabelValues(roleARN).Inc()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
 
+// CacheStatus returns the status of the credentials cached for the role of remoteIP.
+func (iam *Client) CacheStatus(roleARN, externalID string, remoteIP string, opts *SessionOptions) CacheStatus {
+	return iam.cache.Status(credentialCacheKey(roleARN, externalID, sessionName(roleARN, remoteIP), opts))
+}
+
+// CacheEntries returns the status of the credentials in the cache, most recently used first.
+func (iam *Client) CacheEntries() []CacheStatus {
+	return iam.cache.Entries()
+}
+
+// SessionName returns the role session name of the credentials of remoteIP for a role.
+func SessionName(roleARN, remoteIP string) string {
+	return sessionName(roleARN, remoteIP)
+}
+
+// Prefetch assumes a role ahead of the first request from remoteIP so that its credentials are served from the cache.
+func (iam *Client) Prefetch(roleARN, externalID string, remoteIP string, sessionTTL time.Duration, opts *SessionOptions) error {
+	roleSessionName := sessionName(roleARN, remoteIP)
+	key := credentialCacheKey(roleARN, externalID, roleSessionName, opts)
+	return iam.cache.Prefetch(key, roleARN, roleSessionName, sessionTTL, iam.assumeRoleFunc(roleARN, externalID, roleSessionName, sessionTTL, opts))
+}
+
+// assumeRoleFunc returns a function assuming a role using AWS STS.
+func (iam *Client) assumeRoleFunc(roleARN, externalID, roleSessionName string, sessionTTL time.Duration, opts *SessionOptions) func() (*Credentials, error) {
+	return func() (*Credentials, error) {
 		// Set up a prometheus timer to track the AWS request duration. It stores the timer value when
 		// observed. A function gets err at observation time to report the status of the request after the function returns.
 		var err error
@@ -141,32 +242,52 @@ func (iam *Client) AssumeRole(roleARN, externalID string, remoteIP string, sessi
 		timer := metrics.NewFunctionTimer(metrics.IamRequestSec, lvsProducer, nil)
 		defer timer.ObserveDuration()
 
-		sess, err := session.NewSession()
-		if err != nil {
-			return nil, err
-		}
-		config := aws.NewConfig().WithLogLevel(2)
-		config.HTTPClient = &http.Client{
-			// The AWS default http time out is zero, which means the request will never time out
-			// This behaviour will cause the latency issues at downstream
-			// Based on the behaviour of downstream we can decide to choose the minimal time out something less than one second
-			// By default the AWS standard retryer will tries 3 times, every time the timeout exceeds
-			Timeout: 100 * time.Millisecond,
-		}
+		svc := iam.STS
+		if svc == nil {
+			sess, err := session.NewSession()
+			if err != nil {
+				return nil, err
+			}
+			config := aws.NewConfig().WithLogLevel(2)
+			config.HTTPClient = &http.Client{
+				// The AWS default http time out is zero, which means the request will never time out
+				// This behaviour will cause the latency issues at downstream
+				// Based on the behaviour of downstream we can decide to choose the minimal time out something less than one second
+				// By default the AWS standard retryer will tries 3 times, every time the timeout exceeds
+				Timeout: 100 * time.Millisecond,
+			}
 
-		if iam.UseRegionalEndpoint {
-			config = config.WithEndpointResolver(iam)
+			if iam.UseRegionalEndpoint {
+				config = config.WithEndpointResolver(iam)
+			}
+			svc = sts.New(sess, config)
 		}
-		svc := sts.New(sess, config)
 		assumeRoleInput := sts.AssumeRoleInput{
 			DurationSeconds: aws.Int64(int64(sessionTTL.Seconds() * 2)),
 			RoleArn:         aws.String(roleARN),
-			RoleSessionName: aws.String(sessionName(roleARN, remoteIP)),
+			RoleSessionName: aws.String(roleSessionName),
 		}
 		// Only inject the externalID if one was provided with the request
 		if externalID != "" {
 			assumeRoleInput.SetExternalId(externalID)
 		}
+		if opts != nil && opts.Policy != "" {
+			assumeRoleInput.SetPolicy(opts.Policy)
+		}
+		if opts != nil && len(opts.PolicyARNs) > 0 {
+			policyARNs := make([]*sts.PolicyDescriptorType, len(opts.PolicyARNs))
+			for i, arn := range opts.PolicyARNs {
+				policyARNs[i] = &sts.PolicyDescriptorType{Arn: aws.String(arn)}
+			}
+			assumeRoleInput.SetPolicyArns(policyARNs)
+		}
+		if opts != nil && len(opts.Tags) > 0 {
+			tags, transitiveKeys := iam.sessionTags(opts.Tags)
+			assumeRoleInput.SetTags(tags)
+			if len(transitiveKeys) > 0 {
+				assumeRoleInput.SetTransitiveTagKeys(transitiveKeys)
+			}
+		}
 		resp, err := svc.AssumeRole(&assumeRoleInput)
 		if err != nil {
 			return nil, err
@@ -175,27 +296,29 @@ func (iam *Client) AssumeRole(roleARN, externalID string, remoteIP string, sessi
 		return &Credentials{
 			AccessKeyID:     *resp.Credentials.AccessKeyId,
 			Code:            "Success",
-			Expiration:      resp.Credentials.Expiration.Format("2006-01-02T15:04:05Z"),
-			LastUpdated:     time.Now().Format("2006-01-02T15:04:05Z"),
+			Expiration:      resp.Credentials.Expiration.Format(credentialsTimeFormat),
+			LastUpdated:     time.Now().Format(credentialsTimeFormat),
 			SecretAccessKey: *resp.Credentials.SecretAccessKey,
 			Token:           *resp.Credentials.SessionToken,
 			Type:            "AWS-HMAC",
 		}, nil
-	})
-	if hitCache {
-		metrics.IamCacheHitCount.WithLabelValues(roleARN).Inc()
-	}
-	if err != nil {
-		return nil, err
 	}
-	return item.Value().(*Credentials), nil
 }
 
-// NewClient returns a new IAM client.
-func NewClient(baseARN string, regional bool) *Client {
+// RunRefresher renews cached credentials that are still in use before they expire, until stopCh is closed.
+func (iam *Client) RunRefresher(stopCh <-chan struct{}) {
+	iam.cache.runRefresher(refresherInterval, refresherConcurrency, stopCh)
+}
+
+// NewClient returns a new IAM client caching up to cacheMaxEntries credentials. Credentials still in use
+// are renewed refreshWindow before they expire from the cache when the refresher is running.
+func NewClient(baseARN string, regional bool, cacheMaxEntries int, refreshWindow time.Duration) *Client {
+	cache := newCredentialCache(cacheMaxEntries)
+	cache.refreshWindow = refreshWindow
 	return &Client{
 		BaseARN:             baseARN,
 		Endpoint:            "sts.amazonaws.com",
 		UseRegionalEndpoint: regional,
+		cache:               cache,
 	}
 }
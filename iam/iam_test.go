@@ -42,3 +42,53 @@ func TestIsValidRegionWithInvalid(t *testing.T) {
 		}
 	}
 }
+
+func TestSessionOptionsCacheKey(t *testing.T) {
+	var nilOpts *SessionOptions
+	if nilOpts.cacheKey() != (&SessionOptions{}).cacheKey() {
+		t.Error("nil and empty options should have the same cache key")
+	}
+
+	a := &SessionOptions{Tags: map[string]string{"team": "a", "ns": "default"}}
+	b := &SessionOptions{Tags: map[string]string{"ns": "default", "team": "a"}}
+	if a.cacheKey() != b.cacheKey() {
+		t.Errorf("%s and %s should be equal", a.cacheKey(), b.cacheKey())
+	}
+
+	c := &SessionOptions{Tags: map[string]string{"team": "b", "ns": "default"}}
+	if a.cacheKey() == c.cacheKey() {
+		t.Errorf("%s and %s should differ", a.cacheKey(), c.cacheKey())
+	}
+
+	d := &SessionOptions{Tags: a.Tags, Policy: `{"Version":"2012-10-17"}`}
+	if a.cacheKey() == d.cacheKey() {
+		t.Errorf("%s and %s should differ", a.cacheKey(), d.cacheKey())
+	}
+
+	// FNV-32 hashes of these collide
+	g := &SessionOptions{Policy: "costarring"}
+	h := &SessionOptions{Policy: "liquid"}
+	if g.cacheKey() == h.cacheKey() {
+		t.Errorf("%s and %s should differ", g.cacheKey(), h.cacheKey())
+	}
+
+	e := &SessionOptions{PolicyARNs: []string{"arn:aws:iam::aws:policy/a", "arn:aws:iam::aws:policy/b"}}
+	f := &SessionOptions{PolicyARNs: []string{"arn:aws:iam::aws:policy/b", "arn:aws:iam::aws:policy/a"}}
+	if e.cacheKey() != f.cacheKey() {
+		t.Errorf("%s and %s should be equal", e.cacheKey(), f.cacheKey())
+	}
+	if e.cacheKey() == nilOpts.cacheKey() {
+		t.Errorf("%s and %s should differ", e.cacheKey(), nilOpts.cacheKey())
+	}
+}
+
+func TestSessionTags(t *testing.T) {
+	client := &Client{TransitiveTagKeys: []string{"team", "missing"}}
+	tags, transitiveKeys := client.sessionTags(map[string]string{"team": "a", "ns": "default"})
+	if len(tags) != 2 || *tags[0].Key != "ns" || *tags[1].Key != "team" {
+		t.Errorf("Unexpected tags %+v", tags)
+	}
+	if len(transitiveKeys) != 1 || *transitiveKeys[0] != "team" {
+		t.Errorf("Unexpected transitive tag keys %+v", transitiveKeys)
+	}
+}
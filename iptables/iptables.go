@@ -1,44 +1,213 @@
 package iptables
 
 import (
-	"errors"
 	"net"
+	"strconv"
 	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
+	log "github.com/sirupsen/logrus"
 )
 
-// AddRule adds the required rule to the host's nat table.
-func AddRule(appPort, metadataAddress, hostInterface, hostIP string) error {
+const (
+	table = "nat"
+	// chain holds the kube2iam rules, it is jumped to from the top of PREROUTING.
+	chain = "KUBE2IAM"
+)
 
-	if err := checkInterfaceExists(hostInterface); err != nil {
-		return err
+// spec returns the iptables rule specification of r.
+func (r Rule) spec() []string {
+	return append(r.legacySpec(), "-m", "comment", "--comment", iptablesComment(r))
+}
+
+// legacySpec returns the iptables rule specification of r in earlier versions, added directly to PREROUTING.
+func (r Rule) legacySpec() []string {
+	return []string{
+		"-p", "tcp", "-d", r.MetadataAddress, "--dport", "80",
+		"-j", "DNAT", "--to-destination", net.JoinHostPort(r.HostIP, r.AppPort), "-i", r.HostInterface,
+	}
+}
+
+// iptablesComment returns the comment identifying the rule of an interface in the kube2iam chain.
+func iptablesComment(r Rule) string {
+	return "kube2iam:" + r.HostInterface
+}
+
+// ipTables is the subset of the iptables commands used to manage the rules.
+type ipTables interface {
+	ChainExists(table, chain string) (bool, error)
+	NewChain(table, chain string) error
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Append(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+	DeleteIfExists(table, chain string, rulespec ...string) error
+	List(table, chain string) ([]string, error)
+}
+
+// iptablesBackend maintains the kube2iam rules in a dedicated chain of the host's nat table, using
+// ip6tables for the rules of IPv6 host IPs.
+type iptablesBackend struct {
+	rules  map[iptables.Protocol][]Rule
+	tables map[iptables.Protocol]ipTables
+}
+
+// Ensure creates the kube2iam chain, the jump to it and its rules when they are missing, and
+// returns the number of rules that had to be added.
+func (b *iptablesBackend) Ensure() (int, error) {
+	added := 0
+	for proto, rules := range b.rules {
+		ipt := b.tables[proto]
+
+		exists, err := ipt.ChainExists(table, chain)
+		if err != nil {
+			return added, err
+		}
+		if !exists {
+			if err := ipt.NewChain(table, chain); err != nil {
+				return added, err
+			}
+		}
+
+		// Jump to the chain ahead of any other rule so that the metadata traffic can't be redirected elsewhere
+		jump := []string{"-j", chain}
+		if exists, err = ipt.Exists(table, "PREROUTING", jump...); err != nil {
+			return added, err
+		}
+		if !exists {
+			if err := ipt.Insert(table, "PREROUTING", 1, jump...); err != nil {
+				return added, err
+			}
+			added++
+		}
+
+		if err := b.removeStale(ipt, rules); err != nil {
+			return added, err
+		}
+
+		for _, rule := range rules {
+			// Earlier versions added the rules directly to PREROUTING
+			if err := ipt.DeleteIfExists(table, "PREROUTING", rule.legacySpec()...); err != nil {
+				return added, err
+			}
+			if exists, err = ipt.Exists(table, chain, rule.spec()...); err != nil {
+				return added, err
+			}
+			if !exists {
+				if err := ipt.Append(table, chain, rule.spec()...); err != nil {
+					return added, err
+				}
+				added++
+			}
+		}
 	}
+	return added, nil
+}
 
-	if hostIP == "" {
-		return errors.New("--host-ip must be set")
+// removeStale removes the rules of the kube2iam chain that are not part of rules, such as the rules
+// of interfaces that are no longer configured or of a previous port. The rules are deleted by number,
+// from the last one so that the numbers of the remaining rules don't change, as the rules listed by
+// iptables -S are normalized and quoted and can't be given back to iptables -D as is.
+func (b *iptablesBackend) removeStale(ipt ipTables, rules []Rule) error {
+	expected := make(map[Rule]bool, len(rules))
+	for _, rule := range rules {
+		expected[rule] = true
 	}
 
-	ipt, err := iptables.New()
+	listed, err := ipt.List(table, chain)
 	if err != nil {
 		return err
 	}
+	var stale []int
+	num := 0
+	for _, rule := range listed {
+		if !strings.HasPrefix(rule, "-A ") {
+			continue
+		}
+		num++
+		if parsed, ok := parseRule(rule); ok && expected[parsed] {
+			continue
+		}
+		log.Infof("Removing stale iptables rule %s", rule)
+		stale = append(stale, num)
+	}
+	for i := len(stale) - 1; i >= 0; i-- {
+		if err := ipt.Delete(table, chain, strconv.Itoa(stale[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRule returns the Rule of a kube2iam chain rule listed by iptables -S, and false when the rule
+// isn't a rule kube2iam would add, i.e. it doesn't match the spec of the parsed Rule.
+func parseRule(listed string) (Rule, bool) {
+	var rule Rule
+	fields := make(map[string]string)
+	args := strings.Fields(listed)
+	for i := 0; i+1 < len(args); i++ {
+		if strings.HasPrefix(args[i], "-") {
+			fields[args[i]] = strings.Trim(args[i+1], `"`)
+		}
+	}
 
-	return ipt.AppendUnique(
-		"nat", "PREROUTING", "-p", "tcp", "-d", metadataAddress, "--dport", "80",
-		"-j", "DNAT", "--to-destination", hostIP+":"+appPort, "-i", hostInterface,
-	)
+	rule.MetadataAddress = strings.TrimSuffix(strings.TrimSuffix(fields["-d"], "/32"), "/128")
+	rule.HostInterface = fields["-i"]
+	host, port, err := net.SplitHostPort(fields["--to-destination"])
+	if err != nil {
+		return rule, false
+	}
+	rule.HostIP, rule.AppPort = host, port
+	ok := fields["-p"] == "tcp" && fields["--dport"] == "80" && fields["-j"] == "DNAT" &&
+		fields["--comment"] == iptablesComment(rule)
+	return rule, ok
 }
 
-// checkInterfaceExists validates the interface passed exists for the given system.
-// checkInterfaceExists ignores wildcard networks.
-func checkInterfaceExists(hostInterface string) error {
+// Cleanup removes the jump to the kube2iam chain and the chain itself.
+func (b *iptablesBackend) Cleanup() error {
+	for proto := range b.rules {
+		ipt := b.tables[proto]
+		if err := ipt.DeleteIfExists(table, "PREROUTING", "-j", chain); err != nil {
+			return err
+		}
+		exists, err := ipt.ChainExists(table, chain)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if err := ipt.ClearChain(table, chain); err != nil {
+			return err
+		}
+		if err := ipt.DeleteChain(table, chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if strings.Contains(hostInterface, "+") {
-		// wildcard networks ignored
-		return nil
+func newIptablesBackend(rules []Rule) (*iptablesBackend, error) {
+	b := &iptablesBackend{
+		rules:  make(map[iptables.Protocol][]Rule),
+		tables: make(map[iptables.Protocol]ipTables),
 	}
+	for _, rule := range rules {
+		proto, err := protocol(rule.MetadataAddress, rule.HostIP)
+		if err != nil {
+			return nil, err
+		}
+		b.rules[proto] = append(b.rules[proto], rule)
 
-	_, err := net.InterfaceByName(hostInterface)
-	return err
+		if _, ok := b.tables[proto]; !ok {
+			ipt, err := iptables.NewWithProtocol(proto)
+			if err != nil {
+				return nil, err
+			}
+			b.tables[proto] = ipt
+		}
+	}
+	return b, nil
 }
@@ -1,8 +1,14 @@
 package iptables
 
 import (
+	"errors"
+	"reflect"
 	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
 )
 
 func TestCheckInterfaceExistsFailsWithBogusInterface(t *testing.T) {
@@ -29,6 +35,13 @@ func TestCheckInterfaceExistsPassesWithValidInterface(t *testing.T) {
 	}
 }
 
+func TestCheckInterfaceExistsFailsWithPlusNotLast(t *testing.T) {
+	ifc := "cali+0"
+	if err := checkInterfaceExists(ifc); err == nil {
+		t.Error("Should fail with invalid interface pattern. Interface received:", ifc)
+	}
+}
+
 func TestCheckInterfaceExistsPassesWithPlus(t *testing.T) {
 	ifc := "cali+"
 	if err := checkInterfaceExists(ifc); err != nil {
@@ -36,6 +49,331 @@ func TestCheckInterfaceExistsPassesWithPlus(t *testing.T) {
 	}
 }
 
-func TestAddRule(t *testing.T) {
-	t.Skip()
+func TestProtocol(t *testing.T) {
+	var protocolTests = []struct {
+		test            string
+		metadataAddress string
+		hostIP          string
+		expected        iptables.Protocol
+		expectError     bool
+	}{
+		{
+			test:            "IPv4",
+			metadataAddress: "169.254.169.254",
+			hostIP:          "10.0.0.1",
+			expected:        iptables.ProtocolIPv4,
+		},
+		{
+			test:            "IPv6",
+			metadataAddress: "fd00:ec2::254",
+			hostIP:          "2600:1f14::1",
+			expected:        iptables.ProtocolIPv6,
+		},
+		{
+			test:            "Mixed IP families",
+			metadataAddress: "169.254.169.254",
+			hostIP:          "2600:1f14::1",
+			expectError:     true,
+		},
+		{
+			test:            "Invalid host IP",
+			metadataAddress: "169.254.169.254",
+			hostIP:          "node",
+			expectError:     true,
+		},
+	}
+
+	for _, tt := range protocolTests {
+		t.Run(tt.test, func(t *testing.T) {
+			resp, err := protocol(tt.metadataAddress, tt.hostIP)
+			if tt.expectError && err == nil {
+				t.Error("Expected error however didn't recieve one")
+				return
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Didn't expect error but recieved %s", err)
+				return
+			}
+			if !tt.expectError && resp != tt.expected {
+				t.Errorf("Response [%v] did not equal expected [%v]", resp, tt.expected)
+			}
+		})
+	}
+}
+
+type fakeIPTables struct {
+	chains map[string][]string
+}
+
+func (f *fakeIPTables) ChainExists(table, chain string) (bool, error) {
+	_, ok := f.chains[chain]
+	return ok, nil
+}
+func (f *fakeIPTables) NewChain(table, chain string) error {
+	f.chains[chain] = []string{}
+	return nil
+}
+func (f *fakeIPTables) ClearChain(table, chain string) error {
+	f.chains[chain] = []string{}
+	return nil
+}
+func (f *fakeIPTables) DeleteChain(table, chain string) error {
+	delete(f.chains, chain)
+	return nil
+}
+func (f *fakeIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	for _, rule := range f.chains[chain] {
+		if rule == strings.Join(rulespec, " ") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (f *fakeIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	f.chains[chain] = append([]string{strings.Join(rulespec, " ")}, f.chains[chain]...)
+	return nil
+}
+func (f *fakeIPTables) Append(table, chain string, rulespec ...string) error {
+	f.chains[chain] = append(f.chains[chain], strings.Join(rulespec, " "))
+	return nil
+}
+
+// List renders the rules the way iptables -S does, with the destination masked and the comments quoted.
+func (f *fakeIPTables) List(table, chain string) ([]string, error) {
+	listed := []string{"-N " + chain}
+	for _, rule := range f.chains[chain] {
+		args := strings.Fields(rule)
+		for i := 1; i < len(args); i++ {
+			switch args[i-1] {
+			case "-d":
+				if strings.Contains(args[i], ":") {
+					args[i] += "/128"
+				} else {
+					args[i] += "/32"
+				}
+			case "--comment":
+				if strings.ContainsAny(args[i], ":+") {
+					args[i] = `"` + args[i] + `"`
+				}
+			}
+		}
+		listed = append(listed, "-A "+chain+" "+strings.Join(args, " "))
+	}
+	return listed, nil
+}
+func (f *fakeIPTables) Delete(table, chain string, rulespec ...string) error {
+	if len(rulespec) == 1 {
+		if num, err := strconv.Atoi(rulespec[0]); err == nil {
+			if num < 1 || num > len(f.chains[chain]) {
+				return errors.New("index of deletion too big")
+			}
+			f.chains[chain] = append(f.chains[chain][:num-1], f.chains[chain][num:]...)
+			return nil
+		}
+	}
+	if exists, _ := f.Exists(table, chain, rulespec...); !exists {
+		return errors.New("bad rule (does a matching rule exist in that chain?)")
+	}
+	return f.DeleteIfExists(table, chain, rulespec...)
+}
+func (f *fakeIPTables) DeleteIfExists(table, chain string, rulespec ...string) error {
+	rules := f.chains[chain][:0]
+	for _, rule := range f.chains[chain] {
+		if rule != strings.Join(rulespec, " ") {
+			rules = append(rules, rule)
+		}
+	}
+	f.chains[chain] = rules
+	return nil
+}
+
+func TestIptablesBackend(t *testing.T) {
+	rule := Rule{AppPort: "8181", MetadataAddress: "169.254.169.254", HostInterface: "cali+", HostIP: "10.0.0.1"}
+	legacy := strings.Join(rule.legacySpec(), " ")
+	expected := strings.Join(rule.spec(), " ")
+	stale := strings.Join(Rule{AppPort: "8181", MetadataAddress: "169.254.169.254", HostInterface: "docker0", HostIP: "10.0.0.1"}.spec(), " ")
+	// Same comment as the rule but redirecting to a previous port
+	previousPort := strings.Join(Rule{AppPort: "8080", MetadataAddress: "169.254.169.254", HostInterface: "cali+", HostIP: "10.0.0.1"}.spec(), " ")
+	ipt := &fakeIPTables{chains: map[string][]string{
+		"PREROUTING": {"-j KUBE-SERVICES", legacy},
+		chain:        {stale, legacy, previousPort},
+	}}
+	m := &iptablesBackend{
+		rules:  map[iptables.Protocol][]Rule{iptables.ProtocolIPv4: {rule}},
+		tables: map[iptables.Protocol]ipTables{iptables.ProtocolIPv4: ipt},
+	}
+
+	if _, err := m.Ensure(); err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	if !reflect.DeepEqual(ipt.chains["PREROUTING"], []string{"-j KUBE2IAM", "-j KUBE-SERVICES"}) {
+		t.Errorf("Expected jump to the chain first and legacy rule removed but PREROUTING is %v", ipt.chains["PREROUTING"])
+	}
+	if !reflect.DeepEqual(ipt.chains[chain], []string{expected}) {
+		t.Errorf("Expected only the rule in the chain but recieved %v", ipt.chains[chain])
+	}
+
+	if restored, err := m.Ensure(); err != nil || restored != 0 {
+		t.Errorf("Expected no rule to be restored but recieved %d, %v", restored, err)
+	}
+
+	// Flushing the nat table removes the rules but not the chain
+	ipt.chains["PREROUTING"] = []string{"-j KUBE-SERVICES"}
+	ipt.chains[chain] = []string{}
+	if restored, err := m.Ensure(); err != nil || restored != 2 {
+		t.Errorf("Expected 2 rules to be restored but recieved %d, %v", restored, err)
+	}
+
+	if err := m.Cleanup(); err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	if _, ok := ipt.chains[chain]; ok {
+		t.Error("Expected chain to be deleted")
+	}
+	if !reflect.DeepEqual(ipt.chains["PREROUTING"], []string{"-j KUBE-SERVICES"}) {
+		t.Errorf("Expected jump to the chain to be removed but PREROUTING is %v", ipt.chains["PREROUTING"])
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	var parseTests = []struct {
+		test     string
+		listed   string
+		expected Rule
+		ok       bool
+	}{
+		{
+			test:     "IPv4",
+			listed:   `-A KUBE2IAM -d 169.254.169.254/32 -i cali+ -p tcp -m tcp --dport 80 -m comment --comment "kube2iam:cali+" -j DNAT --to-destination 10.0.0.1:8181`,
+			expected: Rule{AppPort: "8181", MetadataAddress: "169.254.169.254", HostInterface: "cali+", HostIP: "10.0.0.1"},
+			ok:       true,
+		},
+		{
+			test:     "IPv6",
+			listed:   `-A KUBE2IAM -d fd00:ec2::254/128 -i eni+ -p tcp -m tcp --dport 80 -m comment --comment "kube2iam:eni+" -j DNAT --to-destination [2600:1f14::1]:8181`,
+			expected: Rule{AppPort: "8181", MetadataAddress: "fd00:ec2::254", HostInterface: "eni+", HostIP: "2600:1f14::1"},
+			ok:       true,
+		},
+		{
+			test:   "Comment of another interface",
+			listed: `-A KUBE2IAM -d 169.254.169.254/32 -i cali+ -p tcp -m tcp --dport 80 -m comment --comment "kube2iam:docker0" -j DNAT --to-destination 10.0.0.1:8181`,
+		},
+		{
+			test:   "Not a DNAT rule",
+			listed: `-A KUBE2IAM -j RETURN`,
+		},
+	}
+
+	for _, tt := range parseTests {
+		t.Run(tt.test, func(t *testing.T) {
+			resp, ok := parseRule(tt.listed)
+			if ok != tt.ok {
+				t.Errorf("Expected ok [%t] but recieved [%t]", tt.ok, ok)
+			}
+			if tt.ok && resp != tt.expected {
+				t.Errorf("Response [%+v] did not equal expected [%+v]", resp, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDetectBackend(t *testing.T) {
+	ipv4 := Rule{AppPort: "8181", MetadataAddress: "169.254.169.254", HostInterface: "cali+", HostIP: "10.0.0.1"}
+	ipv6 := Rule{AppPort: "8181", MetadataAddress: "fd00:ec2::254", HostInterface: "cali+", HostIP: "2600:1f14::1"}
+	legacy := "*nat\n:PREROUTING ACCEPT [0:0]\n-A PREROUTING -m comment --comment \"kubernetes service portals\" -j KUBE-SERVICES\n-A KUBE-SERVICES -j KUBE-NODEPORTS\nCOMMIT\n"
+	ruleset := `table ip nat {
+	chain PREROUTING {
+		type nat hook prerouting priority dstnat; policy accept;
+		counter packets 0 bytes 0 jump KUBE-SERVICES
+	}
+
+	chain KUBE-SERVICES {
+		counter packets 0 bytes 0 jump KUBE-NODEPORTS
+		ip daddr 10.96.0.1 tcp dport 443 counter packets 0 bytes 0 jump KUBE-SVC-NPX46M4PTMTKRN6Y
+	}
+}
+table inet filter {
+	set allowed {
+		type ipv4_addr
+		elements = { 10.0.0.1, 10.0.0.2 }
+	}
+
+	chain input {
+		type filter hook input priority filter; policy accept;
+	}
+}
+`
+	var detectTests = []struct {
+		test        string
+		rules       []Rule
+		outputs     map[string]string
+		expected    string
+		expectError bool
+	}{
+		{
+			test:     "Legacy rules",
+			rules:    []Rule{ipv4},
+			outputs:  map[string]string{"iptables-legacy-save": legacy, "nft": ruleset},
+			expected: BackendIptables,
+		},
+		{
+			test:     "Legacy rules without nftables",
+			rules:    []Rule{ipv4},
+			outputs:  map[string]string{"iptables-legacy-save": legacy},
+			expected: BackendIptables,
+		},
+		{
+			test:     "Empty legacy tables",
+			rules:    []Rule{ipv4},
+			outputs:  map[string]string{"iptables-legacy-save": "", "nft": ruleset},
+			expected: BackendNftables,
+		},
+		{
+			test:        "Empty legacy tables without nftables",
+			rules:       []Rule{ipv4},
+			outputs:     map[string]string{"iptables-legacy-save": ""},
+			expectError: true,
+		},
+		{
+			test:        "Legacy tables not available",
+			rules:       []Rule{ipv4},
+			outputs:     map[string]string{"nft": ruleset},
+			expectError: true,
+		},
+		{
+			test:        "Legacy IPv6 tables not available",
+			rules:       []Rule{ipv4, ipv6},
+			outputs:     map[string]string{"iptables-legacy-save": legacy, "nft": ruleset},
+			expectError: true,
+		},
+		{
+			test:        "Nothing available",
+			rules:       []Rule{ipv4},
+			outputs:     map[string]string{},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range detectTests {
+		t.Run(tt.test, func(t *testing.T) {
+			run := func(name string, args ...string) (string, error) {
+				if out, ok := tt.outputs[name]; ok {
+					return out, nil
+				}
+				return "", errors.New("not found")
+			}
+			resp, err := detectBackend(tt.rules, run)
+			if tt.expectError && err == nil {
+				t.Error("Expected error however didn't recieve one")
+				return
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Didn't expect error but recieved %s", err)
+				return
+			}
+			if resp != tt.expected {
+				t.Errorf("Response [%s] did not equal expected [%s]", resp, tt.expected)
+			}
+		})
+	}
 }
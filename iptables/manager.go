@@ -0,0 +1,204 @@
+package iptables
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/jtblin/kube2iam/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// BackendAuto selects the backend the host already programs its rules with.
+	BackendAuto = "auto"
+	// BackendIptables programs the rules with iptables and ip6tables.
+	BackendIptables = "iptables"
+	// BackendNftables programs the rules with nft.
+	BackendNftables = "nftables"
+)
+
+// Rule redirects the metadata traffic coming from a host interface to kube2iam.
+type Rule struct {
+	AppPort         string
+	MetadataAddress string
+	HostInterface   string
+	HostIP          string
+}
+
+// Backend programs the rules redirecting the metadata traffic to kube2iam on the host.
+type Backend interface {
+	// Ensure adds the rules that are missing and returns how many were added.
+	Ensure() (int, error)
+	// Cleanup removes all the rules.
+	Cleanup() error
+}
+
+// Manager keeps the rules of a backend in place.
+type Manager struct {
+	backend Backend
+}
+
+// Ensure adds the rules that are missing and returns how many were added.
+func (m *Manager) Ensure() (int, error) {
+	return m.backend.Ensure()
+}
+
+// Run verifies the rules every interval until stopCh is closed, restoring them when they
+// were removed, e.g. by a CNI plugin or kube-proxy flushing the nat table.
+func (m *Manager) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		restored, err := m.backend.Ensure()
+		if restored > 0 {
+			metrics.IptablesRulesRestoredCount.Add(float64(restored))
+			log.Warnf("Restored %d missing iptables rules, pods may have reached the EC2 metadata API directly", restored)
+		}
+		if err != nil {
+			log.Errorf("Error verifying iptables rules: %+v", err)
+		}
+	}
+}
+
+// Cleanup removes all the rules.
+func (m *Manager) Cleanup() error {
+	return m.backend.Cleanup()
+}
+
+// NewManager returns a Manager for the rules, validating them, programmed with the backend.
+func NewManager(backend string, rules []Rule) (*Manager, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("at least one --host-interface must be set")
+	}
+	seen := make(map[Rule]bool, len(rules))
+	for _, rule := range rules {
+		if seen[rule] {
+			return nil, fmt.Errorf("host interface %s is set more than once", rule.HostInterface)
+		}
+		seen[rule] = true
+
+		if err := checkInterfaceExists(rule.HostInterface); err != nil {
+			return nil, err
+		}
+
+		if rule.HostIP == "" {
+			return nil, errors.New("--host-ip must be set")
+		}
+	}
+
+	if backend == BackendAuto {
+		var err error
+		if backend, err = detectBackend(rules, func(name string, args ...string) (string, error) {
+			return execCommand(name, "", args...)
+		}); err != nil {
+			return nil, err
+		}
+		log.Infof("Using %s to program the metadata rules", backend)
+	}
+
+	var b Backend
+	var err error
+	switch backend {
+	case BackendIptables:
+		b, err = newIptablesBackend(rules)
+	case BackendNftables:
+		b, err = newNftablesBackend(rules, execNft)
+	default:
+		err = fmt.Errorf("unknown backend %s, expected one of %s, %s or %s", backend, BackendAuto, BackendIptables, BackendNftables)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{backend: b}, nil
+}
+
+// detectBackend returns the backend the host already programs its rules with, the way iptables-wrapper picks
+// the iptables mode of kube-proxy: the binaries of both are installed in the kube2iam image, whatever the host uses.
+// The iptables backend is selected when the legacy iptables tables hold rules, and nftables when they are empty and
+// nftables can be listed. Any other host is ambiguous and requires an explicit backend.
+func detectBackend(rules []Rule, run func(name string, args ...string) (string, error)) (string, error) {
+	binaries := map[string]bool{}
+	for _, rule := range rules {
+		proto, err := protocol(rule.MetadataAddress, rule.HostIP)
+		if err != nil {
+			return "", err
+		}
+		if proto == iptables.ProtocolIPv6 {
+			binaries["ip6tables-legacy-save"] = true
+		} else {
+			binaries["iptables-legacy-save"] = true
+		}
+	}
+
+	legacy := 0
+	for binary := range binaries {
+		out, err := run(binary)
+		if err != nil {
+			return "", fmt.Errorf("legacy iptables tables can't be listed with %s, set --iptables-backend explicitly: %v", binary, err)
+		}
+		legacy += countIptablesRules(out)
+	}
+	if legacy > 0 {
+		return BackendIptables, nil
+	}
+	if _, err := run("nft", "list", "ruleset"); err != nil {
+		return "", fmt.Errorf("nftables ruleset can't be listed and legacy iptables tables are empty, set --iptables-backend explicitly: %v", err)
+	}
+	return BackendNftables, nil
+}
+
+// countIptablesRules returns the number of rules in the output of iptables-save.
+func countIptablesRules(out string) int {
+	count := 0
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			count++
+		}
+	}
+	return count
+}
+
+// protocol returns the IP protocol of the rule redirecting metadataAddress to hostIP.
+func protocol(metadataAddress, hostIP string) (iptables.Protocol, error) {
+	metadataIP := net.ParseIP(metadataAddress)
+	if metadataIP == nil {
+		return iptables.ProtocolIPv4, fmt.Errorf("invalid metadata address %s", metadataAddress)
+	}
+	ip := net.ParseIP(hostIP)
+	if ip == nil {
+		return iptables.ProtocolIPv4, fmt.Errorf("invalid host IP %s", hostIP)
+	}
+	if (ip.To4() == nil) != (metadataIP.To4() == nil) {
+		return iptables.ProtocolIPv4, fmt.Errorf("host IP %s and metadata address %s are not of the same IP family", hostIP, metadataAddress)
+	}
+	if ip.To4() == nil {
+		return iptables.ProtocolIPv6, nil
+	}
+	return iptables.ProtocolIPv4, nil
+}
+
+// checkInterfaceExists validates the interface passed exists for the given system.
+// checkInterfaceExists ignores wildcard networks, which must end with a single +.
+func checkInterfaceExists(hostInterface string) error {
+
+	if strings.Contains(hostInterface, "+") {
+		if strings.Index(hostInterface, "+") != len(hostInterface)-1 {
+			return fmt.Errorf("invalid interface pattern %s, + is only allowed as the last character", hostInterface)
+		}
+		// wildcard networks ignored
+		return nil
+	}
+
+	_, err := net.InterfaceByName(hostInterface)
+	return err
+}
@@ -0,0 +1,165 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	nftTable = "kube2iam"
+	nftChain = "prerouting"
+	// Ahead of the dstnat priority of kube-proxy and the iptables-nft nat table
+	nftChainPriority = -101
+	// Rules are identified by a comment so that they are found whatever way nft prints them
+	nftCommentPrefix = "kube2iam:"
+)
+
+// commandRunner runs nft with args, feeding it stdin, and returns its output.
+type commandRunner func(stdin string, args ...string) (string, error)
+
+func execNft(stdin string, args ...string) (string, error) {
+	return execCommand("nft", stdin, args...)
+}
+
+// execCommand runs the command name with args, feeding it stdin, and returns its output.
+func execCommand(name, stdin string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %v: %s", strings.Join(append([]string{name}, args...), " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// nftablesBackend maintains the kube2iam rules in a dedicated table per IP family, on hosts
+// that only ship nftables.
+type nftablesBackend struct {
+	rules map[iptables.Protocol][]Rule
+	nft   commandRunner
+}
+
+// family returns the nftables family of the table holding the rules of proto.
+func family(proto iptables.Protocol) string {
+	if proto == iptables.ProtocolIPv6 {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// nftComment returns the comment identifying rule in its chain.
+func nftComment(rule Rule) string {
+	return nftCommentPrefix + rule.HostInterface
+}
+
+// nftRule returns the nftables statement of rule. Interface wildcards use * rather than the iptables +.
+func nftRule(proto iptables.Protocol, rule Rule) string {
+	return fmt.Sprintf("iifname %q %s daddr %s tcp dport 80 dnat to %s comment %q",
+		strings.Replace(rule.HostInterface, "+", "*", -1), family(proto), rule.MetadataAddress,
+		net.JoinHostPort(rule.HostIP, rule.AppPort), nftComment(rule))
+}
+
+// nftMatches returns whether a rule listed by nft is rule. The listed rule is compared by its comment along
+// with its destination and redirection, as nft prints the statements in its own way.
+func nftMatches(proto iptables.Protocol, listed string, rule Rule) bool {
+	return strings.Contains(listed, fmt.Sprintf("comment %q", nftComment(rule))) &&
+		strings.Contains(listed, fmt.Sprintf("%s daddr %s ", family(proto), rule.MetadataAddress)) &&
+		strings.Contains(listed, "dnat to "+net.JoinHostPort(rule.HostIP, rule.AppPort)+" ")
+}
+
+// missing returns the number of rules of proto not found in the kube2iam chain, all of them when the chain doesn't exist,
+// and whether the chain holds rules that are not part of the configured rules, such as the rules of a previous port.
+func (b *nftablesBackend) missing(proto iptables.Protocol) (int, bool) {
+	rules := b.rules[proto]
+	out, err := b.nft("", "list", "chain", family(proto), nftTable, nftChain)
+	if err != nil {
+		return len(rules), false
+	}
+
+	found := make([]bool, len(rules))
+	stale := false
+	for _, listed := range strings.Split(out, "\n") {
+		if !strings.Contains(listed, `comment "`+nftCommentPrefix) {
+			continue
+		}
+		matched := false
+		for i, rule := range rules {
+			if nftMatches(proto, listed, rule) {
+				found[i], matched = true, true
+			}
+		}
+		stale = stale || !matched
+	}
+
+	missing := 0
+	for _, ok := range found {
+		if !ok {
+			missing++
+		}
+	}
+	return missing, stale
+}
+
+// Ensure rewrites the kube2iam chain of each family in a single transaction when any of its rules is missing
+// or stale, and returns the number of rules that had to be added.
+func (b *nftablesBackend) Ensure() (int, error) {
+	added := 0
+	for proto, rules := range b.rules {
+		missing, stale := b.missing(proto)
+		if missing == 0 && !stale {
+			continue
+		}
+
+		var script strings.Builder
+		fmt.Fprintf(&script, "table %s %s {\n", family(proto), nftTable)
+		fmt.Fprintf(&script, "\tchain %s {\n\t\ttype nat hook prerouting priority %d; policy accept;\n\t}\n}\n", nftChain, nftChainPriority)
+		fmt.Fprintf(&script, "flush chain %s %s %s\n", family(proto), nftTable, nftChain)
+		for _, rule := range rules {
+			fmt.Fprintf(&script, "add rule %s %s %s %s\n", family(proto), nftTable, nftChain, nftRule(proto, rule))
+		}
+		if _, err := b.nft(script.String(), "-f", "-"); err != nil {
+			return added, err
+		}
+		added += missing
+	}
+	return added, nil
+}
+
+// Cleanup removes the kube2iam tables.
+func (b *nftablesBackend) Cleanup() error {
+	for proto := range b.rules {
+		out, err := b.nft("", "list", "tables", family(proto))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(out, fmt.Sprintf("table %s %s\n", family(proto), nftTable)) {
+			continue
+		}
+		if _, err := b.nft("", "delete", "table", family(proto), nftTable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newNftablesBackend(rules []Rule, nft commandRunner) (*nftablesBackend, error) {
+	b := &nftablesBackend{
+		rules: make(map[iptables.Protocol][]Rule),
+		nft:   nft,
+	}
+	for _, rule := range rules {
+		proto, err := protocol(rule.MetadataAddress, rule.HostIP)
+		if err != nil {
+			return nil, err
+		}
+		b.rules[proto] = append(b.rules[proto], rule)
+	}
+	return b, nil
+}
@@ -0,0 +1,224 @@
+package iptables
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// fakeNft keeps the scripts it runs as the ruleset, which is good enough to look rules up by their comment.
+type fakeNft struct {
+	tables map[string]string
+	calls  []string
+}
+
+func (f *fakeNft) run(stdin string, args ...string) (string, error) {
+	f.calls = append(f.calls, strings.Join(args, " "))
+	switch {
+	case len(args) == 2 && args[0] == "-f":
+		family := strings.Fields(stdin)[1]
+		f.tables[family] = stdin
+		return "", nil
+	case len(args) == 5 && args[0] == "list" && args[1] == "chain":
+		if ruleset, ok := f.tables[args[2]]; ok {
+			return ruleset, nil
+		}
+		return "", errors.New("No such file or directory")
+	case len(args) == 3 && args[0] == "list" && args[1] == "tables":
+		if _, ok := f.tables[args[2]]; ok {
+			return "table " + args[2] + " " + nftTable + "\n", nil
+		}
+		return "", nil
+	case len(args) == 4 && args[0] == "delete" && args[1] == "table":
+		delete(f.tables, args[2])
+		return "", nil
+	}
+	return "", errors.New("unexpected nft command")
+}
+
+func TestNftablesBackend(t *testing.T) {
+	rules := []Rule{
+		{AppPort: "8181", MetadataAddress: "169.254.169.254", HostInterface: "eni+", HostIP: "10.0.0.1"},
+		{AppPort: "8181", MetadataAddress: "fd00:ec2::254", HostInterface: "eni+", HostIP: "2600:1f14::1"},
+	}
+	nft := &fakeNft{tables: map[string]string{}}
+	b, err := newNftablesBackend(rules, nft.run)
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+
+	if added, err := b.Ensure(); err != nil || added != 2 {
+		t.Fatalf("Expected 2 rules to be added but recieved %d, %v", added, err)
+	}
+	for _, expected := range []string{
+		`add rule ip kube2iam prerouting iifname "eni*" ip daddr 169.254.169.254 tcp dport 80 dnat to 10.0.0.1:8181 comment "kube2iam:eni+"`,
+		"type nat hook prerouting priority -101; policy accept;",
+	} {
+		if !strings.Contains(nft.tables["ip"], expected) {
+			t.Errorf("Expected ruleset to contain [%s] but recieved [%s]", expected, nft.tables["ip"])
+		}
+	}
+	expected := `add rule ip6 kube2iam prerouting iifname "eni*" ip6 daddr fd00:ec2::254 tcp dport 80 dnat to [2600:1f14::1]:8181 comment "kube2iam:eni+"`
+	if !strings.Contains(nft.tables["ip6"], expected) {
+		t.Errorf("Expected ruleset to contain [%s] but recieved [%s]", expected, nft.tables["ip6"])
+	}
+
+	nft.calls = nil
+	if added, err := b.Ensure(); err != nil || added != 0 {
+		t.Errorf("Expected no rule to be added but recieved %d, %v", added, err)
+	}
+	for _, call := range nft.calls {
+		if call == "-f -" {
+			t.Error("Expected ruleset not to be rewritten when no rule is missing")
+		}
+	}
+
+	// Flushing the ruleset removes the tables
+	delete(nft.tables, "ip")
+	if added, err := b.Ensure(); err != nil || added != 1 {
+		t.Errorf("Expected 1 rule to be restored but recieved %d, %v", added, err)
+	}
+
+	if err := b.Cleanup(); err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	if len(nft.tables) != 0 {
+		t.Errorf("Expected tables to be deleted but recieved %v", nft.tables)
+	}
+}
+
+func TestNftablesBackendStaleRules(t *testing.T) {
+	rule := Rule{AppPort: "8181", MetadataAddress: "169.254.169.254", HostInterface: "eni+", HostIP: "10.0.0.1"}
+	stale := Rule{AppPort: "8181", MetadataAddress: "169.254.169.254", HostInterface: "docker0", HostIP: "10.0.0.1"}
+	nft := &fakeNft{tables: map[string]string{}}
+	b, err := newNftablesBackend([]Rule{rule, stale}, nft.run)
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	if _, err := b.Ensure(); err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+
+	// The docker0 interface is no longer set
+	b, err = newNftablesBackend([]Rule{rule}, nft.run)
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	if added, err := b.Ensure(); err != nil || added != 0 {
+		t.Errorf("Expected no rule to be added but recieved %d, %v", added, err)
+	}
+	if strings.Contains(nft.tables["ip"], nftComment(stale)) {
+		t.Errorf("Expected stale rule to be removed but recieved [%s]", nft.tables["ip"])
+	}
+	if !strings.Contains(nft.tables["ip"], nftComment(rule)) {
+		t.Errorf("Expected rule to be kept but recieved [%s]", nft.tables["ip"])
+	}
+}
+
+func TestNftablesBackendPortChange(t *testing.T) {
+	rule := Rule{AppPort: "8181", MetadataAddress: "169.254.169.254", HostInterface: "eni+", HostIP: "10.0.0.1"}
+	nft := &fakeNft{tables: map[string]string{}}
+	b, err := newNftablesBackend([]Rule{rule}, nft.run)
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	if _, err := b.Ensure(); err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+
+	// kube2iam now listens on another port, the rule keeps its comment but must redirect to the new port
+	rule.AppPort = "8080"
+	b, err = newNftablesBackend([]Rule{rule}, nft.run)
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	if added, err := b.Ensure(); err != nil || added != 1 {
+		t.Errorf("Expected 1 rule to be added but recieved %d, %v", added, err)
+	}
+	if !strings.Contains(nft.tables["ip"], "dnat to 10.0.0.1:8080 ") {
+		t.Errorf("Expected rule to redirect to the new port but recieved [%s]", nft.tables["ip"])
+	}
+	if strings.Contains(nft.tables["ip"], "dnat to 10.0.0.1:8181 ") {
+		t.Errorf("Expected rule of the previous port to be removed but recieved [%s]", nft.tables["ip"])
+	}
+}
+
+// The fixtures are the output of nft list chain for rules added by Ensure, which nft prints in its own way.
+func TestNftMatchesListedRules(t *testing.T) {
+	var matchTests = []struct {
+		test     string
+		fixture  string
+		proto    iptables.Protocol
+		rule     Rule
+		expected bool
+	}{
+		{
+			test:     "Wildcard interface",
+			fixture:  "testdata/nft-list-chain-ip.txt",
+			proto:    iptables.ProtocolIPv4,
+			rule:     Rule{AppPort: "8181", MetadataAddress: "169.254.169.254", HostInterface: "eth+", HostIP: "10.0.0.1"},
+			expected: true,
+		},
+		{
+			test:     "Interface",
+			fixture:  "testdata/nft-list-chain-ip.txt",
+			proto:    iptables.ProtocolIPv4,
+			rule:     Rule{AppPort: "8181", MetadataAddress: "169.254.169.254", HostInterface: "docker0", HostIP: "10.0.0.1"},
+			expected: true,
+		},
+		{
+			test:     "Other port",
+			fixture:  "testdata/nft-list-chain-ip.txt",
+			proto:    iptables.ProtocolIPv4,
+			rule:     Rule{AppPort: "8080", MetadataAddress: "169.254.169.254", HostInterface: "eth+", HostIP: "10.0.0.1"},
+			expected: false,
+		},
+		{
+			test:     "IPv6",
+			fixture:  "testdata/nft-list-chain-ip6.txt",
+			proto:    iptables.ProtocolIPv6,
+			rule:     Rule{AppPort: "8181", MetadataAddress: "fd00:ec2::254", HostInterface: "eth+", HostIP: "2600:1f14::1"},
+			expected: true,
+		},
+		{
+			test:     "Other IPv6 host IP",
+			fixture:  "testdata/nft-list-chain-ip6.txt",
+			proto:    iptables.ProtocolIPv6,
+			rule:     Rule{AppPort: "8181", MetadataAddress: "fd00:ec2::254", HostInterface: "eth+", HostIP: "2600:1f14::2"},
+			expected: false,
+		},
+	}
+
+	for _, tt := range matchTests {
+		t.Run(tt.test, func(t *testing.T) {
+			listed, err := ioutil.ReadFile(tt.fixture)
+			if err != nil {
+				t.Fatalf("Didn't expect error but recieved %s", err)
+			}
+			matched := false
+			for _, line := range strings.Split(string(listed), "\n") {
+				matched = matched || nftMatches(tt.proto, line, tt.rule)
+			}
+			if matched != tt.expected {
+				t.Errorf("Response [%t] did not equal expected [%t]", matched, tt.expected)
+			}
+
+			nft := &fakeNft{tables: map[string]string{}}
+			b, err := newNftablesBackend([]Rule{tt.rule}, func(stdin string, args ...string) (string, error) {
+				if len(args) == 5 && args[0] == "list" && args[1] == "chain" && args[2] == family(tt.proto) {
+					return string(listed), nil
+				}
+				return nft.run(stdin, args...)
+			})
+			if err != nil {
+				t.Fatalf("Didn't expect error but recieved %s", err)
+			}
+			if missing, _ := b.missing(tt.proto); (missing == 0) != tt.expected {
+				t.Errorf("Expected rule to be found %t but recieved %d missing", tt.expected, missing)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package k8s
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// EventReasonIAMRoleDenied is the reason of the events recorded when a pod is not allowed to assume its role.
+	EventReasonIAMRoleDenied = "IAMRoleDenied"
+	// EventReasonAssumeRoleFailed is the reason of the events recorded when STS fails to assume the role of a pod.
+	EventReasonAssumeRoleFailed = "AssumeRoleFailed"
+
+	eventComponent = "kube2iam"
+	// Pods retrying in a loop get a burst of events then one every 5 minutes so that they don't flood the API server
+	eventBurst = 5
+	eventQPS   = 1. / 300
+)
+
+// StartRecordingEvents starts sending the recorded events to the API server until stopCh is closed.
+func (k8s *Client) StartRecordingEvents(stopCh <-chan struct{}) {
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize: eventBurst,
+		QPS:       eventQPS,
+	})
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k8s.CoreV1().Events("")})
+	k8s.recorder = broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventComponent, Host: k8s.nodeName})
+
+	go func() {
+		<-stopCh
+		broadcaster.Shutdown()
+	}()
+}
+
+// RecordPodWarning records a warning event on a pod, events are dropped when recording isn't started.
+func (k8s *Client) RecordPodWarning(pod *v1.Pod, reason, messageFmt string, args ...interface{}) {
+	k8s.RecordWarning(pod, reason, messageFmt, args...)
+}
+
+// RecordWarning records a warning event on an object, events are dropped when recording isn't started.
+func (k8s *Client) RecordWarning(obj runtime.Object, reason, messageFmt string, args ...interface{}) {
+	if k8s.recorder == nil {
+		return
+	}
+	k8s.recorder.Eventf(obj, v1.EventTypeWarning, reason, messageFmt, args...)
+}
@@ -0,0 +1,32 @@
+package k8s
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRecordPodWarning(t *testing.T) {
+	pod := &v1.Pod{}
+	pod.Name = "web"
+	pod.Namespace = "default"
+
+	k8s := &Client{}
+	// Events are dropped until recording is started
+	k8s.RecordPodWarning(pod, EventReasonIAMRoleDenied, "Role %s denied", "admin")
+
+	recorder := record.NewFakeRecorder(1)
+	k8s.recorder = recorder
+	k8s.RecordPodWarning(pod, EventReasonAssumeRoleFailed, "Unable to assume role %s (%s)", "admin", "AccessDenied")
+
+	select {
+	case event := <-recorder.Events:
+		expected := "Warning AssumeRoleFailed Unable to assume role admin (AccessDenied)"
+		if event != expected {
+			t.Errorf("Expected event [%s] but recieved [%s]", expected, event)
+		}
+	default:
+		t.Error("Expected an event to be recorded")
+	}
+}
@@ -6,13 +6,18 @@ import (
 
 	"github.com/jtblin/kube2iam"
 	"github.com/jtblin/kube2iam/metrics"
+	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	selector "k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
@@ -23,10 +28,17 @@ const (
 // Client represents a kubernetes client.
 type Client struct {
 	*kubernetes.Clientset
+	dynamic             dynamic.Interface
 	namespaceController cache.Controller
 	namespaceIndexer    cache.Indexer
 	podController       cache.Controller
 	podIndexer          cache.Indexer
+	podIPs              *podIPNotifier
+	saController        cache.Controller
+	saIndexer           cache.Indexer
+	rbController        cache.Controller
+	rbIndexer           cache.Indexer
+	recorder            record.EventRecorder
 	nodeName            string
 	resolveDupIPs       bool
 }
@@ -40,16 +52,16 @@ func (k8s *Client) createPodLW() *cache.ListWatch {
 	return cache.NewListWatchFromClient(k8s.CoreV1().RESTClient(), "pods", v1.NamespaceAll, fieldSelector)
 }
 
-// WatchForPods watches for pod changes.
-func (k8s *Client) WatchForPods(podEventLogger cache.ResourceEventHandler, resyncPeriod time.Duration) cache.InformerSynced {
+// WatchForPods watches for pod changes until stopCh is closed.
+func (k8s *Client) WatchForPods(podEventLogger cache.ResourceEventHandler, resyncPeriod time.Duration, stopCh <-chan struct{}) cache.InformerSynced {
 	k8s.podIndexer, k8s.podController = cache.NewIndexerInformer(
 		k8s.createPodLW(),
 		&v1.Pod{},
 		resyncPeriod,
-		podEventLogger,
+		k8s.podIPs.handler(podEventLogger),
 		cache.Indexers{podIPIndexName: kube2iam.PodIPIndexFunc},
 	)
-	go k8s.podController.Run(wait.NeverStop)
+	go k8s.podController.Run(stopCh)
 	return k8s.podController.HasSynced
 }
 
@@ -58,8 +70,8 @@ func (k8s *Client) createNamespaceLW() *cache.ListWatch {
 	return cache.NewListWatchFromClient(k8s.CoreV1().RESTClient(), "namespaces", v1.NamespaceAll, selector.Everything())
 }
 
-// WatchForNamespaces watches for namespaces changes.
-func (k8s *Client) WatchForNamespaces(nsEventLogger cache.ResourceEventHandler, resyncPeriod time.Duration) cache.InformerSynced {
+// WatchForNamespaces watches for namespaces changes until stopCh is closed.
+func (k8s *Client) WatchForNamespaces(nsEventLogger cache.ResourceEventHandler, resyncPeriod time.Duration, stopCh <-chan struct{}) cache.InformerSynced {
 	k8s.namespaceIndexer, k8s.namespaceController = cache.NewIndexerInformer(
 		k8s.createNamespaceLW(),
 		&v1.Namespace{},
@@ -67,10 +79,74 @@ func (k8s *Client) WatchForNamespaces(nsEventLogger cache.ResourceEventHandler,
 		nsEventLogger,
 		cache.Indexers{namespaceIndexName: kube2iam.NamespaceIndexFunc},
 	)
-	go k8s.namespaceController.Run(wait.NeverStop)
+	go k8s.namespaceController.Run(stopCh)
 	return k8s.namespaceController.HasSynced
 }
 
+// returns a cache.ListWatch of service accounts.
+func (k8s *Client) createServiceAccountLW() *cache.ListWatch {
+	return cache.NewListWatchFromClient(k8s.CoreV1().RESTClient(), "serviceaccounts", v1.NamespaceAll, selector.Everything())
+}
+
+// WatchForServiceAccounts watches for service accounts changes until stopCh is closed.
+func (k8s *Client) WatchForServiceAccounts(saEventLogger cache.ResourceEventHandler, resyncPeriod time.Duration, stopCh <-chan struct{}) cache.InformerSynced {
+	k8s.saIndexer, k8s.saController = cache.NewIndexerInformer(
+		k8s.createServiceAccountLW(),
+		&v1.ServiceAccount{},
+		resyncPeriod,
+		saEventLogger,
+		cache.Indexers{},
+	)
+	go k8s.saController.Run(stopCh)
+	return k8s.saController.HasSynced
+}
+
+// returns a cache.ListWatch of IAMRoleBindings, converting the objects received from the dynamic client.
+func (k8s *Client) createRoleBindingLW() *cache.ListWatch {
+	resource := k8s.dynamic.Resource(kube2iam.IAMRoleBindingResource).Namespace(v1.NamespaceAll)
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			list, err := resource.List(options)
+			if err != nil {
+				return nil, err
+			}
+			return kube2iam.IAMRoleBindingListFromUnstructured(list)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			w, err := resource.Watch(options)
+			if err != nil {
+				return nil, err
+			}
+			return watch.Filter(w, func(in watch.Event) (watch.Event, bool) {
+				u, ok := in.Object.(*unstructured.Unstructured)
+				if !ok {
+					return in, true
+				}
+				rb, err := kube2iam.IAMRoleBindingFromUnstructured(u)
+				if err != nil {
+					log.Errorf("Unable to decode IAMRoleBinding %s/%s: %+v", u.GetNamespace(), u.GetName(), err)
+					return in, false
+				}
+				in.Object = rb
+				return in, true
+			}), nil
+		},
+	}
+}
+
+// WatchForRoleBindings watches for IAMRoleBinding changes until stopCh is closed.
+func (k8s *Client) WatchForRoleBindings(rbEventLogger cache.ResourceEventHandler, resyncPeriod time.Duration, stopCh <-chan struct{}) cache.InformerSynced {
+	k8s.rbIndexer, k8s.rbController = cache.NewIndexerInformer(
+		k8s.createRoleBindingLW(),
+		&kube2iam.IAMRoleBinding{},
+		resyncPeriod,
+		rbEventLogger,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+	go k8s.rbController.Run(stopCh)
+	return k8s.rbController.HasSynced
+}
+
 // ListPodIPs returns the underlying set of pods being managed/indexed
 func (k8s *Client) ListPodIPs() []string {
 	// Decided to simply dump this and leave it up to consumer
@@ -79,6 +155,16 @@ func (k8s *Client) ListPodIPs() []string {
 	return k8s.podIndexer.ListIndexFuncValues(podIPIndexName)
 }
 
+// ListPods returns the pods being managed/indexed, including the pods sharing an IP
+func (k8s *Client) ListPods() []*v1.Pod {
+	objs := k8s.podIndexer.List()
+	pods := make([]*v1.Pod, len(objs))
+	for i, obj := range objs {
+		pods[i] = obj.(*v1.Pod)
+	}
+	return pods
+}
+
 // ListNamespaces returns the underlying set of namespaces being managed/indexed
 func (k8s *Client) ListNamespaces() []string {
 	return k8s.namespaceIndexer.ListIndexFuncValues(namespaceIndexName)
@@ -116,6 +202,37 @@ func (k8s *Client) PodByIP(IP string) (*v1.Pod, error) {
 	return pod, nil
 }
 
+// PodByName retrieves a pod indexed by kube2iam by its namespace and name, only the pods of the node are indexed.
+func (k8s *Client) PodByName(namespaceName, name string) (*v1.Pod, error) {
+	pod, exists, err := k8s.podIndexer.GetByKey(namespaceName + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, fmt.Errorf("pod %s/%s was not found on node %s", namespaceName, name, k8s.nodeName)
+	}
+
+	return pod.(*v1.Pod), nil
+}
+
+// PodNamespaceByIP returns the namespace of the pods indexed with an IP, or an empty string if there are none or
+// they don't share a namespace. Unlike PodByIP it doesn't count missing pods.
+func (k8s *Client) PodNamespaceByIP(IP string) string {
+	pods, err := k8s.podIndexer.ByIndex(podIPIndexName, IP)
+	if err != nil || len(pods) == 0 {
+		return ""
+	}
+
+	namespace := pods[0].(*v1.Pod).GetNamespace()
+	for _, pod := range pods[1:] {
+		if pod.(*v1.Pod).GetNamespace() != namespace {
+			return ""
+		}
+	}
+	return namespace
+}
+
 // resolveDuplicatedIP queries the k8s api server trying to make a decision based on NON cached data
 // If the indexed pods all have HostNetwork = true the function return nil and the error message.
 // If we retrive a running pod that doesn't have HostNetwork = true and it is in Running state will return that.
@@ -152,6 +269,44 @@ func (k8s *Client) NamespaceByName(namespaceName string) (*v1.Namespace, error)
 	return namespace[0].(*v1.Namespace), nil
 }
 
+// ServiceAccountByName retrieves a service account by it's namespace and name.
+// Returns an error if service accounts are not being watched or the service account is not available
+func (k8s *Client) ServiceAccountByName(namespaceName, name string) (*v1.ServiceAccount, error) {
+	if k8s.saIndexer == nil {
+		return nil, fmt.Errorf("service accounts are not being watched")
+	}
+
+	sa, exists, err := k8s.saIndexer.GetByKey(namespaceName + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, fmt.Errorf("service account was not found")
+	}
+
+	return sa.(*v1.ServiceAccount), nil
+}
+
+// RoleBindingsByNamespace retrieves the IAMRoleBindings of a namespace.
+// Returns an error if IAMRoleBindings are not being watched
+func (k8s *Client) RoleBindingsByNamespace(namespaceName string) ([]*kube2iam.IAMRoleBinding, error) {
+	if k8s.rbIndexer == nil {
+		return nil, fmt.Errorf("IAMRoleBindings are not being watched")
+	}
+
+	objs, err := k8s.rbIndexer.ByIndex(cache.NamespaceIndex, namespaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := make([]*kube2iam.IAMRoleBinding, len(objs))
+	for i, obj := range objs {
+		bindings[i] = obj.(*kube2iam.IAMRoleBinding)
+	}
+	return bindings, nil
+}
+
 // NewClient returns a new kubernetes client.
 func NewClient(host, token, nodeName string, insecure, resolveDupIPs bool) (*Client, error) {
 	var config *rest.Config
@@ -174,5 +329,15 @@ func NewClient(host, token, nodeName string, insecure, resolveDupIPs bool) (*Cli
 	if err != nil {
 		return nil, err
 	}
-	return &Client{Clientset: client, nodeName: nodeName, resolveDupIPs: resolveDupIPs}, nil
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		Clientset:     client,
+		dynamic:       dynamicClient,
+		podIPs:        newPodIPNotifier(),
+		nodeName:      nodeName,
+		resolveDupIPs: resolveDupIPs,
+	}, nil
 }
@@ -0,0 +1,111 @@
+package k8s
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jtblin/kube2iam"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// podIPNotifier wakes up the requests waiting for a pod IP to be indexed by the pod informer.
+type podIPNotifier struct {
+	mu      sync.Mutex
+	waiters map[string][]chan struct{}
+}
+
+// subscribe returns a channel closed the next time a pod with the IP is indexed, and a function
+// to call once the caller stops waiting.
+func (n *podIPNotifier) subscribe(IP string) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	n.mu.Lock()
+	n.waiters[IP] = append(n.waiters[IP], ch)
+	n.mu.Unlock()
+
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		waiters := n.waiters[IP]
+		for i, w := range waiters {
+			if w == ch {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(n.waiters, IP)
+		} else {
+			n.waiters[IP] = waiters
+		}
+	}
+}
+
+// notify wakes up the requests waiting for any of the IPs of obj.
+func (n *podIPNotifier) notify(obj interface{}) {
+	IPs, err := kube2iam.PodIPIndexFunc(obj)
+	if err != nil || len(IPs) == 0 {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, IP := range IPs {
+		for _, ch := range n.waiters[IP] {
+			close(ch)
+		}
+		delete(n.waiters, IP)
+	}
+}
+
+// handler returns an event handler notifying the waiters before passing the events on to next.
+// The informer indexes objects before calling its handlers, so waiters find the pod when woken up.
+func (n *podIPNotifier) handler(next cache.ResourceEventHandler) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			n.notify(obj)
+			next.OnAdd(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			n.notify(newObj)
+			next.OnUpdate(oldObj, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			// The deletion of a pod can resolve a conflict between pods indexed with the same IP
+			if deletedObj, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				n.notify(deletedObj.Obj)
+			} else {
+				n.notify(obj)
+			}
+			next.OnDelete(obj)
+		},
+	}
+}
+
+func newPodIPNotifier() *podIPNotifier {
+	return &podIPNotifier{waiters: make(map[string][]chan struct{})}
+}
+
+// WaitForPodByIP returns the pod indexed with the IP, waiting up to timeout for the pod informer
+// to index it when it isn't yet. The last lookup error is returned when the timeout is reached.
+func (k8s *Client) WaitForPodByIP(IP string, timeout time.Duration) (*v1.Pod, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		// Subscribe before looking up the pod so that an event in between isn't missed
+		indexed, unsubscribe := k8s.podIPs.subscribe(IP)
+		pod, err := k8s.PodByIP(IP)
+		if err == nil {
+			unsubscribe()
+			return pod, nil
+		}
+
+		select {
+		case <-indexed:
+		case <-timer.C:
+			unsubscribe()
+			return nil, err
+		}
+	}
+}
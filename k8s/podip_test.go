@@ -0,0 +1,90 @@
+package k8s
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jtblin/kube2iam"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestClient() *Client {
+	return &Client{
+		podIndexer: cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{podIPIndexName: kube2iam.PodIPIndexFunc}),
+		podIPs:     newPodIPNotifier(),
+	}
+}
+
+func newTestPod(name, IP string) *v1.Pod {
+	pod := &v1.Pod{}
+	pod.Name = name
+	pod.Namespace = "default"
+	pod.Status.PodIP = IP
+	pod.Status.Phase = v1.PodRunning
+	return pod
+}
+
+func TestWaitForPodByIP(t *testing.T) {
+	k8s := newTestClient()
+	handler := k8s.podIPs.handler(cache.ResourceEventHandlerFuncs{})
+	k8s.podIndexer.Add(newTestPod("indexed", "10.0.0.1"))
+
+	if pod, err := k8s.WaitForPodByIP("10.0.0.1", time.Second); err != nil || pod.Name != "indexed" {
+		t.Errorf("Expected pod indexed but recieved %+v, %v", pod, err)
+	}
+
+	start := time.Now()
+	if _, err := k8s.WaitForPodByIP("10.0.0.2", 50*time.Millisecond); err == nil {
+		t.Error("Expected error however didn't recieve one")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected lookup to wait for the timeout but it returned after %s", elapsed)
+	}
+
+	// Index the pod the way the informer does, before calling the event handlers
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pod := newTestPod("late", "10.0.0.3")
+		k8s.podIndexer.Add(pod)
+		handler.OnAdd(pod)
+	}()
+	if pod, err := k8s.WaitForPodByIP("10.0.0.3", 5*time.Second); err != nil || pod.Name != "late" {
+		t.Errorf("Expected pod late but recieved %+v, %v", pod, err)
+	}
+
+	if len(k8s.podIPs.waiters) != 0 {
+		t.Errorf("Expected no waiters left but recieved %d", len(k8s.podIPs.waiters))
+	}
+}
+
+func TestPodByName(t *testing.T) {
+	k8s := newTestClient()
+	k8s.podIndexer.Add(newTestPod("indexed", "10.0.0.1"))
+
+	if pod, err := k8s.PodByName("default", "indexed"); err != nil || pod.Name != "indexed" {
+		t.Errorf("Expected pod indexed but recieved %+v, %v", pod, err)
+	}
+	if _, err := k8s.PodByName("other", "indexed"); err == nil {
+		t.Error("Expected error however didn't recieve one")
+	}
+}
+
+func TestPodNamespaceByIP(t *testing.T) {
+	k8s := newTestClient()
+	k8s.podIndexer.Add(newTestPod("indexed", "10.0.0.1"))
+	hostNetwork := newTestPod("host-network", "10.0.0.2")
+	hostNetwork.Namespace = "kube-system"
+	k8s.podIndexer.Add(hostNetwork)
+	k8s.podIndexer.Add(newTestPod("other-host-network", "10.0.0.2"))
+
+	if namespace := k8s.PodNamespaceByIP("10.0.0.1"); namespace != "default" {
+		t.Errorf("Expected namespace default but recieved %q", namespace)
+	}
+	if namespace := k8s.PodNamespaceByIP("10.0.0.2"); namespace != "" {
+		t.Errorf("Expected no namespace for pods of different namespaces but recieved %q", namespace)
+	}
+	if namespace := k8s.PodNamespaceByIP("10.0.0.3"); namespace != "" {
+		t.Errorf("Expected no namespace for unknown IP but recieved %q", namespace)
+	}
+}
@@ -0,0 +1,68 @@
+package mappings
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/jtblin/kube2iam/metrics"
+)
+
+// Violation summarizes the requests of a namespace for a role that namespace restrictions would have denied.
+type Violation struct {
+	Namespace string    `json:"namespace"`
+	Role      string    `json:"role"`
+	Count     int       `json:"count"`
+	LastPod   string    `json:"lastPod"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Reason    string    `json:"reason"`
+}
+
+// violationLog records the violations of namespace restrictions in audit mode.
+type violationLog struct {
+	mutex      sync.Mutex
+	violations map[string]*Violation
+}
+
+func newViolationLog() *violationLog {
+	return &violationLog{violations: make(map[string]*Violation)}
+}
+
+// record logs and counts a request of pod for role denied with reason.
+func (l *violationLog) record(role string, pod *v1.Pod, reason string) {
+	log.Warnf("Audit: role %s would be denied to pod %s on namespace %s: %s", role, pod.GetName(), pod.GetNamespace(), reason)
+	metrics.NamespaceRestrictionViolationCount.WithLabelValues(pod.GetNamespace(), role).Inc()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	key := pod.GetNamespace() + "/" + role
+	v, ok := l.violations[key]
+	if !ok {
+		v = &Violation{Namespace: pod.GetNamespace(), Role: role}
+		l.violations[key] = v
+	}
+	v.Count++
+	v.LastPod = pod.GetName()
+	v.LastSeen = time.Now()
+	v.Reason = reason
+}
+
+// list returns the recorded violations ordered by namespace and role.
+func (l *violationLog) list() []Violation {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	violations := make([]Violation, 0, len(l.violations))
+	for _, v := range l.violations {
+		violations = append(violations, *v)
+	}
+	sort.Slice(violations, func(i, j int) bool {
+		if violations[i].Namespace != violations[j].Namespace {
+			return violations[i].Namespace < violations[j].Namespace
+		}
+		return violations[i].Role < violations[j].Role
+	})
+	return violations
+}
@@ -0,0 +1,81 @@
+package mappings
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jtblin/kube2iam/iam"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestGetRoleMappingForPodAudit(t *testing.T) {
+	var auditTests = []struct {
+		test               string
+		audit              bool
+		role               string
+		expectError        bool
+		expectedViolations int
+	}{
+		{
+			test: "Allowed role",
+			role: "allowed-role",
+		},
+		{
+			test:        "Denied role enforced",
+			role:        "denied-role",
+			expectError: true,
+		},
+		{
+			test:               "Allowed role in audit mode",
+			audit:              true,
+			role:               "allowed-role",
+			expectedViolations: 0,
+		},
+		{
+			test:               "Denied role in audit mode",
+			audit:              true,
+			role:               "denied-role",
+			expectedViolations: 1,
+		},
+	}
+
+	for _, tt := range auditTests {
+		t.Run(tt.test, func(t *testing.T) {
+			config := newTestConfig()
+			config.Audit = tt.audit
+			rp := NewRoleMapper(
+				config,
+				&iam.Client{BaseARN: defaultBaseRole},
+				&storeMock{
+					namespace:   "default",
+					annotations: map[string]string{namespaceKey: `["allowed-role"]`},
+				},
+			)
+
+			pod := &v1.Pod{}
+			pod.Name = "web"
+			pod.Namespace = "default"
+			pod.Annotations = map[string]string{roleKey: tt.role}
+
+			result, err := rp.GetRoleMappingForPod(pod, "")
+			if tt.expectError != (err != nil) {
+				t.Fatalf("Expected error [%t] for test but recieved [%v]", tt.expectError, err)
+			}
+			var denied *RoleDeniedError
+			if err != nil && !errors.As(err, &denied) {
+				t.Errorf("Expected a RoleDeniedError for test but recieved [%v]", err)
+			}
+			if err == nil && result.Role != defaultBaseRole+tt.role {
+				t.Errorf("Expected role [%s] for test but recieved [%s]", defaultBaseRole+tt.role, result.Role)
+			}
+
+			violations := rp.violations.list()
+			if len(violations) != tt.expectedViolations {
+				t.Fatalf("Expected [%d] violations for test but recieved [%+v]", tt.expectedViolations, violations)
+			}
+			if tt.expectedViolations > 0 && (violations[0].Namespace != "default" || violations[0].Role != defaultBaseRole+tt.role || violations[0].LastPod != "web") {
+				t.Errorf("Unexpected violation [%+v] for test", violations[0])
+			}
+		})
+	}
+}
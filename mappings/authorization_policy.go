@@ -0,0 +1,143 @@
+package mappings
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	glob "github.com/ryanuber/go-glob"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// PolicyEffectAllow grants the roles of a rule.
+	PolicyEffectAllow = "allow"
+	// PolicyEffectDeny refuses the roles of a rule, deny rules take precedence over allow rules.
+	PolicyEffectDeny = "deny"
+)
+
+// AuthorizationPolicy grants roles to pods according to ordered rules. A role is allowed when no deny
+// rule matches the request and at least one allow rule does.
+type AuthorizationPolicy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule matches requests for its roles, every condition set must match the request.
+type PolicyRule struct {
+	// Name identifies the rule in the reason of decisions.
+	Name   string `json:"name"`
+	Effect string `json:"effect"`
+	// Roles lists the role patterns of the rule, following the namespace restriction format.
+	Roles []string `json:"roles"`
+	// PodSelector and NamespaceSelector are label selectors, e.g. "team=a,env in (dev, staging)".
+	PodSelector       string `json:"podSelector,omitempty"`
+	NamespaceSelector string `json:"namespaceSelector,omitempty"`
+	// ServiceAccounts and Nodes list glob patterns of service account and node names.
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"`
+	Nodes           []string `json:"nodes,omitempty"`
+
+	podSelector       labels.Selector
+	namespaceSelector labels.Selector
+}
+
+// LoadAuthorizationPolicy reads an authorization policy from a YAML or JSON file, e.g. a mounted ConfigMap.
+func LoadAuthorizationPolicy(path string) (*AuthorizationPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAuthorizationPolicy(data)
+}
+
+// ParseAuthorizationPolicy parses and validates an authorization policy.
+func ParseAuthorizationPolicy(data []byte) (*AuthorizationPolicy, error) {
+	policy := &AuthorizationPolicy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("invalid authorization policy: %v", err)
+	}
+
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if rule.Effect != PolicyEffectAllow && rule.Effect != PolicyEffectDeny {
+			return nil, fmt.Errorf("invalid effect %q of authorization policy rule %s, expected %s or %s", rule.Effect, rule.Name, PolicyEffectAllow, PolicyEffectDeny)
+		}
+		if len(rule.Roles) == 0 {
+			return nil, fmt.Errorf("authorization policy rule %s has no roles", rule.Name)
+		}
+
+		var err error
+		if rule.podSelector, err = labels.Parse(rule.PodSelector); err != nil {
+			return nil, fmt.Errorf("invalid pod selector of authorization policy rule %s: %v", rule.Name, err)
+		}
+		if rule.namespaceSelector, err = labels.Parse(rule.NamespaceSelector); err != nil {
+			return nil, fmt.Errorf("invalid namespace selector of authorization policy rule %s: %v", rule.Name, err)
+		}
+	}
+	return policy, nil
+}
+
+// matches returns whether the rule applies to the request, roles are matched with matchRole.
+func (rule *PolicyRule) matches(req *AuthorizationRequest, matchRole func(pattern, roleARN string) bool) bool {
+	if !rule.selects(req) {
+		return false
+	}
+	for _, pattern := range rule.Roles {
+		if matchRole(pattern, req.RoleARN) {
+			return true
+		}
+	}
+	return false
+}
+
+// selects returns whether the pod of the request meets the conditions of the rule, regardless of its roles.
+func (rule *PolicyRule) selects(req *AuthorizationRequest) bool {
+	if !rule.podSelector.Matches(labels.Set(req.Pod.GetLabels())) {
+		return false
+	}
+	if !rule.namespaceSelector.Empty() {
+		// Namespace conditions can't be met when the namespace is unknown
+		if req.Namespace == nil || !rule.namespaceSelector.Matches(labels.Set(req.Namespace.GetLabels())) {
+			return false
+		}
+	}
+	if len(rule.ServiceAccounts) > 0 && !matchAnyGlob(rule.ServiceAccounts, req.ServiceAccount) {
+		return false
+	}
+	if len(rule.Nodes) > 0 && !matchAnyGlob(rule.Nodes, req.Node) {
+		return false
+	}
+	return true
+}
+
+// evaluate returns the decision of the policy for the request.
+func (p *AuthorizationPolicy) evaluate(req *AuthorizationRequest, matchRole func(pattern, roleARN string) bool) Decision {
+	var allowedBy *PolicyRule
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.matches(req, matchRole) {
+			continue
+		}
+		if rule.Effect == PolicyEffectDeny {
+			return deny("role %s denied by authorization policy rule %s", req.RoleARN, rule.Name)
+		}
+		if allowedBy == nil {
+			allowedBy = rule
+		}
+	}
+	if allowedBy != nil {
+		return allow("role %s allowed by authorization policy rule %s", req.RoleARN, allowedBy.Name)
+	}
+	return deny("no authorization policy rule allows role %s", req.RoleARN)
+}
+
+func matchAnyGlob(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if glob.Glob(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
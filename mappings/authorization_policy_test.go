@@ -0,0 +1,177 @@
+package mappings
+
+import (
+	"testing"
+
+	"github.com/jtblin/kube2iam/iam"
+	v1 "k8s.io/api/core/v1"
+)
+
+const testPolicy = `
+rules:
+  - name: payments
+    effect: allow
+    roles:
+      - payments-*
+    namespaceSelector: team=payments
+    podSelector: app in (api, worker)
+    serviceAccounts:
+      - payments-*
+  - name: no-admin-on-spot
+    effect: deny
+    roles:
+      - "*-admin"
+    nodes:
+      - spot-*
+  - effect: allow
+    roles:
+      - payments-admin
+`
+
+func TestParseAuthorizationPolicy(t *testing.T) {
+	var parseTests = []struct {
+		test        string
+		policy      string
+		expectError bool
+	}{
+		{
+			test:   "Valid policy",
+			policy: testPolicy,
+		},
+		{
+			test:   "Empty policy",
+			policy: "",
+		},
+		{
+			test:        "Invalid effect",
+			policy:      "rules:\n  - effect: maybe\n    roles: [a]\n",
+			expectError: true,
+		},
+		{
+			test:        "No roles",
+			policy:      "rules:\n  - effect: allow\n",
+			expectError: true,
+		},
+		{
+			test:        "Invalid selector",
+			policy:      "rules:\n  - effect: allow\n    roles: [a]\n    podSelector: 'app in ('\n",
+			expectError: true,
+		},
+		{
+			test:        "Unknown field",
+			policy:      "rules:\n  - effect: allow\n    roles: [a]\n    labels: a=b\n",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range parseTests {
+		t.Run(tt.test, func(t *testing.T) {
+			_, err := ParseAuthorizationPolicy([]byte(tt.policy))
+			if tt.expectError != (err != nil) {
+				t.Errorf("Expected error [%t] for test but recieved [%v]", tt.expectError, err)
+			}
+		})
+	}
+}
+
+func TestPolicyAuthorizer(t *testing.T) {
+	policy, err := ParseAuthorizationPolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Unable to parse policy: %v", err)
+	}
+
+	var policyTests = []struct {
+		test            string
+		roleARN         string
+		namespaceLabels map[string]string
+		podLabels       map[string]string
+		serviceAccount  string
+		node            string
+		expectedResult  bool
+		expectedReason  string
+	}{
+		{
+			test:            "All conditions match",
+			roleARN:         "arn:aws:iam::123456789012:role/payments-reader",
+			namespaceLabels: map[string]string{"team": "payments"},
+			podLabels:       map[string]string{"app": "api"},
+			serviceAccount:  "payments-api",
+			expectedResult:  true,
+			expectedReason:  "role arn:aws:iam::123456789012:role/payments-reader allowed by authorization policy rule payments",
+		},
+		{
+			test:            "Namespace label mismatch",
+			roleARN:         "arn:aws:iam::123456789012:role/payments-reader",
+			namespaceLabels: map[string]string{"team": "search"},
+			podLabels:       map[string]string{"app": "api"},
+			serviceAccount:  "payments-api",
+			expectedResult:  false,
+			expectedReason:  "no authorization policy rule allows role arn:aws:iam::123456789012:role/payments-reader",
+		},
+		{
+			test:            "Pod label mismatch",
+			roleARN:         "arn:aws:iam::123456789012:role/payments-reader",
+			namespaceLabels: map[string]string{"team": "payments"},
+			podLabels:       map[string]string{"app": "cron"},
+			serviceAccount:  "payments-api",
+			expectedResult:  false,
+		},
+		{
+			test:            "Default service account mismatch",
+			roleARN:         "arn:aws:iam::123456789012:role/payments-reader",
+			namespaceLabels: map[string]string{"team": "payments"},
+			podLabels:       map[string]string{"app": "api"},
+			expectedResult:  false,
+		},
+		{
+			test:           "Unconditional allow",
+			roleARN:        "arn:aws:iam::123456789012:role/payments-admin",
+			node:           "on-demand-1",
+			expectedResult: true,
+			expectedReason: "role arn:aws:iam::123456789012:role/payments-admin allowed by authorization policy rule #3",
+		},
+		{
+			test:           "Deny takes precedence",
+			roleARN:        "arn:aws:iam::123456789012:role/payments-admin",
+			node:           "spot-1",
+			expectedResult: false,
+			expectedReason: "role arn:aws:iam::123456789012:role/payments-admin denied by authorization policy rule no-admin-on-spot",
+		},
+		{
+			test:           "Default role not allowed by a rule",
+			roleARN:        "arn:aws:iam::123456789012:role/default-role",
+			expectedResult: false,
+			expectedReason: "no authorization policy rule allows role arn:aws:iam::123456789012:role/default-role",
+		},
+	}
+
+	for _, tt := range policyTests {
+		t.Run(tt.test, func(t *testing.T) {
+			config := newTestConfig()
+			config.DefaultRole = "default-role"
+			config.Policy = policy
+			rp := NewRoleMapper(
+				config,
+				&iam.Client{BaseARN: defaultBaseRole},
+				&storeMock{
+					namespace:       "default",
+					namespaceLabels: tt.namespaceLabels,
+				},
+			)
+
+			pod := &v1.Pod{}
+			pod.Namespace = "default"
+			pod.Labels = tt.podLabels
+			pod.Spec.ServiceAccountName = tt.serviceAccount
+			pod.Spec.NodeName = tt.node
+
+			resp := rp.checkRoleForPod(tt.roleARN, pod)
+			if resp.Allowed != tt.expectedResult {
+				t.Errorf("Expected [%t] for test but recieved [%+v]", tt.expectedResult, resp)
+			}
+			if tt.expectedReason != "" && resp.Reason != tt.expectedReason {
+				t.Errorf("Expected reason [%s] for test but recieved [%s]", tt.expectedReason, resp.Reason)
+			}
+		})
+	}
+}
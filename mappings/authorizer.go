@@ -0,0 +1,123 @@
+package mappings
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/jtblin/kube2iam"
+)
+
+// Decision is the outcome of an authorization request along with the reason it was reached.
+type Decision struct {
+	Allowed bool
+	Reason  string
+	// Audited is set when the role is denied but the pod is allowed anyway as the mapper runs in audit mode.
+	Audited bool
+}
+
+// AuthorizationRequest describes a pod requesting a role.
+type AuthorizationRequest struct {
+	RoleARN string
+	Pod     *v1.Pod
+	// Namespace is nil when the namespace of the pod is not indexed.
+	Namespace      *v1.Namespace
+	ServiceAccount string
+	Node           string
+}
+
+// RoleDeniedError is returned when a pod is not allowed to assume its role.
+type RoleDeniedError struct {
+	Role      string
+	IP        string
+	Namespace string
+	Reason    string
+}
+
+func (e *RoleDeniedError) Error() string {
+	return fmt.Sprintf("role requested %s not valid for namespace of pod at %s with namespace %s: %s", e.Role, e.IP, e.Namespace, e.Reason)
+}
+
+// Authorizer decides whether a pod is allowed to assume a role.
+type Authorizer interface {
+	Authorize(req *AuthorizationRequest) Decision
+}
+
+func allow(format string, args ...interface{}) Decision {
+	return Decision{Allowed: true, Reason: fmt.Sprintf(format, args...)}
+}
+
+func deny(format string, args ...interface{}) Decision {
+	return Decision{Allowed: false, Reason: fmt.Sprintf(format, args...)}
+}
+
+// allowAllAuthorizer allows any role when namespace restrictions are disabled.
+type allowAllAuthorizer struct{}
+
+func (a allowAllAuthorizer) Authorize(req *AuthorizationRequest) Decision {
+	return allow("namespace restrictions are disabled")
+}
+
+// namespaceAnnotationAuthorizer allows the default role and the roles matching the patterns annotated on the
+// namespace of the pod, unless denied by the namespace.
+type namespaceAnnotationAuthorizer struct {
+	mapper *RoleMapper
+}
+
+func (a *namespaceAnnotationAuthorizer) Authorize(req *AuthorizationRequest) Decision {
+	if decision, decided := a.mapper.checkDeniedOrDefaultRole(req.RoleARN, req.Pod.GetNamespace()); decided {
+		return decision
+	}
+	return a.mapper.checkRoleForNamespace(req.RoleARN, req.Pod.GetNamespace())
+}
+
+// roleBindingAuthorizer allows the default role and the roles granted to the pod by the IAMRoleBindings of its
+// namespace, unless denied by the namespace.
+type roleBindingAuthorizer struct {
+	mapper *RoleMapper
+}
+
+func (a *roleBindingAuthorizer) Authorize(req *AuthorizationRequest) Decision {
+	if decision, decided := a.mapper.checkDeniedOrDefaultRole(req.RoleARN, req.Pod.GetNamespace()); decided {
+		return decision
+	}
+	return a.mapper.checkRoleBindings(req.RoleARN, req.Pod)
+}
+
+// policyAuthorizer allows the roles according to the rules of an authorization policy.
+type policyAuthorizer struct {
+	policy *AuthorizationPolicy
+	// patterns holds the role patterns of the rules compiled once, patterns that can't be compiled match no role.
+	patterns map[string]*kube2iam.RolePattern
+}
+
+func (a *policyAuthorizer) Authorize(req *AuthorizationRequest) Decision {
+	return a.policy.evaluate(req, a.matchRole)
+}
+
+// matchRole matches a role ARN against a compiled role pattern of the policy.
+func (a *policyAuthorizer) matchRole(pattern, roleARN string) bool {
+	rolePattern, ok := a.patterns[pattern]
+	return ok && rolePattern.Match(roleARN)
+}
+
+// newPolicyAuthorizer returns an authorizer of the policy compiling the role patterns of its rules in format,
+// normalized to full ARNs by normalize.
+func newPolicyAuthorizer(policy *AuthorizationPolicy, format string, normalize func(string) string) *policyAuthorizer {
+	a := &policyAuthorizer{policy: policy, patterns: make(map[string]*kube2iam.RolePattern)}
+	for _, rule := range policy.Rules {
+		for _, pattern := range rule.Roles {
+			if _, ok := a.patterns[pattern]; ok {
+				continue
+			}
+			rolePattern, err := kube2iam.CompileRolePattern(pattern, format, normalize)
+			if err != nil {
+				log.Errorf("Ignoring invalid role pattern %s of authorization policy rule %s: %s", pattern, rule.Name, err)
+				continue
+			}
+			a.patterns[pattern] = rolePattern
+		}
+	}
+	return a
+}
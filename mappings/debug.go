@@ -0,0 +1,214 @@
+package mappings
+
+import (
+	"sort"
+
+	glob "github.com/ryanuber/go-glob"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/jtblin/kube2iam"
+	"github.com/jtblin/kube2iam/iam"
+)
+
+// DebugFilter selects the entries returned by the debug API, empty fields match every entry. Role is a glob
+// pattern normalized like role annotations, e.g. "team-a-*".
+type DebugFilter struct {
+	Namespace string
+	IP        string
+	Role      string
+}
+
+// matchRole returns whether a role ARN matches the role of the filter.
+func (r *RoleMapper) matchRole(filter DebugFilter, roleArn string) bool {
+	return filter.Role == "" || glob.Glob(r.iam.RoleARN(filter.Role), roleArn)
+}
+
+// DebugPod describes the role of an indexed pod.
+type DebugPod struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid"`
+	IP        string `json:"ip"`
+	// IPs are the IPs the pod is indexed with, both of them for dual-stack pods.
+	IPs         []string `json:"ips,omitempty"`
+	Phase       string   `json:"phase"`
+	HostNetwork bool     `json:"hostNetwork,omitempty"`
+	// Role is the normalized role of the pod, whether or not it is allowed to assume it.
+	Role       string `json:"role,omitempty"`
+	RoleSource string `json:"roleSource,omitempty"`
+}
+
+// DebugConflict lists the pods indexed with the same IP, such as hostNetwork pods. Requests from the IP are
+// refused unless the conflict can be resolved with --resolve-duplicate-cache-ips.
+type DebugConflict struct {
+	IP   string     `json:"ip"`
+	Pods []DebugPod `json:"pods"`
+}
+
+// DebugNamespace describes the role restrictions of an indexed namespace.
+type DebugNamespace struct {
+	Name            string   `json:"name"`
+	AllowedRoles    []string `json:"allowedRoles,omitempty"`
+	DeniedRoles     []string `json:"deniedRoles,omitempty"`
+	DefaultRole     string   `json:"defaultRole,omitempty"`
+	InvalidPatterns []string `json:"invalidPatterns,omitempty"`
+	RoleBindings    []string `json:"roleBindings,omitempty"`
+}
+
+// DebugPods returns the indexed pods matching the filter, sorted by namespace and name. Pods that are not indexed by
+// IP, such as completed pods still holding the IP they had, are left out. The IP of the filter matches any IP of a pod.
+func (r *RoleMapper) DebugPods(filter DebugFilter) []DebugPod {
+	pods := []DebugPod{}
+	for _, pod := range r.store.ListPods() {
+		IPs, err := kube2iam.PodIPIndexFunc(pod)
+		if err != nil || len(IPs) == 0 {
+			continue
+		}
+		p := r.debugPod(pod, IPs)
+		if (filter.Namespace == "" || p.Namespace == filter.Namespace) && (filter.IP == "" || containsString(p.IPs, filter.IP)) && r.matchRole(filter, p.Role) {
+			pods = append(pods, p)
+		}
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+	return pods
+}
+
+func (r *RoleMapper) debugPod(pod *v1.Pod, IPs []string) DebugPod {
+	p := DebugPod{
+		Namespace:   pod.GetNamespace(),
+		Name:        pod.GetName(),
+		UID:         string(pod.GetUID()),
+		IP:          pod.Status.PodIP,
+		IPs:         IPs,
+		Phase:       string(pod.Status.Phase),
+		HostNetwork: pod.Spec.HostNetwork,
+	}
+	var rawRole string
+	if rawRole, p.RoleSource = r.findRole(pod); p.RoleSource != "" {
+		p.Role = r.iam.RoleARN(rawRole)
+	}
+	return p
+}
+
+// DebugConflicts returns the IPs indexed for several pods, sorted by IP. A conflict matches the filter when one
+// of its pods does.
+func (r *RoleMapper) DebugConflicts(filter DebugFilter) []DebugConflict {
+	podsByIP := make(map[string][]DebugPod)
+	for _, pod := range r.DebugPods(DebugFilter{IP: filter.IP}) {
+		for _, IP := range pod.IPs {
+			podsByIP[IP] = append(podsByIP[IP], pod)
+		}
+	}
+
+	conflicts := []DebugConflict{}
+	for ip, pods := range podsByIP {
+		if filter.IP != "" && ip != filter.IP {
+			continue
+		}
+		if len(pods) < 2 {
+			continue
+		}
+		for _, pod := range pods {
+			if (filter.Namespace == "" || pod.Namespace == filter.Namespace) && r.matchRole(filter, pod.Role) {
+				conflicts = append(conflicts, DebugConflict{IP: ip, Pods: pods})
+				break
+			}
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].IP < conflicts[j].IP })
+	return conflicts
+}
+
+// DebugNamespaces returns the role restrictions of the indexed namespaces matching the namespace of the filter,
+// sorted by name.
+func (r *RoleMapper) DebugNamespaces(filter DebugFilter) []DebugNamespace {
+	namespaces := []DebugNamespace{}
+	for _, name := range r.store.ListNamespaces() {
+		if filter.Namespace != "" && name != filter.Namespace {
+			continue
+		}
+		ns, err := r.store.NamespaceByName(name)
+		if err != nil {
+			continue
+		}
+
+		d := DebugNamespace{Name: name}
+		roles := r.namespaces.RolesByNamespace(ns)
+		for _, rolePattern := range roles.Allowed {
+			d.AllowedRoles = append(d.AllowedRoles, rolePattern.Pattern)
+		}
+		for _, rolePattern := range roles.Denied {
+			d.DeniedRoles = append(d.DeniedRoles, rolePattern.Pattern)
+		}
+		for _, err := range roles.Invalid {
+			d.InvalidPatterns = append(d.InvalidPatterns, err.Error())
+		}
+		if r.namespaceDefaultRoleKey != "" {
+			d.DefaultRole = ns.GetAnnotations()[r.namespaceDefaultRoleKey]
+		}
+		if r.roleBindings {
+			if bindings, err := r.store.RoleBindingsByNamespace(name); err == nil {
+				for _, rb := range bindings {
+					d.RoleBindings = append(d.RoleBindings, rb.GetName())
+				}
+			}
+		}
+		namespaces = append(namespaces, d)
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Name < namespaces[j].Name })
+	return namespaces
+}
+
+// DebugCache returns the status of the cached credentials matching the filter, most recently used first. The
+// namespace and IP of the filter select the credentials of the matching pods for their current role.
+func (r *RoleMapper) DebugCache(filter DebugFilter) []iam.CacheStatus {
+	var sessions map[string]bool
+	if filter.Namespace != "" || filter.IP != "" {
+		sessions = make(map[string]bool)
+		for _, pod := range r.DebugPods(filter) {
+			if pod.Role == "" {
+				continue
+			}
+			// Pods are issued credentials for the IP they call kube2iam over, any of their IPs
+			for _, IP := range pod.IPs {
+				if filter.IP == "" || IP == filter.IP {
+					sessions[iam.SessionName(pod.Role, IP)] = true
+				}
+			}
+		}
+	}
+
+	entries := []iam.CacheStatus{}
+	for _, entry := range r.iam.CacheEntries() {
+		if (sessions == nil || sessions[entry.SessionName]) && r.matchRole(filter, entry.Role) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// DebugViolations returns the violations of namespace restrictions recorded in audit mode matching the namespace
+// and role of the filter, sorted by namespace and role. Violations are not indexed by IP and ignore its IP.
+func (r *RoleMapper) DebugViolations(filter DebugFilter) []Violation {
+	violations := []Violation{}
+	for _, v := range r.violations.list() {
+		if (filter.Namespace == "" || v.Namespace == filter.Namespace) && r.matchRole(filter, v.Role) {
+			violations = append(violations, v)
+		}
+	}
+	return violations
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
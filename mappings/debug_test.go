@@ -0,0 +1,135 @@
+package mappings
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jtblin/kube2iam/iam"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newDebugTestPod(namespace, name, IP, role string, hostNetwork bool) *v1.Pod {
+	pod := &v1.Pod{}
+	pod.Namespace = namespace
+	pod.Name = name
+	pod.UID = types.UID(namespace + "-" + name)
+	pod.Status.PodIP = IP
+	pod.Spec.HostNetwork = hostNetwork
+	if role != "" {
+		pod.Annotations = map[string]string{roleKey: role}
+	}
+	return pod
+}
+
+func TestDebugPods(t *testing.T) {
+	web := newDebugTestPod("default", "web", "10.0.0.1", "team-a-web", false)
+	web.Status.PodIPs = []v1.PodIP{{IP: "10.0.0.1"}, {IP: "2600:1f14::1"}}
+	// Completed pods keep their IP, which may be reused by another pod
+	completed := newDebugTestPod("default", "migration", "10.0.0.2", "team-a-migration", false)
+	completed.Status.Phase = v1.PodSucceeded
+
+	rp := NewRoleMapper(
+		newTestConfig(),
+		iam.NewClient(defaultBaseRole, false, 0, 0),
+		&storeMock{
+			pods: []*v1.Pod{
+				web,
+				newDebugTestPod("default", "worker", "10.0.0.2", "team-a-worker", false),
+				completed,
+				newDebugTestPod("kube-system", "node-exporter", "192.168.0.1", "", true),
+				newDebugTestPod("kube-system", "proxy", "192.168.0.1", "team-b-proxy", true),
+			},
+			namespace:   "default",
+			annotations: map[string]string{namespaceKey: `["team-a-*"]`, namespaceDeniedKey: `["team-a-admin"]`, namespaceDefaultRoleKey: "team-a-default"},
+		},
+	)
+
+	var podTests = []struct {
+		test              string
+		filter            DebugFilter
+		expectedPods      []string
+		expectedConflicts []string
+	}{
+		{
+			test:              "No filter",
+			expectedPods:      []string{"default/web", "default/worker", "kube-system/node-exporter", "kube-system/proxy"},
+			expectedConflicts: []string{"192.168.0.1"},
+		},
+		{
+			test:              "Namespace",
+			filter:            DebugFilter{Namespace: "default"},
+			expectedPods:      []string{"default/web", "default/worker"},
+			expectedConflicts: []string{},
+		},
+		{
+			test:              "IP shared by host network pods",
+			filter:            DebugFilter{IP: "192.168.0.1"},
+			expectedPods:      []string{"kube-system/node-exporter", "kube-system/proxy"},
+			expectedConflicts: []string{"192.168.0.1"},
+		},
+		{
+			test:              "IPv6 of a dual-stack pod",
+			filter:            DebugFilter{IP: "2600:1f14::1"},
+			expectedPods:      []string{"default/web"},
+			expectedConflicts: []string{},
+		},
+		{
+			test:              "IP reused after a completed pod",
+			filter:            DebugFilter{IP: "10.0.0.2"},
+			expectedPods:      []string{"default/worker"},
+			expectedConflicts: []string{},
+		},
+		{
+			test:              "Role name pattern",
+			filter:            DebugFilter{Role: "team-a-*"},
+			expectedPods:      []string{"default/web", "default/worker"},
+			expectedConflicts: []string{},
+		},
+		{
+			test:              "Role of a conflicting pod",
+			filter:            DebugFilter{Role: defaultBaseRole + "team-b-proxy"},
+			expectedPods:      []string{"kube-system/proxy"},
+			expectedConflicts: []string{"192.168.0.1"},
+		},
+	}
+
+	for _, tt := range podTests {
+		t.Run(tt.test, func(t *testing.T) {
+			pods := []string{}
+			for _, pod := range rp.DebugPods(tt.filter) {
+				pods = append(pods, pod.Namespace+"/"+pod.Name)
+			}
+			if !reflect.DeepEqual(pods, tt.expectedPods) {
+				t.Errorf("Expected pods [%v] for test but recieved [%v]", tt.expectedPods, pods)
+			}
+
+			conflicts := []string{}
+			for _, conflict := range rp.DebugConflicts(tt.filter) {
+				conflicts = append(conflicts, conflict.IP)
+				if len(conflict.Pods) != 2 {
+					t.Errorf("Expected every pod of conflict [%s] but recieved [%+v]", conflict.IP, conflict.Pods)
+				}
+			}
+			if !reflect.DeepEqual(conflicts, tt.expectedConflicts) {
+				t.Errorf("Expected conflicts [%v] for test but recieved [%v]", tt.expectedConflicts, conflicts)
+			}
+		})
+	}
+
+	pods := rp.DebugPods(DebugFilter{IP: "10.0.0.1"})
+	expected := DebugPod{Namespace: "default", Name: "web", UID: "default-web", IP: "10.0.0.1", IPs: []string{"10.0.0.1", "2600:1f14::1"}, Role: defaultBaseRole + "team-a-web", RoleSource: RoleSourcePod}
+	if len(pods) != 1 || !reflect.DeepEqual(pods[0], expected) {
+		t.Errorf("Expected pod [%+v] but recieved [%+v]", expected, pods)
+	}
+
+	namespaces := rp.DebugNamespaces(DebugFilter{Namespace: "default"})
+	expectedNamespace := DebugNamespace{Name: "default", AllowedRoles: []string{"team-a-*"}, DeniedRoles: []string{"team-a-admin"}, DefaultRole: "team-a-default"}
+	if len(namespaces) != 1 || !reflect.DeepEqual(namespaces[0], expectedNamespace) {
+		t.Errorf("Expected namespace [%+v] but recieved [%+v]", expectedNamespace, namespaces)
+	}
+
+	if entries := rp.DebugCache(DebugFilter{}); len(entries) != 0 {
+		t.Errorf("Expected no cache entries but recieved [%+v]", entries)
+	}
+}
@@ -0,0 +1,233 @@
+package mappings
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/jtblin/kube2iam/iam"
+)
+
+// RoleExplanation traces how the role of a pod is looked up and authorized, to debug pods denied their role.
+type RoleExplanation struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	IP        string `json:"ip"`
+	// RoleSource is where the role was read from, one of the RoleSource constants, it is empty when the pod
+	// doesn't get any role. RoleAnnotation is the key of the annotation holding the role, if any.
+	RoleSource     string `json:"roleSource,omitempty"`
+	RoleAnnotation string `json:"roleAnnotation,omitempty"`
+	// RawRole is the role as annotated and Role the ARN it is normalized to.
+	RawRole  string `json:"rawRole,omitempty"`
+	Role     string `json:"role,omitempty"`
+	ValidARN bool   `json:"validARN"`
+	// Authorizer names the authorizer deciding whether the pod may assume its role.
+	Authorizer string `json:"authorizer,omitempty"`
+	// Checks lists the role patterns tried against the role, in order.
+	Checks []PatternCheck `json:"checks,omitempty"`
+	// InvalidPatterns lists the patterns of the namespace that can't be compiled, allowed ones are ignored while
+	// denied ones deny every role but the default role.
+	InvalidPatterns []string `json:"invalidPatterns,omitempty"`
+	Allowed         bool     `json:"allowed"`
+	// Audited is set when the role is denied but credentials are still issued in audit mode.
+	Audited bool   `json:"audited,omitempty"`
+	Reason  string `json:"reason"`
+	// ExternalIDSource is where the external ID was read from, empty when the role is assumed without one.
+	ExternalIDSource string `json:"externalIDSource,omitempty"`
+}
+
+// PatternCheck is a role pattern tried against the role of a pod.
+type PatternCheck struct {
+	// Source is the annotation, IAMRoleBinding or policy rule the pattern belongs to.
+	Source  string `json:"source"`
+	Pattern string `json:"pattern"`
+	Matched bool   `json:"matched"`
+	// Skipped explains why the pattern wasn't tried, e.g. the IAMRoleBinding doesn't select the pod.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// explainer is implemented by the authorizers to name themselves and trace the patterns they try.
+type explainer interface {
+	name() string
+	explain(req *AuthorizationRequest) []PatternCheck
+}
+
+// Explain traces the lookup and authorization of the role of a pod looked up with IP, the primary IP of the pod
+// when empty. It has no side effect, denied roles are neither logged nor recorded as violations.
+func (r *RoleMapper) Explain(pod *v1.Pod, IP string) *RoleExplanation {
+	authorizer, _ := r.authorizer.(explainer)
+	if IP == "" {
+		IP = pod.Status.PodIP
+	}
+	e := &RoleExplanation{
+		Namespace: pod.GetNamespace(),
+		Pod:       pod.GetName(),
+		IP:        IP,
+	}
+	if authorizer != nil {
+		e.Authorizer = authorizer.name()
+	}
+
+	e.RawRole, e.RoleSource = r.findRole(pod)
+	switch e.RoleSource {
+	case "":
+		e.Allowed = true
+		e.Reason = "pod doesn't request a role"
+		return e
+	case RoleSourcePod:
+		e.RoleAnnotation = r.iamRoleKey
+	case RoleSourceServiceAccount:
+		e.RoleAnnotation = r.serviceAccountRoleKey
+	case RoleSourceNamespaceDefault:
+		e.RoleAnnotation = r.namespaceDefaultRoleKey
+	}
+	e.Role = r.iam.RoleARN(e.RawRole)
+	e.ValidARN = iam.ARNRegexp.MatchString(e.Role)
+
+	decision := r.checkRoleForPod(e.Role, pod)
+	e.Allowed, e.Reason = decision.Allowed, decision.Reason
+	e.Audited = !decision.Allowed && r.audit
+
+	if authorizer != nil {
+		e.Checks = authorizer.explain(r.authorizationRequest(e.Role, pod))
+	}
+	if r.namespaceRestriction {
+		if ns, err := r.store.NamespaceByName(pod.GetNamespace()); err == nil {
+			for _, err := range r.namespaces.RolesByNamespace(ns).Invalid {
+				e.InvalidPatterns = append(e.InvalidPatterns, err.Error())
+			}
+		}
+	}
+
+	e.ExternalIDSource = r.explainExternalID(e.Role, pod)
+	return e
+}
+
+// explainDeniedRoles tries every denied pattern of the namespace against the role.
+func (r *RoleMapper) explainDeniedRoles(roleArn string, namespace string) []PatternCheck {
+	if r.namespaceDeniedKey == "" {
+		return nil
+	}
+
+	ns, err := r.store.NamespaceByName(namespace)
+	if err != nil {
+		return nil
+	}
+
+	var checks []PatternCheck
+	source := fmt.Sprintf("namespace %s annotation %s", namespace, r.namespaceDeniedKey)
+	for _, rolePattern := range r.namespaces.RolesByNamespace(ns).Denied {
+		checks = append(checks, PatternCheck{Source: source, Pattern: rolePattern.Pattern, Matched: rolePattern.Match(roleArn)})
+	}
+	return checks
+}
+
+// explainExternalID returns where the external ID of the pod is read from, following GetExternalIDMappingForPod.
+func (r *RoleMapper) explainExternalID(roleArn string, pod *v1.Pod) string {
+	if r.roleBindings && r.namespaceRestriction {
+		if rb := r.matchingRoleBinding(roleArn, pod); rb != nil && rb.Spec.ExternalID != "" {
+			return fmt.Sprintf("IAMRoleBinding %s/%s", rb.GetNamespace(), rb.GetName())
+		}
+	}
+
+	if pod.GetAnnotations()[r.iamExternalIDKey] != "" {
+		return fmt.Sprintf("pod annotation %s", r.iamExternalIDKey)
+	}
+	return ""
+}
+
+func (a allowAllAuthorizer) name() string {
+	return "none"
+}
+
+func (a allowAllAuthorizer) explain(req *AuthorizationRequest) []PatternCheck {
+	return nil
+}
+
+func (a *namespaceAnnotationAuthorizer) name() string {
+	return "namespaceAnnotation"
+}
+
+func (a *namespaceAnnotationAuthorizer) explain(req *AuthorizationRequest) []PatternCheck {
+	checks := a.mapper.explainDeniedRoles(req.RoleARN, req.Pod.GetNamespace())
+	// The allowed roles aren't consulted for denied roles and the default role
+	if _, decided := a.mapper.checkDeniedOrDefaultRole(req.RoleARN, req.Pod.GetNamespace()); decided || req.Namespace == nil {
+		return checks
+	}
+
+	source := fmt.Sprintf("namespace %s annotation %s", req.Namespace.GetName(), a.mapper.namespaceKey)
+	for _, rolePattern := range a.mapper.namespaces.RolesByNamespace(req.Namespace).Allowed {
+		checks = append(checks, PatternCheck{Source: source, Pattern: rolePattern.Pattern, Matched: rolePattern.Match(req.RoleARN)})
+	}
+	return checks
+}
+
+func (a *roleBindingAuthorizer) name() string {
+	return "iamRoleBinding"
+}
+
+func (a *roleBindingAuthorizer) explain(req *AuthorizationRequest) []PatternCheck {
+	checks := a.mapper.explainDeniedRoles(req.RoleARN, req.Pod.GetNamespace())
+	// The IAMRoleBindings aren't consulted for denied roles and the default role
+	if _, decided := a.mapper.checkDeniedOrDefaultRole(req.RoleARN, req.Pod.GetNamespace()); decided {
+		return checks
+	}
+
+	bindings, err := a.mapper.store.RoleBindingsByNamespace(req.Pod.GetNamespace())
+	if err != nil {
+		return checks
+	}
+
+	for _, rb := range bindings {
+		source := fmt.Sprintf("IAMRoleBinding %s/%s", rb.GetNamespace(), rb.GetName())
+		skipped := ""
+		if podSelector, err := metav1.LabelSelectorAsSelector(&rb.Spec.PodSelector); err != nil {
+			skipped = fmt.Sprintf("invalid pod selector: %v", err)
+		} else if !podSelector.Matches(labels.Set(req.Pod.GetLabels())) {
+			skipped = fmt.Sprintf("pod selector %s doesn't match the pod", podSelector)
+		}
+		roles := a.mapper.roleBindingRoles.RolesByRoleBinding(rb)
+		for _, rolePattern := range roles.Roles {
+			check := PatternCheck{Source: source, Pattern: rolePattern.Pattern, Skipped: skipped}
+			if skipped == "" {
+				check.Matched = rolePattern.Match(req.RoleARN)
+			}
+			checks = append(checks, check)
+		}
+		for _, err := range roles.Invalid {
+			checks = append(checks, PatternCheck{Source: source, Skipped: fmt.Sprintf("invalid pattern: %v", err)})
+		}
+	}
+	return checks
+}
+
+func (a *policyAuthorizer) name() string {
+	return "authorizationPolicy"
+}
+
+func (a *policyAuthorizer) explain(req *AuthorizationRequest) []PatternCheck {
+	var checks []PatternCheck
+	for i := range a.policy.Rules {
+		rule := &a.policy.Rules[i]
+		source := fmt.Sprintf("authorization policy rule %s (%s)", rule.Name, rule.Effect)
+		if !rule.selects(req) {
+			checks = append(checks, PatternCheck{
+				Source:  source,
+				Pattern: strings.Join(rule.Roles, ","),
+				Skipped: "rule conditions don't match the pod",
+			})
+			continue
+		}
+		for _, rolePattern := range rule.Roles {
+			check := PatternCheck{Source: source, Pattern: rolePattern, Matched: a.matchRole(rolePattern, req.RoleARN)}
+			if _, ok := a.patterns[rolePattern]; !ok {
+				check.Skipped = "invalid pattern"
+			}
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
@@ -0,0 +1,135 @@
+package mappings
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jtblin/kube2iam"
+	"github.com/jtblin/kube2iam/iam"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExplain(t *testing.T) {
+	var explainTests = []struct {
+		test                     string
+		roleBindings             bool
+		defaultRole              string
+		annotations              map[string]string
+		saAnnotations            map[string]string
+		expectedSource           string
+		expectedRole             string
+		expectedAllowed          bool
+		expectedChecks           []PatternCheck
+		expectedExternalIDSource string
+	}{
+		{
+			test:            "Pod annotation allowed",
+			annotations:     map[string]string{roleKey: "team-a-role", externalIDKey: "external-id"},
+			expectedSource:  RoleSourcePod,
+			expectedRole:    defaultBaseRole + "team-a-role",
+			expectedAllowed: true,
+			expectedChecks: []PatternCheck{
+				{Source: "namespace default annotation namespaceDeniedKey", Pattern: "team-a-admin", Matched: false},
+				{Source: "namespace default annotation namespaceKey", Pattern: "other-role", Matched: false},
+				{Source: "namespace default annotation namespaceKey", Pattern: "team-a-*", Matched: true},
+			},
+			expectedExternalIDSource: "pod annotation externalIDKey",
+		},
+		{
+			test:           "Service account annotation denied",
+			annotations:    map[string]string{},
+			saAnnotations:  map[string]string{saRoleKey: "team-a-admin"},
+			expectedSource: RoleSourceServiceAccount,
+			expectedRole:   defaultBaseRole + "team-a-admin",
+			expectedChecks: []PatternCheck{
+				{Source: "namespace default annotation namespaceDeniedKey", Pattern: "team-a-admin", Matched: true},
+			},
+		},
+		{
+			test:            "Default role",
+			defaultRole:     "default-role",
+			annotations:     map[string]string{},
+			expectedSource:  RoleSourceDefault,
+			expectedRole:    defaultBaseRole + "default-role",
+			expectedAllowed: true,
+			expectedChecks: []PatternCheck{
+				{Source: "namespace default annotation namespaceDeniedKey", Pattern: "team-a-admin", Matched: false},
+			},
+		},
+		{
+			test:            "Role bindings",
+			roleBindings:    true,
+			annotations:     map[string]string{roleKey: "team-a-role"},
+			expectedSource:  RoleSourcePod,
+			expectedRole:    defaultBaseRole + "team-a-role",
+			expectedAllowed: true,
+			expectedChecks: []PatternCheck{
+				{Source: "namespace default annotation namespaceDeniedKey", Pattern: "team-a-admin", Matched: false},
+				{Source: "IAMRoleBinding default/web", Pattern: "team-a-*", Skipped: "pod selector app=web doesn't match the pod"},
+				{Source: "IAMRoleBinding default/all", Pattern: "team-a-*", Matched: true},
+			},
+			expectedExternalIDSource: "IAMRoleBinding default/all",
+		},
+	}
+
+	bindings := []*kube2iam.IAMRoleBinding{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: kube2iam.IAMRoleBindingSpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				Roles:       []string{"team-a-*"},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "all", Namespace: "default"},
+			Spec: kube2iam.IAMRoleBindingSpec{
+				Roles:      []string{"team-a-*"},
+				ExternalID: "binding-external-id",
+			},
+		},
+	}
+
+	for _, tt := range explainTests {
+		t.Run(tt.test, func(t *testing.T) {
+			config := newTestConfig()
+			config.DefaultRole = tt.defaultRole
+			config.RoleBindings = tt.roleBindings
+			rp := NewRoleMapper(
+				config,
+				&iam.Client{BaseARN: defaultBaseRole},
+				&storeMock{
+					namespace: "default",
+					annotations: map[string]string{
+						namespaceKey:       `["other-role", "team-a-*"]`,
+						namespaceDeniedKey: `["team-a-admin"]`,
+					},
+					saAnnotations: tt.saAnnotations,
+					roleBindings:  bindings,
+				},
+			)
+
+			pod := &v1.Pod{}
+			pod.Name = "worker"
+			pod.Namespace = "default"
+			pod.Annotations = tt.annotations
+
+			e := rp.Explain(pod, "")
+			if e.RoleSource != tt.expectedSource || e.Role != tt.expectedRole {
+				t.Errorf("Expected role [%s] from [%s] for test but recieved [%s] from [%s]", tt.expectedRole, tt.expectedSource, e.Role, e.RoleSource)
+			}
+			if e.Allowed != tt.expectedAllowed {
+				t.Errorf("Expected allowed [%t] for test but recieved [%+v]", tt.expectedAllowed, e)
+			}
+			if e.Allowed != rp.ValidatePod(pod).Allowed {
+				t.Errorf("Expected explanation to agree with the decision of the mapper but recieved [%+v]", e)
+			}
+			if !reflect.DeepEqual(e.Checks, tt.expectedChecks) {
+				t.Errorf("Expected checks [%+v] for test but recieved [%+v]", tt.expectedChecks, e.Checks)
+			}
+			if e.ExternalIDSource != tt.expectedExternalIDSource {
+				t.Errorf("Expected external ID source [%s] for test but recieved [%s]", tt.expectedExternalIDSource, e.ExternalIDSource)
+			}
+		})
+	}
+}
@@ -2,41 +2,58 @@ package mappings
 
 import (
 	"fmt"
-	"regexp"
-	"strings"
 
-	glob "github.com/ryanuber/go-glob"
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 
 	"github.com/jtblin/kube2iam"
 	"github.com/jtblin/kube2iam/iam"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 // RoleMapper handles relevant logic around associating IPs with a given IAM role
 type RoleMapper struct {
 	defaultRoleARN             string
 	iamRoleKey                 string
+	serviceAccountRoleKey      string
 	iamExternalIDKey           string
+	sessionPolicyKey           string
+	sessionPolicyARNsKey       string
 	namespaceKey               string
+	namespaceDeniedKey         string
+	namespaceDefaultRoleKey    string
 	namespaceRestriction       bool
+	roleBindings               bool
+	audit                      bool
+	violations                 *violationLog
 	iam                        *iam.Client
 	store                      store
 	namespaceRestrictionFormat string
+	sessionTagMappings         []SessionTagMapping
+	authorizer                 Authorizer
+	namespaces                 *kube2iam.NamespaceHandler
+	roleBindingRoles           *kube2iam.RoleBindingHandler
 }
 
 type store interface {
 	ListPodIPs() []string
+	ListPods() []*v1.Pod
 	PodByIP(string) (*v1.Pod, error)
 	ListNamespaces() []string
 	NamespaceByName(string) (*v1.Namespace, error)
+	ServiceAccountByName(string, string) (*v1.ServiceAccount, error)
+	RoleBindingsByNamespace(string) ([]*kube2iam.IAMRoleBinding, error)
 }
 
 // RoleMappingResult represents the relevant information for a given mapping request
 type RoleMappingResult struct {
-	Role      string
-	IP        string
-	Namespace string
+	Role        string
+	IP          string
+	Namespace   string
+	SessionTags map[string]string
+	Policy      string
+	PolicyARNs  []string
 }
 
 // GetRoleMapping returns the normalized iam RoleMappingResult based on IP address
@@ -47,17 +64,43 @@ func (r *RoleMapper) GetRoleMapping(IP string) (*RoleMappingResult, error) {
 		return nil, err
 	}
 
-	role, err := r.extractRoleARN(pod)
+	return r.GetRoleMappingForPod(pod, IP)
+}
+
+// GetRoleMappingForPod returns the normalized iam RoleMappingResult of a pod requesting credentials over IP, which
+// is any of the IPs of dual-stack pods. The primary IP of the pod is used when IP is empty.
+func (r *RoleMapper) GetRoleMappingForPod(pod *v1.Pod, IP string) (*RoleMappingResult, error) {
+	if IP == "" {
+		IP = pod.Status.PodIP
+	}
+	role, err := r.extractRoleARN(pod, IP)
 	if err != nil {
 		return nil, err
 	}
 
 	// Determine if normalized role is allowed to be used in pod's namespace
-	if r.checkRoleForNamespace(role, pod.GetNamespace()) {
-		return &RoleMappingResult{Role: role, Namespace: pod.GetNamespace(), IP: IP}, nil
+	decision := r.checkRoleForPod(role, pod)
+	if !decision.Allowed && r.audit {
+		// Credentials are still issued in audit mode so that violations can be fixed before enforcing
+		r.violations.record(role, pod, decision.Reason)
+	}
+	if decision.Allowed || r.audit {
+		policy, policyARNs, err := r.sessionPolicy(pod)
+		if err != nil {
+			return nil, err
+		}
+		return &RoleMappingResult{
+			Role:        role,
+			Namespace:   pod.GetNamespace(),
+			IP:          IP,
+			SessionTags: r.sessionTags(pod),
+			Policy:      policy,
+			PolicyARNs:  policyARNs,
+		}, nil
 	}
 
-	return nil, fmt.Errorf("role requested %s not valid for namespace of pod at %s with namespace %s", role, IP, pod.GetNamespace())
+	log.Warnf("Role: %s denied to pod %s on namespace: %s: %s", role, pod.GetName(), pod.GetNamespace(), decision.Reason)
+	return nil, &RoleDeniedError{Role: role, IP: IP, Namespace: pod.GetNamespace(), Reason: decision.Reason}
 }
 
 // GetExternalIDMapping returns the externalID based on IP address
@@ -68,65 +111,248 @@ func (r *RoleMapper) GetExternalIDMapping(IP string) (string, error) {
 		return "", err
 	}
 
-	externalID := pod.GetAnnotations()[r.iamExternalIDKey]
+	return r.GetExternalIDMappingForPod(pod), nil
+}
+
+// GetExternalIDMappingForPod returns the externalID of a pod
+func (r *RoleMapper) GetExternalIDMappingForPod(pod *v1.Pod) string {
+	// IAMRoleBindings are authoritative, their external ID takes precedence over the pod annotation
+	if r.roleBindings && r.namespaceRestriction {
+		if rawRole, source := r.findRole(pod); source != "" {
+			if rb := r.matchingRoleBinding(r.iam.RoleARN(rawRole), pod); rb != nil && rb.Spec.ExternalID != "" {
+				return rb.Spec.ExternalID
+			}
+		}
+	}
+
+	return pod.GetAnnotations()[r.iamExternalIDKey]
+}
+
+// RequestsRole returns whether the pod requests a role through its own annotation or its service account's,
+// rather than falling back to the default role.
+func (r *RoleMapper) RequestsRole(pod *v1.Pod) bool {
+	if _, ok := pod.GetAnnotations()[r.iamRoleKey]; ok {
+		return true
+	}
+	_, ok := r.serviceAccountRole(pod)
+	return ok
+}
 
-	return externalID, nil
+// ValidatePod checks the role a pod would assume, as at admission time: the role must be a valid role ARN once
+// normalized and the pod must be allowed to assume it. Pods that don't get any role are valid. In audit mode, pods
+// denied their role are allowed with an audited decision, as they are still issued credentials.
+func (r *RoleMapper) ValidatePod(pod *v1.Pod) Decision {
+	role, err := r.extractRoleARN(pod, pod.Status.PodIP)
+	if err != nil {
+		return allow("pod doesn't request a role")
+	}
+	if !iam.ARNRegexp.MatchString(role) {
+		return deny("role %s is not a valid IAM role ARN, expected: %s", role, iam.ARNRegexp.String())
+	}
+	decision := r.checkRoleForPod(role, pod)
+	if !decision.Allowed && r.audit {
+		// Credentials are still issued in audit mode, the pod mustn't be rejected either
+		decision.Allowed, decision.Audited = true, true
+	}
+	return decision
 }
 
+// Sources of the role of a pod, in lookup order.
+const (
+	RoleSourcePod              = "pod"
+	RoleSourceServiceAccount   = "serviceAccount"
+	RoleSourceNamespaceDefault = "namespace"
+	RoleSourceDefault          = "default"
+)
+
 // extractQualifiedRoleName extracts a fully qualified ARN for a given pod,
 // taking into consideration the appropriate fallback logic and defaulting
-// logic along with the namespace role restrictions
-func (r *RoleMapper) extractRoleARN(pod *v1.Pod) (string, error) {
-	rawRoleName, annotationPresent := pod.GetAnnotations()[r.iamRoleKey]
+// logic along with the namespace role restrictions. IP is the IP the pod is looked up with, reported in the logs.
+func (r *RoleMapper) extractRoleARN(pod *v1.Pod, IP string) (string, error) {
+	rawRoleName, source := r.findRole(pod)
+	switch source {
+	case "":
+		return "", fmt.Errorf("unable to find role for IP %s", IP)
+	case RoleSourceNamespaceDefault:
+		log.Debugf("Using default role of namespace %s for IP %s", pod.GetNamespace(), IP)
+	case RoleSourceDefault:
+		log.Warnf("Using fallback role for IP %s", IP)
+	}
 
-	if !annotationPresent && r.defaultRoleARN == "" {
-		return "", fmt.Errorf("unable to find role for IP %s", pod.Status.PodIP)
+	return r.iam.RoleARN(rawRoleName), nil
+}
+
+// findRole returns the role of a pod before normalization along with its source, the source is empty when the
+// pod doesn't get any role.
+// The role is looked up in order from the pod annotation, the pod's service account
+// annotation (when a service account role key is configured), the default role annotation
+// of the pod's namespace and finally the default role.
+func (r *RoleMapper) findRole(pod *v1.Pod) (string, string) {
+	if role, ok := pod.GetAnnotations()[r.iamRoleKey]; ok {
+		return role, RoleSourcePod
+	}
+	if role, ok := r.serviceAccountRole(pod); ok {
+		return role, RoleSourceServiceAccount
+	}
+	if role, ok := r.namespaceDefaultRole(pod); ok {
+		return role, RoleSourceNamespaceDefault
+	}
+	if r.defaultRoleARN != "" {
+		return r.defaultRoleARN, RoleSourceDefault
+	}
+	return "", ""
+}
+
+// namespaceDefaultRole returns the default role annotated on the namespace of the pod, if any. Unlike the
+// global default role, it is subject to namespace restrictions.
+func (r *RoleMapper) namespaceDefaultRole(pod *v1.Pod) (string, bool) {
+	if r.namespaceDefaultRoleKey == "" {
+		return "", false
 	}
 
-	if !annotationPresent {
-		log.Warnf("Using fallback role for IP %s", pod.Status.PodIP)
-		rawRoleName = r.defaultRoleARN
+	ns, err := r.store.NamespaceByName(pod.GetNamespace())
+	if err != nil {
+		log.Debugf("Unable to find an indexed namespace of %s", pod.GetNamespace())
+		return "", false
 	}
 
-	return r.iam.RoleARN(rawRoleName), nil
+	role := ns.GetAnnotations()[r.namespaceDefaultRoleKey]
+	return role, role != ""
 }
 
-// checkRoleForNamespace checks the 'database' for a role allowed in a namespace,
-// returns true if the role is found, otheriwse false
-func (r *RoleMapper) checkRoleForNamespace(roleArn string, namespace string) bool {
-	if !r.namespaceRestriction || roleArn == r.defaultRoleARN {
-		return true
+// serviceAccountRole returns the role annotated on the service account of the pod, if any.
+func (r *RoleMapper) serviceAccountRole(pod *v1.Pod) (string, bool) {
+	if r.serviceAccountRoleKey == "" {
+		return "", false
+	}
+
+	saName := pod.Spec.ServiceAccountName
+	if saName == "" {
+		saName = "default"
+	}
+
+	sa, err := r.store.ServiceAccountByName(pod.GetNamespace(), saName)
+	if err != nil {
+		log.Debugf("Unable to find an indexed service account %s in namespace %s", saName, pod.GetNamespace())
+		return "", false
+	}
+
+	role, ok := sa.GetAnnotations()[r.serviceAccountRoleKey]
+	return role, ok
+}
+
+// checkRoleForPod checks whether the pod is allowed to assume a role with the authorizer of the mapper
+func (r *RoleMapper) checkRoleForPod(roleArn string, pod *v1.Pod) Decision {
+	return r.authorizer.Authorize(r.authorizationRequest(roleArn, pod))
+}
+
+// authorizationRequest returns the request of the pod for a role to the authorizer.
+func (r *RoleMapper) authorizationRequest(roleArn string, pod *v1.Pod) *AuthorizationRequest {
+	req := &AuthorizationRequest{
+		RoleARN:        roleArn,
+		Pod:            pod,
+		ServiceAccount: pod.Spec.ServiceAccountName,
+		Node:           pod.Spec.NodeName,
+	}
+	if req.ServiceAccount == "" {
+		req.ServiceAccount = "default"
+	}
+	if ns, err := r.store.NamespaceByName(pod.GetNamespace()); err == nil {
+		req.Namespace = ns
+	}
+	return req
+}
+
+// checkDeniedOrDefaultRole applies the rules of the namespace annotations that come before the roles granted to
+// the pod, returns true along with the decision if the role is denied by the namespace or is the default role
+func (r *RoleMapper) checkDeniedOrDefaultRole(roleArn string, namespace string) (Decision, bool) {
+	// Denied roles take precedence over any grant, including the default role
+	if decision, denied := r.checkDeniedRoles(roleArn, namespace); denied {
+		return decision, true
+	}
+	if roleArn == r.defaultRoleARN {
+		return allow("role %s is the default role", roleArn), true
+	}
+	return Decision{}, false
+}
+
+// checkDeniedRoles checks the denied roles annotation of a namespace, returns true along with the decision if
+// the role matches one of its patterns, or if the annotation is invalid and the role isn't the default role
+func (r *RoleMapper) checkDeniedRoles(roleArn string, namespace string) (Decision, bool) {
+	if r.namespaceDeniedKey == "" {
+		return Decision{}, false
+	}
+
+	ns, err := r.store.NamespaceByName(namespace)
+	if err != nil {
+		return Decision{}, false
 	}
 
+	roles := r.namespaces.RolesByNamespace(ns)
+	// An invalid deny list fails closed rather than granting the roles it was meant to block
+	if len(roles.DeniedInvalid) > 0 && roleArn != r.defaultRoleARN {
+		return deny("role %s denied as the denied roles annotation %s of namespace %s is invalid: %v",
+			roleArn, r.namespaceDeniedKey, namespace, roles.DeniedInvalid[0]), true
+	}
+	for _, rolePattern := range roles.Denied {
+		if rolePattern.Match(roleArn) {
+			return deny("role %s matched denied pattern %s of namespace %s", roleArn, rolePattern.Pattern, namespace), true
+		}
+	}
+	return Decision{}, false
+}
+
+// checkRoleForNamespace checks the 'database' for a role allowed in a namespace
+func (r *RoleMapper) checkRoleForNamespace(roleArn string, namespace string) Decision {
 	ns, err := r.store.NamespaceByName(namespace)
 	if err != nil {
 		log.Debugf("Unable to find an indexed namespace of %s", namespace)
-		return false
+		return deny("namespace %s is not indexed", namespace)
 	}
 
-	ar := kube2iam.GetNamespaceRoleAnnotation(ns, r.namespaceKey)
-	for _, rolePattern := range ar {
-		normalized := r.iam.RoleARN(rolePattern)
+	for _, rolePattern := range r.namespaces.RolesByNamespace(ns).Allowed {
+		if rolePattern.Match(roleArn) {
+			log.Debugf("Role: %s matched %s on namespace:%s.", roleArn, rolePattern.Pattern, namespace)
+			return allow("role %s matched pattern %s of namespace %s", roleArn, rolePattern.Pattern, namespace)
+		}
+	}
+	return deny("role %s matched no pattern of namespace %s", roleArn, namespace)
+}
 
-		if strings.ToLower(r.namespaceRestrictionFormat) == "regexp" {
-			matched, err := regexp.MatchString(normalized, roleArn)
-			if err != nil {
-				log.Errorf("Namespace annotation %s caused an error when trying to match: %s for namespace: %s", rolePattern, roleArn, namespace)
-			}
-			if matched {
-				log.Debugf("Role: %s matched %s on namespace:%s.", roleArn, rolePattern, namespace)
-				return true
-			}
-		} else {
-			if glob.Glob(normalized, roleArn) {
-				log.Debugf("Role: %s matched %s on namespace:%s.", roleArn, rolePattern, namespace)
-				return true
+// checkRoleBindings checks the IAMRoleBindings of the pod's namespace for a binding
+// selecting the pod and granting the role
+func (r *RoleMapper) checkRoleBindings(roleArn string, pod *v1.Pod) Decision {
+	if rb := r.matchingRoleBinding(roleArn, pod); rb != nil {
+		log.Debugf("Role: %s granted by IAMRoleBinding %s on namespace:%s.", roleArn, rb.GetName(), pod.GetNamespace())
+		return allow("role %s granted by IAMRoleBinding %s/%s", roleArn, rb.GetNamespace(), rb.GetName())
+	}
+	return deny("role %s not granted by any IAMRoleBinding of namespace %s", roleArn, pod.GetNamespace())
+}
+
+// matchingRoleBinding returns the first IAMRoleBinding of the pod's namespace selecting the pod and granting the role.
+func (r *RoleMapper) matchingRoleBinding(roleArn string, pod *v1.Pod) *kube2iam.IAMRoleBinding {
+	bindings, err := r.store.RoleBindingsByNamespace(pod.GetNamespace())
+	if err != nil {
+		log.Debugf("Unable to find indexed IAMRoleBindings for namespace %s: %+v", pod.GetNamespace(), err)
+		return nil
+	}
+
+	for _, rb := range bindings {
+		podSelector, err := metav1.LabelSelectorAsSelector(&rb.Spec.PodSelector)
+		if err != nil {
+			log.Errorf("IAMRoleBinding %s/%s has an invalid pod selector: %+v", rb.GetNamespace(), rb.GetName(), err)
+			continue
+		}
+		if !podSelector.Matches(labels.Set(pod.GetLabels())) {
+			continue
+		}
+		for _, rolePattern := range r.roleBindingRoles.RolesByRoleBinding(rb).Roles {
+			if rolePattern.Match(roleArn) {
+				return rb
 			}
 		}
-
 	}
-	log.Warnf("Role: %s on namespace: %s not found.", roleArn, namespace)
-	return false
+	return nil
 }
 
 // DumpDebugInfo outputs all the roles by IP address.
@@ -135,6 +361,7 @@ func (r *RoleMapper) DumpDebugInfo() map[string]interface{} {
 	rolesByIP := make(map[string]string)
 	namespacesByIP := make(map[string]string)
 	rolesByNamespace := make(map[string][]string)
+	deniedRolesByNamespace := make(map[string][]string)
 
 	for _, ip := range r.store.ListPodIPs() {
 		// When pods have `hostNetwork: true` they share an IP and we receive an error
@@ -151,25 +378,110 @@ func (r *RoleMapper) DumpDebugInfo() map[string]interface{} {
 	for _, namespaceName := range r.store.ListNamespaces() {
 		if namespace, err := r.store.NamespaceByName(namespaceName); err == nil {
 			rolesByNamespace[namespace.GetName()] = kube2iam.GetNamespaceRoleAnnotation(namespace, r.namespaceKey)
+			if denied := kube2iam.GetNamespaceRoleAnnotation(namespace, r.namespaceDeniedKey); len(denied) > 0 {
+				deniedRolesByNamespace[namespace.GetName()] = denied
+			}
+		}
+	}
+
+	if r.roleBindings {
+		roleBindingsByNamespace := make(map[string][]string)
+		for namespaceName := range rolesByNamespace {
+			if bindings, err := r.store.RoleBindingsByNamespace(namespaceName); err == nil && len(bindings) > 0 {
+				for _, rb := range bindings {
+					roleBindingsByNamespace[namespaceName] = append(roleBindingsByNamespace[namespaceName], rb.GetName())
+				}
+			}
 		}
+		output["roleBindingsByNamespace"] = roleBindingsByNamespace
+	}
+
+	if r.audit {
+		output["namespaceRestrictionViolations"] = r.violations.list()
 	}
 
 	output["rolesByIP"] = rolesByIP
 	output["namespaceByIP"] = namespacesByIP
 	output["rolesByNamespace"] = rolesByNamespace
+	output["deniedRolesByNamespace"] = deniedRolesByNamespace
 	return output
 }
 
+// NamespaceHandler returns the handler compiling the role patterns of namespaces for the mapper, it should
+// receive the events of the namespace informer.
+func (r *RoleMapper) NamespaceHandler() *kube2iam.NamespaceHandler {
+	return r.namespaces
+}
+
+// RoleBindingHandler returns the handler compiling the role patterns of IAMRoleBindings for the mapper, it should
+// receive the events of the IAMRoleBinding informer.
+func (r *RoleMapper) RoleBindingHandler() *kube2iam.RoleBindingHandler {
+	return r.roleBindingRoles
+}
+
+// Config configures a RoleMapper.
+type Config struct {
+	// RoleKey, ServiceAccountRoleKey and ExternalIDKey are the annotations holding the role of pods and service
+	// accounts and the external ID of pods.
+	RoleKey               string
+	ServiceAccountRoleKey string
+	ExternalIDKey         string
+	// SessionPolicyKey and SessionPolicyARNsKey are the annotations holding the session policies of pods and
+	// namespaces, they are disabled when empty.
+	SessionPolicyKey     string
+	SessionPolicyARNsKey string
+	// DefaultRole is the role of pods that don't request one.
+	DefaultRole string
+	// NamespaceRestriction restricts the roles of pods to the ones allowed for their namespace.
+	NamespaceRestriction bool
+	// RoleBindings allows roles with IAMRoleBindings rather than namespace annotations.
+	RoleBindings bool
+	// Audit records the violations of namespace restrictions but still issues credentials.
+	Audit                   bool
+	NamespaceKey            string
+	NamespaceDeniedKey      string
+	NamespaceDefaultRoleKey string
+	// NamespaceRestrictionFormat is the format of the role patterns of namespaces (glob/regexp).
+	NamespaceRestrictionFormat string
+	SessionTagMappings         []SessionTagMapping
+	// Policy authorizes the roles of pods in place of namespace annotations and IAMRoleBindings when set.
+	Policy *AuthorizationPolicy
+}
+
 // NewRoleMapper returns a new RoleMapper for use.
-func NewRoleMapper(roleKey string, externalIDKey string, defaultRole string, namespaceRestriction bool, namespaceKey string, iamInstance *iam.Client, kubeStore store, namespaceRestrictionFormat string) *RoleMapper {
-	return &RoleMapper{
-		defaultRoleARN:             iamInstance.RoleARN(defaultRole),
-		iamRoleKey:                 roleKey,
-		iamExternalIDKey:           externalIDKey,
-		namespaceKey:               namespaceKey,
-		namespaceRestriction:       namespaceRestriction,
+func NewRoleMapper(config Config, iamInstance *iam.Client, kubeStore store) *RoleMapper {
+	r := &RoleMapper{
+		defaultRoleARN:             iamInstance.RoleARN(config.DefaultRole),
+		iamRoleKey:                 config.RoleKey,
+		serviceAccountRoleKey:      config.ServiceAccountRoleKey,
+		iamExternalIDKey:           config.ExternalIDKey,
+		sessionPolicyKey:           config.SessionPolicyKey,
+		sessionPolicyARNsKey:       config.SessionPolicyARNsKey,
+		namespaceKey:               config.NamespaceKey,
+		namespaceDeniedKey:         config.NamespaceDeniedKey,
+		namespaceDefaultRoleKey:    config.NamespaceDefaultRoleKey,
+		namespaceRestriction:       config.NamespaceRestriction,
+		roleBindings:               config.RoleBindings,
+		audit:                      config.Audit,
+		violations:                 newViolationLog(),
 		iam:                        iamInstance,
 		store:                      kubeStore,
-		namespaceRestrictionFormat: namespaceRestrictionFormat,
+		namespaceRestrictionFormat: config.NamespaceRestrictionFormat,
+		sessionTagMappings:         config.SessionTagMappings,
+	}
+
+	r.namespaces = kube2iam.NewNamespaceHandler(config.NamespaceKey, config.NamespaceDeniedKey, config.NamespaceRestrictionFormat, iamInstance.RoleARN)
+	r.roleBindingRoles = kube2iam.NewRoleBindingHandler(config.NamespaceRestrictionFormat, iamInstance.RoleARN)
+
+	switch {
+	case !config.NamespaceRestriction:
+		r.authorizer = allowAllAuthorizer{}
+	case config.Policy != nil:
+		r.authorizer = newPolicyAuthorizer(config.Policy, config.NamespaceRestrictionFormat, iamInstance.RoleARN)
+	case config.RoleBindings:
+		r.authorizer = &roleBindingAuthorizer{mapper: r}
+	default:
+		r.authorizer = &namespaceAnnotationAuthorizer{mapper: r}
 	}
+	return r
 }
@@ -1,27 +1,56 @@
 package mappings
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/jtblin/kube2iam"
 	"github.com/jtblin/kube2iam/iam"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 const (
-	defaultBaseRole = "arn:aws:iam::123456789012:role/"
-	roleKey         = "roleKey"
-	externalIDKey   = "externalIDKey"
-	namespaceKey    = "namespaceKey"
+	defaultBaseRole         = "arn:aws:iam::123456789012:role/"
+	roleKey                 = "roleKey"
+	saRoleKey               = "saRoleKey"
+	externalIDKey           = "externalIDKey"
+	policyKey               = "policyKey"
+	policyARNsKey           = "policyARNsKey"
+	namespaceKey            = "namespaceKey"
+	namespaceDeniedKey      = "namespaceDeniedKey"
+	namespaceDefaultRoleKey = "namespaceDefaultRoleKey"
 )
 
+// newTestConfig returns the configuration of a role mapper restricting roles with the test annotation keys,
+// tests override its fields.
+func newTestConfig() Config {
+	return Config{
+		RoleKey:                    roleKey,
+		ServiceAccountRoleKey:      saRoleKey,
+		ExternalIDKey:              externalIDKey,
+		SessionPolicyKey:           policyKey,
+		SessionPolicyARNsKey:       policyARNsKey,
+		NamespaceRestriction:       true,
+		NamespaceKey:               namespaceKey,
+		NamespaceDeniedKey:         namespaceDeniedKey,
+		NamespaceDefaultRoleKey:    namespaceDefaultRoleKey,
+		NamespaceRestrictionFormat: "glob",
+	}
+}
+
 func TestExtractRoleARN(t *testing.T) {
 	var roleExtractionTests = []struct {
-		test        string
-		annotations map[string]string
-		defaultRole string
-		expectedARN string
-		expectError bool
+		test          string
+		annotations   map[string]string
+		saAnnotations map[string]string
+		nsAnnotations map[string]string
+		saRoleKey     string
+		defaultRole   string
+		expectedARN   string
+		expectError   bool
 	}{
 		{
 			test:        "No default, no annotation",
@@ -63,6 +92,65 @@ func TestExtractRoleARN(t *testing.T) {
 			defaultRole: "explicit-default-role",
 			expectedARN: "arn:aws:iam::123456789012:role/something",
 		},
+		{
+			test:          "Service account key disabled, has service account annotation",
+			annotations:   map[string]string{},
+			saAnnotations: map[string]string{saRoleKey: "sa-role"},
+			defaultRole:   "explicit-default-role",
+			expectedARN:   "arn:aws:iam::123456789012:role/explicit-default-role",
+		},
+		{
+			test:          "No default, has service account annotation",
+			annotations:   map[string]string{},
+			saAnnotations: map[string]string{saRoleKey: "arn:aws:iam::999999999999:role/sa-role"},
+			saRoleKey:     saRoleKey,
+			expectedARN:   "arn:aws:iam::999999999999:role/sa-role",
+		},
+		{
+			test:          "Default present, has service account annotation",
+			annotations:   map[string]string{},
+			saAnnotations: map[string]string{saRoleKey: "sa-role"},
+			saRoleKey:     saRoleKey,
+			defaultRole:   "explicit-default-role",
+			expectedARN:   "arn:aws:iam::123456789012:role/sa-role",
+		},
+		{
+			test:          "Default present, has annotations and service account annotation",
+			annotations:   map[string]string{roleKey: "something"},
+			saAnnotations: map[string]string{saRoleKey: "sa-role"},
+			saRoleKey:     saRoleKey,
+			defaultRole:   "explicit-default-role",
+			expectedARN:   "arn:aws:iam::123456789012:role/something",
+		},
+		{
+			test:        "Default present, no service account",
+			annotations: map[string]string{},
+			saRoleKey:   saRoleKey,
+			defaultRole: "explicit-default-role",
+			expectedARN: "arn:aws:iam::123456789012:role/explicit-default-role",
+		},
+		{
+			test:          "No default, has namespace default",
+			annotations:   map[string]string{},
+			nsAnnotations: map[string]string{namespaceDefaultRoleKey: "namespace-role"},
+			expectedARN:   "arn:aws:iam::123456789012:role/namespace-role",
+		},
+		{
+			test:          "Default present, namespace default takes precedence",
+			annotations:   map[string]string{},
+			nsAnnotations: map[string]string{namespaceDefaultRoleKey: "namespace-role"},
+			defaultRole:   "explicit-default-role",
+			expectedARN:   "arn:aws:iam::123456789012:role/namespace-role",
+		},
+		{
+			test:          "Default present, has service account annotation and namespace default",
+			annotations:   map[string]string{},
+			saAnnotations: map[string]string{saRoleKey: "sa-role"},
+			nsAnnotations: map[string]string{namespaceDefaultRoleKey: "namespace-role"},
+			saRoleKey:     saRoleKey,
+			defaultRole:   "explicit-default-role",
+			expectedARN:   "arn:aws:iam::123456789012:role/sa-role",
+		},
 	}
 	for _, tt := range roleExtractionTests {
 		t.Run(tt.test, func(t *testing.T) {
@@ -70,12 +158,16 @@ func TestExtractRoleARN(t *testing.T) {
 			rp.iamRoleKey = "roleKey"
 			rp.iamExternalIDKey = "externalIDKey"
 			rp.defaultRoleARN = tt.defaultRole
+			rp.serviceAccountRoleKey = tt.saRoleKey
+			rp.namespaceDefaultRoleKey = namespaceDefaultRoleKey
 			rp.iam = &iam.Client{BaseARN: defaultBaseRole}
+			rp.store = &storeMock{namespace: "default", annotations: tt.nsAnnotations, saAnnotations: tt.saAnnotations}
 
 			pod := &v1.Pod{}
+			pod.Namespace = "default"
 			pod.Annotations = tt.annotations
 
-			resp, err := rp.extractRoleARN(pod)
+			resp, err := rp.extractRoleARN(pod, pod.Status.PodIP)
 			if tt.expectError && err == nil {
 				t.Error("Expected error however didn't recieve one")
 				return
@@ -358,48 +450,458 @@ func TestCheckRoleForNamespace(t *testing.T) {
 
 	for _, tt := range roleCheckTests {
 		t.Run(tt.test, func(t *testing.T) {
+			config := newTestConfig()
+			config.DefaultRole = tt.defaultArn
+			config.NamespaceRestriction = tt.namespaceRestriction
+			config.NamespaceRestrictionFormat = tt.namespaceRestrictionFormat
 			rp := NewRoleMapper(
-				roleKey,
-				externalIDKey,
-				tt.defaultArn,
-				tt.namespaceRestriction,
-				namespaceKey,
+				config,
 				&iam.Client{BaseARN: defaultBaseRole},
 				&storeMock{
 					namespace:   tt.namespace,
 					annotations: tt.namespaceAnnotations,
 				},
-				tt.namespaceRestrictionFormat,
 			)
 
-			resp := rp.checkRoleForNamespace(tt.roleARN, tt.namespace)
-			if resp != tt.expectedResult {
-				t.Errorf("Expected [%t] for test but recieved [%t]", tt.expectedResult, resp)
+			pod := &v1.Pod{}
+			pod.Namespace = tt.namespace
+
+			resp := rp.checkRoleForPod(tt.roleARN, pod)
+			if resp.Allowed != tt.expectedResult {
+				t.Errorf("Expected [%t] for test but recieved [%+v]", tt.expectedResult, resp)
+			}
+		})
+	}
+}
+
+func TestCheckRoleBindings(t *testing.T) {
+	bindings := []*kube2iam.IAMRoleBinding{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: kube2iam.IAMRoleBindingSpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				Roles:       []string{"web-*"},
+				ExternalID:  "web-external-id",
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "all", Namespace: "default"},
+			Spec: kube2iam.IAMRoleBindingSpec{
+				Roles: []string{"arn:aws:iam::123456789012:role/shared-role"},
+			},
+		},
+	}
+
+	var roleBindingTests = []struct {
+		test                 string
+		namespaceRestriction bool
+		defaultArn           string
+		podLabels            map[string]string
+		roleARN              string
+		expectedResult       bool
+		expectedExternalID   string
+	}{
+		{
+			test:                 "No restrictions",
+			namespaceRestriction: false,
+			roleARN:              "arn:aws:iam::123456789012:role/explicit-role",
+			expectedResult:       true,
+		},
+		{
+			test:                 "Restrictions enabled, default role",
+			namespaceRestriction: true,
+			defaultArn:           "default-role",
+			roleARN:              "arn:aws:iam::123456789012:role/default-role",
+			expectedResult:       true,
+		},
+		{
+			test:                 "Restrictions enabled, selector matches",
+			namespaceRestriction: true,
+			podLabels:            map[string]string{"app": "web"},
+			roleARN:              "arn:aws:iam::123456789012:role/web-role",
+			expectedResult:       true,
+			expectedExternalID:   "web-external-id",
+		},
+		{
+			test:                 "Restrictions enabled, selector does not match",
+			namespaceRestriction: true,
+			podLabels:            map[string]string{"app": "worker"},
+			roleARN:              "arn:aws:iam::123456789012:role/web-role",
+			expectedResult:       false,
+		},
+		{
+			test:                 "Restrictions enabled, empty selector matches all pods",
+			namespaceRestriction: true,
+			podLabels:            map[string]string{"app": "worker"},
+			roleARN:              "arn:aws:iam::123456789012:role/shared-role",
+			expectedResult:       true,
+		},
+		{
+			test:                 "Restrictions enabled, role not granted",
+			namespaceRestriction: true,
+			podLabels:            map[string]string{"app": "web"},
+			roleARN:              "arn:aws:iam::123456789012:role/admin-role",
+			expectedResult:       false,
+		},
+	}
+
+	for _, tt := range roleBindingTests {
+		t.Run(tt.test, func(t *testing.T) {
+			config := newTestConfig()
+			config.DefaultRole = tt.defaultArn
+			config.NamespaceRestriction = tt.namespaceRestriction
+			config.RoleBindings = true
+			rp := NewRoleMapper(
+				config,
+				&iam.Client{BaseARN: defaultBaseRole},
+				&storeMock{
+					namespace:    "default",
+					roleBindings: bindings,
+				},
+			)
+
+			pod := &v1.Pod{}
+			pod.Namespace = "default"
+			pod.Labels = tt.podLabels
+			pod.Annotations = map[string]string{roleKey: tt.roleARN, externalIDKey: "pod-external-id"}
+
+			resp := rp.checkRoleForPod(tt.roleARN, pod)
+			if resp.Allowed != tt.expectedResult {
+				t.Errorf("Expected [%t] for test but recieved [%+v]", tt.expectedResult, resp)
+			}
+			if tt.expectedExternalID == "" {
+				return
+			}
+			rb := rp.matchingRoleBinding(tt.roleARN, pod)
+			if rb == nil || rb.Spec.ExternalID != tt.expectedExternalID {
+				t.Errorf("Expected external ID [%s] for test but recieved binding [%+v]", tt.expectedExternalID, rb)
+			}
+		})
+	}
+}
+
+func TestCheckDeniedRoles(t *testing.T) {
+	var deniedTests = []struct {
+		test                       string
+		namespaceRestriction       bool
+		defaultArn                 string
+		namespaceAnnotations       map[string]string
+		roleARN                    string
+		namespaceRestrictionFormat string
+		expectedResult             bool
+	}{
+		{
+			test:                       "Allowed by wildcard, not denied",
+			namespaceRestriction:       true,
+			namespaceAnnotations:       map[string]string{namespaceKey: `["team-a-*"]`, namespaceDeniedKey: `["*-admin"]`},
+			roleARN:                    "arn:aws:iam::123456789012:role/team-a-reader",
+			namespaceRestrictionFormat: "glob",
+			expectedResult:             true,
+		},
+		{
+			test:                       "Allowed by wildcard, denied by glob",
+			namespaceRestriction:       true,
+			namespaceAnnotations:       map[string]string{namespaceKey: `["team-a-*"]`, namespaceDeniedKey: `["*-admin"]`},
+			roleARN:                    "arn:aws:iam::123456789012:role/team-a-admin",
+			namespaceRestrictionFormat: "glob",
+			expectedResult:             false,
+		},
+		{
+			test:                       "Allowed by wildcard, denied by regexp",
+			namespaceRestriction:       true,
+			namespaceAnnotations:       map[string]string{namespaceKey: `["team-a-.*"]`, namespaceDeniedKey: `[".*-admin$"]`},
+			roleARN:                    "arn:aws:iam::123456789012:role/team-a-admin",
+			namespaceRestrictionFormat: "regexp",
+			expectedResult:             false,
+		},
+		{
+			test:                       "Default role denied",
+			namespaceRestriction:       true,
+			defaultArn:                 "team-a-admin",
+			namespaceAnnotations:       map[string]string{namespaceDeniedKey: `["*-admin"]`},
+			roleARN:                    "arn:aws:iam::123456789012:role/team-a-admin",
+			namespaceRestrictionFormat: "glob",
+			expectedResult:             false,
+		},
+		{
+			test:                       "Default role not denied",
+			namespaceRestriction:       true,
+			defaultArn:                 "team-a-reader",
+			namespaceAnnotations:       map[string]string{namespaceDeniedKey: `["*-admin"]`},
+			roleARN:                    "arn:aws:iam::123456789012:role/team-a-reader",
+			namespaceRestrictionFormat: "glob",
+			expectedResult:             true,
+		},
+		{
+			test:                       "Undecodable denied roles, role denied",
+			namespaceRestriction:       true,
+			namespaceAnnotations:       map[string]string{namespaceKey: `["team-a-*"]`, namespaceDeniedKey: `not json`},
+			roleARN:                    "arn:aws:iam::123456789012:role/team-a-reader",
+			namespaceRestrictionFormat: "glob",
+			expectedResult:             false,
+		},
+		{
+			test:                       "Invalid denied pattern, role denied",
+			namespaceRestriction:       true,
+			namespaceAnnotations:       map[string]string{namespaceKey: `["team-a-.*"]`, namespaceDeniedKey: `[".*-admin$", "team-(b"]`},
+			roleARN:                    "arn:aws:iam::123456789012:role/team-a-reader",
+			namespaceRestrictionFormat: "regexp",
+			expectedResult:             false,
+		},
+		{
+			test:                       "Undecodable denied roles, default role not denied",
+			namespaceRestriction:       true,
+			defaultArn:                 "team-a-reader",
+			namespaceAnnotations:       map[string]string{namespaceDeniedKey: `not json`},
+			roleARN:                    "arn:aws:iam::123456789012:role/team-a-reader",
+			namespaceRestrictionFormat: "glob",
+			expectedResult:             true,
+		},
+		{
+			test:                       "Denied roles ignored without restrictions",
+			namespaceRestriction:       false,
+			namespaceAnnotations:       map[string]string{namespaceDeniedKey: `["*-admin"]`},
+			roleARN:                    "arn:aws:iam::123456789012:role/team-a-admin",
+			namespaceRestrictionFormat: "glob",
+			expectedResult:             true,
+		},
+	}
+
+	for _, tt := range deniedTests {
+		t.Run(tt.test, func(t *testing.T) {
+			config := newTestConfig()
+			config.DefaultRole = tt.defaultArn
+			config.NamespaceRestriction = tt.namespaceRestriction
+			config.NamespaceRestrictionFormat = tt.namespaceRestrictionFormat
+			rp := NewRoleMapper(
+				config,
+				&iam.Client{BaseARN: defaultBaseRole},
+				&storeMock{
+					namespace:   "default",
+					annotations: tt.namespaceAnnotations,
+				},
+			)
+
+			pod := &v1.Pod{}
+			pod.Namespace = "default"
+
+			resp := rp.checkRoleForPod(tt.roleARN, pod)
+			if resp.Allowed != tt.expectedResult {
+				t.Errorf("Expected [%t] for test but recieved [%+v]", tt.expectedResult, resp)
+			}
+			if !resp.Allowed && strings.Contains(tt.namespaceAnnotations[namespaceDeniedKey], "not json") &&
+				!strings.Contains(resp.Reason, "is invalid") {
+				t.Errorf("Expected reason to report the invalid annotation but recieved [%s]", resp.Reason)
+			}
+		})
+	}
+}
+
+func TestNamespaceDefaultRoleRestrictions(t *testing.T) {
+	var defaultRoleTests = []struct {
+		test                 string
+		namespaceAnnotations map[string]string
+		expectError          bool
+	}{
+		{
+			test:                 "Namespace default allowed",
+			namespaceAnnotations: map[string]string{namespaceDefaultRoleKey: "team-a-baseline", namespaceKey: `["team-a-*"]`},
+		},
+		{
+			test:                 "Namespace default not allowed",
+			namespaceAnnotations: map[string]string{namespaceDefaultRoleKey: "team-b-baseline", namespaceKey: `["team-a-*"]`},
+			expectError:          true,
+		},
+		{
+			test:                 "Namespace default denied",
+			namespaceAnnotations: map[string]string{namespaceDefaultRoleKey: "team-a-admin", namespaceKey: `["team-a-*"]`, namespaceDeniedKey: `["*-admin"]`},
+			expectError:          true,
+		},
+		{
+			test:                 "Global default allowed",
+			namespaceAnnotations: map[string]string{namespaceKey: `["team-a-*"]`},
+		},
+	}
+
+	for _, tt := range defaultRoleTests {
+		t.Run(tt.test, func(t *testing.T) {
+			config := newTestConfig()
+			config.DefaultRole = "global-default"
+			rp := NewRoleMapper(
+				config,
+				&iam.Client{BaseARN: defaultBaseRole},
+				&storeMock{
+					namespace:   "default",
+					annotations: tt.namespaceAnnotations,
+				},
+			)
+
+			pod := &v1.Pod{}
+			pod.Namespace = "default"
+
+			_, err := rp.GetRoleMappingForPod(pod, "")
+			if tt.expectError != (err != nil) {
+				t.Errorf("Expected error [%t] for test but recieved [%v]", tt.expectError, err)
+			}
+		})
+	}
+}
+
+func TestGetRoleMappingForPodIP(t *testing.T) {
+	rp := NewRoleMapper(
+		newTestConfig(),
+		&iam.Client{BaseARN: defaultBaseRole},
+		&storeMock{
+			namespace:   "default",
+			annotations: map[string]string{namespaceKey: `["team-a-*"]`},
+		},
+	)
+
+	pod := &v1.Pod{}
+	pod.Namespace = "default"
+	pod.Status.PodIP = "10.0.0.1"
+	pod.Status.PodIPs = []v1.PodIP{{IP: "10.0.0.1"}, {IP: "2600:1f14::1"}}
+
+	pod.Annotations = map[string]string{roleKey: "team-a-reader"}
+	result, err := rp.GetRoleMappingForPod(pod, "2600:1f14::1")
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	if result.IP != "2600:1f14::1" {
+		t.Errorf("Expected the IP of the request but recieved [%s]", result.IP)
+	}
+	if result, err = rp.GetRoleMappingForPod(pod, ""); err != nil || result.IP != "10.0.0.1" {
+		t.Errorf("Expected the primary IP of the pod but recieved [%+v] %v", result, err)
+	}
+
+	pod.Annotations = map[string]string{roleKey: "team-b-reader"}
+	_, err = rp.GetRoleMappingForPod(pod, "2600:1f14::1")
+	var denied *RoleDeniedError
+	if !errors.As(err, &denied) || denied.IP != "2600:1f14::1" {
+		t.Errorf("Expected the role to be denied to the IP of the request but recieved %v", err)
+	}
+}
+
+func TestValidatePod(t *testing.T) {
+	var validateTests = []struct {
+		test            string
+		audit           bool
+		annotations     map[string]string
+		expectedResult  bool
+		expectedAudited bool
+	}{
+		{
+			test:           "No role",
+			annotations:    map[string]string{},
+			expectedResult: true,
+		},
+		{
+			test:           "Allowed role",
+			annotations:    map[string]string{roleKey: "team-a-reader"},
+			expectedResult: true,
+		},
+		{
+			test:           "Role not allowed",
+			annotations:    map[string]string{roleKey: "team-b-reader"},
+			expectedResult: false,
+		},
+		{
+			test:           "Denied role",
+			annotations:    map[string]string{roleKey: "team-a-admin"},
+			expectedResult: false,
+		},
+		{
+			test:           "Invalid role ARN",
+			annotations:    map[string]string{roleKey: "arn:aws:iam::not-an-account:role/team-a-reader"},
+			expectedResult: false,
+		},
+		{
+			test:            "Role not allowed in audit mode",
+			audit:           true,
+			annotations:     map[string]string{roleKey: "team-b-reader"},
+			expectedResult:  true,
+			expectedAudited: true,
+		},
+		{
+			test:           "Invalid role ARN in audit mode",
+			audit:          true,
+			annotations:    map[string]string{roleKey: "arn:aws:iam::not-an-account:role/team-a-reader"},
+			expectedResult: false,
+		},
+	}
+
+	for _, tt := range validateTests {
+		t.Run(tt.test, func(t *testing.T) {
+			config := newTestConfig()
+			config.Audit = tt.audit
+			rp := NewRoleMapper(
+				config,
+				&iam.Client{BaseARN: defaultBaseRole},
+				&storeMock{
+					namespace:   "default",
+					annotations: map[string]string{namespaceKey: `["team-a-*", "arn:aws:iam::*:role/team-a-*"]`, namespaceDeniedKey: `["*-admin"]`},
+				},
+			)
+
+			pod := &v1.Pod{}
+			pod.Namespace = "default"
+			pod.Annotations = tt.annotations
+
+			resp := rp.ValidatePod(pod)
+			if resp.Allowed != tt.expectedResult || resp.Audited != tt.expectedAudited {
+				t.Errorf("Expected [%t] audited [%t] for test but recieved [%+v]", tt.expectedResult, tt.expectedAudited, resp)
 			}
 		})
 	}
 }
 
 type storeMock struct {
-	namespace   string
-	annotations map[string]string
+	pods            []*v1.Pod
+	namespace       string
+	annotations     map[string]string
+	namespaceLabels map[string]string
+	saAnnotations   map[string]string
+	roleBindings    []*kube2iam.IAMRoleBinding
 }
 
 func (k *storeMock) ListPodIPs() []string {
 	return nil
 }
+func (k *storeMock) ListPods() []*v1.Pod {
+	return k.pods
+}
 func (k *storeMock) PodByIP(string) (*v1.Pod, error) {
 	return nil, nil
 }
 func (k *storeMock) ListNamespaces() []string {
-	return nil
+	if k.namespace == "" {
+		return nil
+	}
+	return []string{k.namespace}
 }
 func (k *storeMock) NamespaceByName(ns string) (*v1.Namespace, error) {
 	if ns == k.namespace {
 		nns := &v1.Namespace{}
 		nns.Name = k.namespace
 		nns.Annotations = k.annotations
+		nns.Labels = k.namespaceLabels
 		return nns, nil
 	}
 	return nil, fmt.Errorf("namespace isn't present")
 }
+func (k *storeMock) ServiceAccountByName(ns, name string) (*v1.ServiceAccount, error) {
+	if k.saAnnotations != nil {
+		sa := &v1.ServiceAccount{}
+		sa.Namespace = ns
+		sa.Name = name
+		sa.Annotations = k.saAnnotations
+		return sa, nil
+	}
+	return nil, fmt.Errorf("service account isn't present")
+}
+func (k *storeMock) RoleBindingsByNamespace(ns string) ([]*kube2iam.IAMRoleBinding, error) {
+	if ns == k.namespace {
+		return k.roleBindings, nil
+	}
+	return nil, nil
+}
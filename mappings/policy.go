@@ -0,0 +1,67 @@
+package mappings
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const maxSessionPolicyARNs = 10
+
+// sessionPolicy returns the inline session policy and managed session policy ARNs requested by the pod.
+// When namespace restrictions are enabled and its namespace is annotated with a session policy, the pods of the
+// namespace get the policy of the namespace in place of their own.
+func (r *RoleMapper) sessionPolicy(pod *v1.Pod) (string, []string, error) {
+	policy, policyARNs, err := r.parseSessionPolicy(pod.GetAnnotations())
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid session policy on pod %s/%s: %v", pod.GetNamespace(), pod.GetName(), err)
+	}
+	if !r.namespaceRestriction {
+		return policy, policyARNs, nil
+	}
+
+	ns, err := r.store.NamespaceByName(pod.GetNamespace())
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to look up the session policy of namespace %s: %v", pod.GetNamespace(), err)
+	}
+	nsPolicy, nsPolicyARNs, err := r.parseSessionPolicy(ns.GetAnnotations())
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid session policy on namespace %s: %v", ns.GetName(), err)
+	}
+	if nsPolicy == "" && len(nsPolicyARNs) == 0 {
+		return policy, policyARNs, nil
+	}
+	return nsPolicy, nsPolicyARNs, nil
+}
+
+// parseSessionPolicy reads the session policy annotations, the inline policy is a JSON policy document
+// and the managed policies are a JSON array of policy ARNs (["arn:aws:iam::aws:policy/ReadOnlyAccess"]).
+func (r *RoleMapper) parseSessionPolicy(annotations map[string]string) (string, []string, error) {
+	var policy string
+	if r.sessionPolicyKey != "" {
+		policy = strings.TrimSpace(annotations[r.sessionPolicyKey])
+		if policy != "" && !json.Valid([]byte(policy)) {
+			return "", nil, fmt.Errorf("%s is not a valid JSON policy document", r.sessionPolicyKey)
+		}
+	}
+
+	var policyARNs []string
+	if r.sessionPolicyARNsKey != "" {
+		if arns := annotations[r.sessionPolicyARNsKey]; arns != "" {
+			if err := json.Unmarshal([]byte(arns), &policyARNs); err != nil {
+				return "", nil, fmt.Errorf("%s is not a JSON array: %v", r.sessionPolicyARNsKey, err)
+			}
+		}
+		if len(policyARNs) > maxSessionPolicyARNs {
+			return "", nil, fmt.Errorf("%s lists more than %d policies", r.sessionPolicyARNsKey, maxSessionPolicyARNs)
+		}
+		for _, arn := range policyARNs {
+			if !strings.HasPrefix(arn, "arn:") {
+				return "", nil, fmt.Errorf("%s must only contain policy ARNs, got %q", r.sessionPolicyARNsKey, arn)
+			}
+		}
+	}
+	return policy, policyARNs, nil
+}
@@ -0,0 +1,150 @@
+package mappings
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jtblin/kube2iam/iam"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestSessionPolicy(t *testing.T) {
+	const (
+		podPolicy = `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"*"}]}`
+		nsPolicy  = `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:*","Resource":"*"}]}`
+	)
+
+	var policyTests = []struct {
+		test                 string
+		namespaceRestriction bool
+		namespaceMissing     bool
+		podAnnotations       map[string]string
+		nsAnnotations        map[string]string
+		expectedPolicy       string
+		expectedPolicyARNs   []string
+		expectError          bool
+	}{
+		{
+			test:           "No policy",
+			podAnnotations: map[string]string{},
+		},
+		{
+			test:               "Pod policy and policy ARNs",
+			podAnnotations:     map[string]string{policyKey: podPolicy, policyARNsKey: `["arn:aws:iam::aws:policy/ReadOnlyAccess"]`},
+			expectedPolicy:     podPolicy,
+			expectedPolicyARNs: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+		},
+		{
+			test:           "Pod policy with restrictions disabled",
+			podAnnotations: map[string]string{policyKey: podPolicy},
+			nsAnnotations:  map[string]string{policyKey: nsPolicy},
+			expectedPolicy: podPolicy,
+		},
+		{
+			test:                 "Namespace policy with restrictions enabled",
+			namespaceRestriction: true,
+			podAnnotations:       map[string]string{},
+			nsAnnotations:        map[string]string{policyKey: nsPolicy},
+			expectedPolicy:       nsPolicy,
+		},
+		{
+			test:                 "Namespace policy in place of the pod policy",
+			namespaceRestriction: true,
+			podAnnotations:       map[string]string{policyKey: podPolicy, policyARNsKey: `["arn:aws:iam::aws:policy/ReadOnlyAccess"]`},
+			nsAnnotations:        map[string]string{policyKey: nsPolicy},
+			expectedPolicy:       nsPolicy,
+		},
+		{
+			test:                 "Namespace policy ARNs in place of the pod policy",
+			namespaceRestriction: true,
+			podAnnotations:       map[string]string{policyKey: podPolicy},
+			nsAnnotations:        map[string]string{policyARNsKey: `["arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess"]`},
+			expectedPolicyARNs:   []string{"arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess"},
+		},
+		{
+			test:                 "Invalid namespace policy",
+			namespaceRestriction: true,
+			podAnnotations:       map[string]string{policyKey: podPolicy},
+			nsAnnotations:        map[string]string{policyKey: "{not json"},
+			expectError:          true,
+		},
+		{
+			test:                 "Namespace not found with restrictions enabled",
+			namespaceRestriction: true,
+			namespaceMissing:     true,
+			podAnnotations:       map[string]string{policyKey: podPolicy},
+			expectError:          true,
+		},
+		{
+			test:                 "Pod policy when the namespace has none",
+			namespaceRestriction: true,
+			podAnnotations:       map[string]string{policyKey: podPolicy},
+			nsAnnotations:        map[string]string{},
+			expectedPolicy:       podPolicy,
+		},
+		{
+			test:           "Namespace policy ignored with restrictions disabled",
+			podAnnotations: map[string]string{},
+			nsAnnotations:  map[string]string{policyKey: nsPolicy},
+		},
+		{
+			test:           "Invalid policy document",
+			podAnnotations: map[string]string{policyKey: "{not json"},
+			expectError:    true,
+		},
+		{
+			test:           "Policy ARNs not a JSON array",
+			podAnnotations: map[string]string{policyARNsKey: "arn:aws:iam::aws:policy/ReadOnlyAccess"},
+			expectError:    true,
+		},
+		{
+			test:           "Policy ARNs containing a policy name",
+			podAnnotations: map[string]string{policyARNsKey: `["ReadOnlyAccess"]`},
+			expectError:    true,
+		},
+		{
+			test:           "Too many policy ARNs",
+			podAnnotations: map[string]string{policyARNsKey: `["arn:1","arn:2","arn:3","arn:4","arn:5","arn:6","arn:7","arn:8","arn:9","arn:10","arn:11"]`},
+			expectError:    true,
+		},
+	}
+
+	for _, tt := range policyTests {
+		t.Run(tt.test, func(t *testing.T) {
+			namespace := "default"
+			if tt.namespaceMissing {
+				namespace = ""
+			}
+			config := newTestConfig()
+			config.NamespaceRestriction = tt.namespaceRestriction
+			rp := NewRoleMapper(
+				config,
+				&iam.Client{BaseARN: defaultBaseRole},
+				&storeMock{
+					namespace:   namespace,
+					annotations: tt.nsAnnotations,
+				},
+			)
+
+			pod := &v1.Pod{}
+			pod.Namespace = "default"
+			pod.Annotations = tt.podAnnotations
+
+			policy, policyARNs, err := rp.sessionPolicy(pod)
+			if tt.expectError && err == nil {
+				t.Error("Expected error however didn't recieve one")
+				return
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Didn't expect error but recieved %s", err)
+				return
+			}
+			if policy != tt.expectedPolicy {
+				t.Errorf("Policy [%s] did not equal expected [%s]", policy, tt.expectedPolicy)
+			}
+			if !reflect.DeepEqual(policyARNs, tt.expectedPolicyARNs) {
+				t.Errorf("Policy ARNs [%v] did not equal expected [%v]", policyARNs, tt.expectedPolicyARNs)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package mappings
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// SessionTagSourceNamespace tags the session with the namespace of the pod.
+	SessionTagSourceNamespace = "namespace"
+	// SessionTagSourcePodName tags the session with the name of the pod.
+	SessionTagSourcePodName = "pod-name"
+	// SessionTagSourceServiceAccount tags the session with the service account of the pod.
+	SessionTagSourceServiceAccount = "service-account"
+	// SessionTagSourceLabelPrefix tags the session with the value of a pod label, e.g. label:app.
+	SessionTagSourceLabelPrefix = "label:"
+
+	maxSessionTagKeyLength   = 128
+	maxSessionTagValueLength = 256
+)
+
+// SessionTagMapping maps a STS session tag key to the pod metadata its value is read from.
+type SessionTagMapping struct {
+	Key    string
+	Source string
+}
+
+// ParseSessionTagMappings parses session tag mappings in the form key=source, where source is
+// one of namespace, pod-name, service-account or label:<label key>.
+func ParseSessionTagMappings(specs []string) ([]SessionTagMapping, error) {
+	tagMappings := make([]SessionTagMapping, 0, len(specs))
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid session tag %q, expected key=source", spec)
+		}
+		key, source := parts[0], parts[1]
+		if len(key) > maxSessionTagKeyLength {
+			return nil, fmt.Errorf("session tag key %q is longer than %d characters", key, maxSessionTagKeyLength)
+		}
+		// Tag keys are case insensitive for STS
+		if seen[strings.ToLower(key)] {
+			return nil, fmt.Errorf("session tag key %q is mapped more than once", key)
+		}
+		seen[strings.ToLower(key)] = true
+
+		switch {
+		case source == SessionTagSourceNamespace, source == SessionTagSourcePodName, source == SessionTagSourceServiceAccount:
+		case strings.HasPrefix(source, SessionTagSourceLabelPrefix) && len(source) > len(SessionTagSourceLabelPrefix):
+		default:
+			return nil, fmt.Errorf("invalid session tag source %q for key %q", source, key)
+		}
+		tagMappings = append(tagMappings, SessionTagMapping{Key: key, Source: source})
+	}
+	return tagMappings, nil
+}
+
+// sessionTags returns the session tags of a pod according to the configured mappings.
+// Tags mapped to a label the pod doesn't have are omitted.
+func (r *RoleMapper) sessionTags(pod *v1.Pod) map[string]string {
+	if len(r.sessionTagMappings) == 0 {
+		return nil
+	}
+
+	tags := make(map[string]string, len(r.sessionTagMappings))
+	for _, m := range r.sessionTagMappings {
+		var value string
+		switch m.Source {
+		case SessionTagSourceNamespace:
+			value = pod.GetNamespace()
+		case SessionTagSourcePodName:
+			value = pod.GetName()
+		case SessionTagSourceServiceAccount:
+			value = pod.Spec.ServiceAccountName
+		default:
+			var ok bool
+			if value, ok = pod.GetLabels()[strings.TrimPrefix(m.Source, SessionTagSourceLabelPrefix)]; !ok {
+				continue
+			}
+		}
+		if len(value) > maxSessionTagValueLength {
+			value = value[:maxSessionTagValueLength]
+		}
+		tags[m.Key] = value
+	}
+	return tags
+}
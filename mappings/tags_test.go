@@ -0,0 +1,89 @@
+package mappings
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestParseSessionTagMappings(t *testing.T) {
+	var parseTests = []struct {
+		test        string
+		specs       []string
+		expected    []SessionTagMapping
+		expectError bool
+	}{
+		{
+			test:     "No mappings",
+			specs:    []string{},
+			expected: []SessionTagMapping{},
+		},
+		{
+			test:  "All sources",
+			specs: []string{"ns=namespace", "pod=pod-name", "sa=service-account", "team=label:team"},
+			expected: []SessionTagMapping{
+				{Key: "ns", Source: "namespace"},
+				{Key: "pod", Source: "pod-name"},
+				{Key: "sa", Source: "service-account"},
+				{Key: "team", Source: "label:team"},
+			},
+		},
+		{
+			test:        "Missing source",
+			specs:       []string{"ns"},
+			expectError: true,
+		},
+		{
+			test:        "Unknown source",
+			specs:       []string{"ns=node"},
+			expectError: true,
+		},
+		{
+			test:        "Empty label",
+			specs:       []string{"team=label:"},
+			expectError: true,
+		},
+		{
+			test:        "Duplicated key",
+			specs:       []string{"ns=namespace", "NS=pod-name"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range parseTests {
+		t.Run(tt.test, func(t *testing.T) {
+			resp, err := ParseSessionTagMappings(tt.specs)
+			if tt.expectError && err == nil {
+				t.Error("Expected error however didn't recieve one")
+				return
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Didn't expect error but recieved %s", err)
+				return
+			}
+			if !tt.expectError && !reflect.DeepEqual(resp, tt.expected) {
+				t.Errorf("Response [%+v] did not equal expected [%+v]", resp, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSessionTags(t *testing.T) {
+	tagMappings, err := ParseSessionTagMappings([]string{"ns=namespace", "pod=pod-name", "sa=service-account", "team=label:team", "tier=label:tier"})
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	rp := RoleMapper{sessionTagMappings: tagMappings}
+
+	pod := &v1.Pod{}
+	pod.Name = "web-1234"
+	pod.Namespace = "team-a"
+	pod.Labels = map[string]string{"team": "a"}
+	pod.Spec.ServiceAccountName = "web"
+
+	expected := map[string]string{"ns": "team-a", "pod": "web-1234", "sa": "web", "team": "a"}
+	if resp := rp.sessionTags(pod); !reflect.DeepEqual(resp, expected) {
+		t.Errorf("Response [%+v] did not equal expected [%+v]", resp, expected)
+	}
+}
@@ -1,12 +1,12 @@
 package metrics
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	log "github.com/sirupsen/logrus"
 
 	"github.com/jtblin/kube2iam/version"
 )
@@ -18,6 +18,16 @@ const (
 	IamSuccessCode = "Success"
 	// IamUnknownFailCode is the code used for metrics when an IAM request fails with an error not reported by AWS.
 	IamUnknownFailCode = "UnknownError"
+
+	// IamCacheEvictionExpired is the reason used for metrics when cached credentials are removed after expiring.
+	IamCacheEvictionExpired = "expired"
+	// IamCacheEvictionCapacity is the reason used for metrics when cached credentials are removed to make room for new ones.
+	IamCacheEvictionCapacity = "capacity"
+
+	// IamResultSuccess is the result used for metrics when credentials are renewed or prefetched.
+	IamResultSuccess = "success"
+	// IamResultFailure is the result used for metrics when credentials fail to be renewed or prefetched.
+	IamResultFailure = "failure"
 )
 
 var (
@@ -54,6 +64,102 @@ var (
 		},
 	)
 
+	// IamCacheEntries reports the number of credentials held by the IAM cache.
+	IamCacheEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "iam",
+			Name:      "cache_entries",
+			Help:      "Number of credentials held by the IAM cache.",
+		},
+	)
+
+	// IamCacheEvictionCount tracks total number of credentials removed from the IAM cache.
+	IamCacheEvictionCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "iam",
+			Name:      "cache_evictions_total",
+			Help:      "Total number of credentials removed from the IAM cache.",
+		},
+		[]string{
+			// Why the credentials were removed, expired or capacity
+			"reason",
+		},
+	)
+
+	// IamCacheRefreshCount tracks total number of background renewals of cached credentials.
+	IamCacheRefreshCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "iam",
+			Name:      "cache_refreshes_total",
+			Help:      "Total number of background renewals of cached credentials.",
+		},
+		[]string{
+			// Whether the credentials were renewed, success or failure
+			"result",
+		},
+	)
+
+	// IamPrefetchCount tracks total number of credentials prefetched when pods are scheduled on the node.
+	IamPrefetchCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "iam",
+			Name:      "prefetches_total",
+			Help:      "Total number of credentials prefetched for pods scheduled on the node.",
+		},
+		[]string{
+			// Whether the credentials were prefetched, success or failure
+			"result",
+		},
+	)
+
+	// IamPrefetchHitCount tracks total number of first requests for credentials served by a prefetch.
+	IamPrefetchHitCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "iam",
+			Name:      "prefetch_hits_total",
+			Help:      "Total number of first requests for credentials served from prefetched credentials.",
+		},
+		[]string{
+			// The arn of the IAM role being requested
+			"role_arn",
+		},
+	)
+
+	// NamespaceRestrictionViolationCount tracks total number of requests that namespace restrictions would deny in audit mode.
+	NamespaceRestrictionViolationCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "namespace_restrictions",
+			Name:      "violations_total",
+			Help:      "Total number of requests for roles that namespace restrictions would deny in audit mode.",
+		},
+		[]string{
+			// The namespace of the pod requesting the role
+			"namespace",
+			// The arn of the IAM role being requested
+			"role_arn",
+		},
+	)
+
+	// NamespaceRestrictionInvalidPatterns reports the number of invalid role patterns annotated on namespaces.
+	NamespaceRestrictionInvalidPatterns = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "namespace_restrictions",
+			Name:      "invalid_patterns",
+			Help:      "Number of invalid role patterns annotated on namespaces, they are ignored.",
+		},
+		[]string{
+			// The namespace holding the patterns
+			"namespace",
+		},
+	)
+
 	// K8sAPIDupReqCount tracks total number of K8s Api requests performed when duplicated pods are identified in the cache.
 	K8sAPIDupReqCount = prometheus.NewCounter(
 		prometheus.CounterOpts{
@@ -104,6 +210,32 @@ var (
 		},
 	)
 
+	// RateLimitedRequestCount tracks total number of requests refused for exceeding the rate limits.
+	RateLimitedRequestCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "rate_limited_requests_total",
+			Help:      "Total number of requests refused for exceeding the rate limits.",
+		},
+		[]string{
+			// The namespace of the pod sending the request, empty if the IP isn't indexed
+			"namespace",
+			// The limit exceeded, ip or global
+			"limit",
+		},
+	)
+
+	// IptablesRulesRestoredCount tracks total number of iptables rules found missing and restored.
+	IptablesRulesRestoredCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "iptables",
+			Name:      "rules_restored_total",
+			Help:      "Total number of iptables rules found missing and restored.",
+		},
+	)
+
 	// HealthcheckStatus reports the current healthcheck status of kube2iam.
 	HealthcheckStatus = prometheus.NewGauge(
 		prometheus.GaugeOpts{
@@ -135,30 +267,48 @@ var (
 func init() {
 	prometheus.MustRegister(IamRequestSec)
 	prometheus.MustRegister(IamCacheHitCount)
+	prometheus.MustRegister(IamCacheEntries)
+	prometheus.MustRegister(IamCacheEvictionCount)
+	prometheus.MustRegister(IamCacheRefreshCount)
+	prometheus.MustRegister(IamPrefetchCount)
+	prometheus.MustRegister(IamPrefetchHitCount)
+	prometheus.MustRegister(IptablesRulesRestoredCount)
+	prometheus.MustRegister(NamespaceRestrictionViolationCount)
+	prometheus.MustRegister(NamespaceRestrictionInvalidPatterns)
 	prometheus.MustRegister(K8sAPIDupReqCount)
 	prometheus.MustRegister(K8sAPIDupReqSuccesCount)
 	prometheus.MustRegister(PodNotFoundInCache)
 	prometheus.MustRegister(HTTPRequestSec)
+	prometheus.MustRegister(RateLimitedRequestCount)
 	prometheus.MustRegister(HealthcheckStatus)
 	prometheus.MustRegister(Info)
 
 	for _, val := range []string{IamSuccessCode, IamUnknownFailCode} {
 		IamRequestSec.WithLabelValues(val, "")
 	}
+	for _, val := range []string{IamCacheEvictionExpired, IamCacheEvictionCapacity} {
+		IamCacheEvictionCount.WithLabelValues(val)
+	}
+	for _, val := range []string{IamResultSuccess, IamResultFailure} {
+		IamCacheRefreshCount.WithLabelValues(val)
+		IamPrefetchCount.WithLabelValues(val)
+	}
 	Info.WithLabelValues(version.Version, version.BuildDate, version.GitCommit).Set(1)
 }
 
 // StartMetricsServer registers a prometheus /metrics handler and starts a HTTP server
-// listening on the provided port to service it.
-func StartMetricsServer(metricsPort string) {
+// listening on the provided port to service it, sending the error it fails with to errCh.
+func StartMetricsServer(metricsPort string, errCh chan<- error) *http.Server {
 	r := mux.NewRouter()
 	r.Handle("/metrics", GetHandler())
 
+	srv := &http.Server{Addr: ":" + metricsPort, Handler: r}
 	go func() {
-		if err := http.ListenAndServe(":"+metricsPort, r); err != nil {
-			log.Fatalf("Error creating metrics http server: %+v", err)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			errCh <- fmt.Errorf("error creating metrics http server: %+v", err)
 		}
 	}()
+	return srv
 }
 
 // GetHandler creates a prometheus HTTP handler that will serve metrics.
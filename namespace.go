@@ -3,14 +3,39 @@ package kube2iam
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/jtblin/kube2iam/metrics"
 )
 
-// NamespaceHandler outputs change events from K8.
+// NamespaceRoles holds the role patterns of a namespace compiled from its annotations.
+type NamespaceRoles struct {
+	// ResourceVersion is the version of the namespace the patterns were compiled from.
+	ResourceVersion string
+	Allowed         []*RolePattern
+	Denied          []*RolePattern
+	// Invalid lists the errors of the annotations or patterns that couldn't be compiled. Invalid allowed
+	// patterns are ignored.
+	Invalid []error
+	// DeniedInvalid lists the errors of the denied roles annotation, which fails closed: every role but the
+	// default role is denied in the namespace until the annotation is fixed.
+	DeniedInvalid []error
+}
+
+// NamespaceHandler compiles the role patterns of namespaces as they are added or updated in K8.
 type NamespaceHandler struct {
-	namespaceKey string
+	namespaceKey       string
+	namespaceDeniedKey string
+	format             string
+	normalize          func(string) string
+	recordWarning      WarningRecorder
+
+	mutex sync.RWMutex
+	roles map[string]*NamespaceRoles
 }
 
 func (h *NamespaceHandler) namespaceFields(ns *v1.Namespace) log.Fields {
@@ -30,9 +55,9 @@ func (h *NamespaceHandler) OnAdd(obj interface{}) {
 	logger := log.WithFields(h.namespaceFields(ns))
 	logger.Debug("Namespace OnAdd")
 
-	roles := GetNamespaceRoleAnnotation(ns, h.namespaceKey)
-	for _, role := range roles {
-		logger.WithField("ns.role", role).Info("Discovered role on namespace (OnAdd)")
+	roles := h.update(ns, logger)
+	for _, pattern := range roles.Allowed {
+		logger.WithField("ns.role", pattern.Pattern).Info("Discovered role on namespace (OnAdd)")
 	}
 }
 
@@ -46,35 +71,139 @@ func (h *NamespaceHandler) OnUpdate(oldObj, newObj interface{}) {
 	logger := log.WithFields(h.namespaceFields(nns))
 	logger.Debug("Namespace OnUpdate")
 
-	roles := GetNamespaceRoleAnnotation(nns, h.namespaceKey)
+	// Resyncs deliver unchanged namespaces, their patterns are already compiled and reported
+	if h.cached(nns) != nil {
+		return
+	}
 
-	for _, role := range roles {
-		logger.WithField("ns.role", role).Info("Discovered role on namespace (OnUpdate)")
+	roles := h.update(nns, logger)
+	for _, pattern := range roles.Allowed {
+		logger.WithField("ns.role", pattern.Pattern).Info("Discovered role on namespace (OnUpdate)")
 	}
 }
 
 // OnDelete called with a namespace is removed from k8s.
 func (h *NamespaceHandler) OnDelete(obj interface{}) {
 	ns, ok := obj.(*v1.Namespace)
+	if !ok {
+		deletedObj, dok := obj.(cache.DeletedFinalStateUnknown)
+		if dok {
+			ns, ok = deletedObj.Obj.(*v1.Namespace)
+		}
+	}
+
 	if !ok {
 		log.Errorf("Expected Namespace but OnDelete handler received %+v", obj)
 		return
 	}
 	log.WithFields(h.namespaceFields(ns)).Info("Deleting namespace (OnDelete)")
+
+	h.mutex.Lock()
+	delete(h.roles, ns.GetName())
+	h.mutex.Unlock()
+	metrics.NamespaceRestrictionInvalidPatterns.DeleteLabelValues(ns.GetName())
+}
+
+// update compiles and caches the role patterns of a namespace, reporting the invalid ones. A warning event is
+// recorded on the namespace once per version, informers deliver the same version again when they relist.
+func (h *NamespaceHandler) update(ns *v1.Namespace, logger *log.Entry) *NamespaceRoles {
+	roles := h.compile(ns)
+	for _, err := range roles.Invalid {
+		logger.Errorf("Ignoring invalid role pattern: %s", err)
+	}
+	for _, err := range roles.DeniedInvalid {
+		logger.Errorf("Denying every role but the default role until the denied role pattern is fixed: %s", err)
+	}
+	metrics.NamespaceRestrictionInvalidPatterns.WithLabelValues(ns.GetName()).Set(float64(len(roles.Invalid)))
+	if h.recordWarning != nil && h.cached(ns) == nil {
+		switch {
+		case len(roles.DeniedInvalid) > 0:
+			h.recordWarning(ns, EventReasonInvalidRolePattern, "Denying every role but the default role until the invalid role patterns are fixed: %s", joinErrors(roles.Invalid))
+		case len(roles.Invalid) > 0:
+			h.recordWarning(ns, EventReasonInvalidRolePattern, "Ignoring invalid role patterns: %s", joinErrors(roles.Invalid))
+		}
+	}
+
+	h.mutex.Lock()
+	h.roles[ns.GetName()] = roles
+	h.mutex.Unlock()
+	return roles
+}
+
+// cached returns the compiled role patterns of the namespace if they are up to date.
+func (h *NamespaceHandler) cached(ns *v1.Namespace) *NamespaceRoles {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	roles, ok := h.roles[ns.GetName()]
+	if !ok || roles.ResourceVersion != ns.GetResourceVersion() {
+		return nil
+	}
+	return roles
+}
+
+func (h *NamespaceHandler) compile(ns *v1.Namespace) *NamespaceRoles {
+	roles := &NamespaceRoles{ResourceVersion: ns.GetResourceVersion()}
+	roles.Allowed, roles.Invalid = h.compileAnnotation(ns, h.namespaceKey)
+	if h.namespaceDeniedKey != "" {
+		roles.Denied, roles.DeniedInvalid = h.compileAnnotation(ns, h.namespaceDeniedKey)
+		roles.Invalid = append(roles.Invalid, roles.DeniedInvalid...)
+	}
+	return roles
+}
+
+// compileAnnotation returns the patterns of the annotation key that compiled along with the errors of the others.
+func (h *NamespaceHandler) compileAnnotation(ns *v1.Namespace, key string) ([]*RolePattern, []error) {
+	patterns, err := decodeNamespaceRoleAnnotation(ns, key)
+	if err != nil {
+		return nil, []error{fmt.Errorf("unable to decode annotation %s: %v", key, err)}
+	}
+
+	var invalid []error
+	compiled := make([]*RolePattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		p, err := CompileRolePattern(pattern, h.format, h.normalize)
+		if err != nil {
+			invalid = append(invalid, fmt.Errorf("pattern %s of annotation %s: %v", pattern, key, err))
+			continue
+		}
+		compiled = append(compiled, p)
+	}
+	return compiled, invalid
+}
+
+// SetWarningRecorder sets the recorder of the warning events of namespaces declaring invalid role patterns,
+// it must be called before the handler receives namespaces.
+func (h *NamespaceHandler) SetWarningRecorder(recordWarning WarningRecorder) {
+	h.recordWarning = recordWarning
+}
+
+// RolesByNamespace returns the compiled role patterns of a namespace. The patterns are compiled on the fly
+// when the handler hasn't received the current version of the namespace yet.
+func (h *NamespaceHandler) RolesByNamespace(ns *v1.Namespace) *NamespaceRoles {
+	if roles := h.cached(ns); roles != nil {
+		return roles
+	}
+	return h.compile(ns)
 }
 
 // GetNamespaceRoleAnnotation reads the "iam.amazonaws.com/allowed-roles" annotation off a namespace
 // and splits them as a JSON list (["role1", "role2", "role3"])
 func GetNamespaceRoleAnnotation(ns *v1.Namespace, namespaceKey string) []string {
+	decoded, err := decodeNamespaceRoleAnnotation(ns, namespaceKey)
+	if err != nil {
+		log.Errorf("Unable to decode roles on namespace %s ( role annotation is '%s' ) with error: %s", ns.Name, ns.GetAnnotations()[namespaceKey], err)
+	}
+	return decoded
+}
+
+func decodeNamespaceRoleAnnotation(ns *v1.Namespace, namespaceKey string) ([]string, error) {
 	rolesString := ns.GetAnnotations()[namespaceKey]
-	if rolesString != "" {
-		var decoded []string
-		if err := json.Unmarshal([]byte(rolesString), &decoded); err != nil {
-			log.Errorf("Unable to decode roles on namespace %s ( role annotation is '%s' ) with error: %s", ns.Name, rolesString, err)
-		}
-		return decoded
+	if rolesString == "" {
+		return nil, nil
 	}
-	return nil
+	var decoded []string
+	err := json.Unmarshal([]byte(rolesString), &decoded)
+	return decoded, err
 }
 
 // NamespaceIndexFunc maps a namespace to it's name.
@@ -87,9 +216,14 @@ func NamespaceIndexFunc(obj interface{}) ([]string, error) {
 	return []string{namespace.GetName()}, nil
 }
 
-// NewNamespaceHandler returns a new namespace handler.
-func NewNamespaceHandler(namespaceKey string) *NamespaceHandler {
+// NewNamespaceHandler returns a new namespace handler compiling the patterns of the allowed and denied
+// roles annotations in format, normalized to full ARNs by normalize.
+func NewNamespaceHandler(namespaceKey, namespaceDeniedKey, format string, normalize func(string) string) *NamespaceHandler {
 	return &NamespaceHandler{
-		namespaceKey: namespaceKey,
+		namespaceKey:       namespaceKey,
+		namespaceDeniedKey: namespaceDeniedKey,
+		format:             format,
+		normalize:          normalize,
+		roles:              make(map[string]*NamespaceRoles),
 	}
 }
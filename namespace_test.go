@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 func TestGetNamespaceRoleAnnotation(t *testing.T) {
@@ -46,3 +47,71 @@ func TestGetNamespaceRoleAnnotation(t *testing.T) {
 		})
 	}
 }
+
+func TestNamespaceHandler(t *testing.T) {
+	h := NewNamespaceHandler("namespaceKey", "namespaceDeniedKey", "regexp", normalizeRole)
+
+	ns := &v1.Namespace{}
+	ns.Name = "default"
+	ns.ResourceVersion = "1"
+	ns.Annotations = map[string]string{
+		"namespaceKey":       `["team-a-.*", "team-(b"]`,
+		"namespaceDeniedKey": "not json",
+	}
+	events := 0
+	h.SetWarningRecorder(func(obj runtime.Object, reason, messageFmt string, args ...interface{}) {
+		if reason != EventReasonInvalidRolePattern {
+			t.Errorf("Expected reason [%s] but received [%s]", EventReasonInvalidRolePattern, reason)
+		}
+		events++
+	})
+	h.OnAdd(ns)
+
+	roles := h.RolesByNamespace(ns)
+	if len(roles.Allowed) != 1 || roles.Allowed[0].Pattern != "team-a-.*" {
+		t.Errorf("Expected allowed patterns [team-a-.*] but received %+v", roles.Allowed)
+	}
+	if len(roles.Denied) != 0 {
+		t.Errorf("Expected no denied patterns but received %+v", roles.Denied)
+	}
+	if len(roles.Invalid) != 2 {
+		t.Errorf("Expected 2 invalid patterns but received %+v", roles.Invalid)
+	}
+	if len(roles.DeniedInvalid) != 1 {
+		t.Errorf("Expected the denied annotation to be invalid but received %+v", roles.DeniedInvalid)
+	}
+
+	// A resync delivers the same version, the compiled patterns are kept
+	h.OnUpdate(ns, ns)
+	if h.RolesByNamespace(ns) != roles {
+		t.Error("Expected the compiled patterns to be kept on resync")
+	}
+
+	// A relist adds the same version again, the invalid patterns were already reported
+	h.OnAdd(ns)
+	if events != 1 {
+		t.Errorf("Expected 1 event for the invalid patterns but received %d", events)
+	}
+
+	updated := ns.DeepCopy()
+	updated.ResourceVersion = "2"
+	updated.Annotations = map[string]string{"namespaceKey": `["team-b-.*"]`}
+
+	// Versions not yet delivered to the handler are compiled on the fly
+	if roles := h.RolesByNamespace(updated); len(roles.Allowed) != 1 || roles.Allowed[0].Pattern != "team-b-.*" {
+		t.Errorf("Expected allowed patterns [team-b-.*] but received %+v", roles.Allowed)
+	}
+
+	h.OnUpdate(ns, updated)
+	if h.cached(updated) == nil {
+		t.Error("Expected the updated namespace patterns to be cached")
+	}
+	if events != 1 {
+		t.Errorf("Expected no event for the valid patterns but received %d", events-1)
+	}
+
+	h.OnDelete(updated)
+	if h.cached(updated) != nil {
+		t.Error("Expected the deleted namespace patterns to be removed")
+	}
+}
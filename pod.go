@@ -2,15 +2,22 @@ package kube2iam
 
 import (
 	"fmt"
+	"reflect"
 
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
+// CredentialsPrefetcher obtains the credentials of a pod ahead of its first request.
+type CredentialsPrefetcher interface {
+	Prefetch(pod *v1.Pod)
+}
+
 // PodHandler represents a pod handler.
 type PodHandler struct {
 	iamRoleKey string
+	prefetcher CredentialsPrefetcher
 }
 
 func (p *PodHandler) podFields(pod *v1.Pod) log.Fields {
@@ -36,11 +43,15 @@ func (p *PodHandler) OnAdd(obj interface{}) {
 	// of cronjobs that stick around in Completed/Succeeded status
 	logger := log.WithFields(p.podFields(pod))
 	logger.Debug("Pod OnAdd")
+
+	if p.prefetcher != nil && isPodActive(pod) {
+		p.prefetcher.Prefetch(pod)
+	}
 }
 
 // OnUpdate is called when a pod is modified.
 func (p *PodHandler) OnUpdate(oldObj, newObj interface{}) {
-	_, ok1 := oldObj.(*v1.Pod)
+	oldPod, ok1 := oldObj.(*v1.Pod)
 	newPod, ok2 := newObj.(*v1.Pod)
 	if !ok1 || !ok2 {
 		log.Errorf("Expected Pod but OnUpdate handler received %+v %+v", oldObj, newObj)
@@ -49,6 +60,11 @@ func (p *PodHandler) OnUpdate(oldObj, newObj interface{}) {
 
 	logger := log.WithFields(p.podFields(newPod))
 	logger.Debug("Pod OnUpdate")
+
+	// Only prefetch when the pod gets its IPs, not on every status update or resync
+	if p.prefetcher != nil && isPodActive(newPod) && !reflect.DeepEqual(PodIPs(oldPod), PodIPs(newPod)) {
+		p.prefetcher.Prefetch(newPod)
+	}
 }
 
 // OnDelete is called when a pod is deleted.
@@ -76,19 +92,34 @@ func isPodActive(p *v1.Pod) bool {
 		v1.PodFailed != p.Status.Phase
 }
 
-// PodIPIndexFunc maps a given Pod to it's IP for caching.
+// PodIPIndexFunc maps a given Pod to it's IPs for caching.
 func PodIPIndexFunc(obj interface{}) ([]string, error) {
 	pod, ok := obj.(*v1.Pod)
 	if !ok {
 		return nil, fmt.Errorf("obj not pod: %+v", obj)
 	}
-	if isPodActive(pod) {
-		return []string{pod.Status.PodIP}, nil
+	if !isPodActive(pod) {
+		return nil, nil
+	}
+	return PodIPs(pod), nil
+}
+
+// PodIPs returns the IPs of a pod. Dual-stack pods have an IP per family, PodIP is the first of them.
+func PodIPs(pod *v1.Pod) []string {
+	if pod.Status.PodIP == "" {
+		return nil
+	}
+	IPs := []string{pod.Status.PodIP}
+	for _, podIP := range pod.Status.PodIPs {
+		if podIP.IP != "" && podIP.IP != pod.Status.PodIP {
+			IPs = append(IPs, podIP.IP)
+		}
 	}
-	return nil, nil
+	return IPs
 }
 
-// NewPodHandler constructs a pod handler given the relevant IAM Role Key
-func NewPodHandler(iamRoleKey string) *PodHandler {
-	return &PodHandler{iamRoleKey: iamRoleKey}
+// NewPodHandler constructs a pod handler given the relevant IAM Role Key, prefetching
+// the credentials of pods getting an IP when prefetcher is not nil
+func NewPodHandler(iamRoleKey string, prefetcher CredentialsPrefetcher) *PodHandler {
+	return &PodHandler{iamRoleKey: iamRoleKey, prefetcher: prefetcher}
 }
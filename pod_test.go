@@ -0,0 +1,146 @@
+package kube2iam
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestPodIPIndexFunc(t *testing.T) {
+	var indexTests = []struct {
+		test     string
+		phase    v1.PodPhase
+		podIP    string
+		podIPs   []string
+		expected []string
+	}{
+		{
+			test:     "No IP",
+			phase:    v1.PodPending,
+			expected: nil,
+		},
+		{
+			test:     "Single stack",
+			phase:    v1.PodRunning,
+			podIP:    "10.0.0.1",
+			podIPs:   []string{"10.0.0.1"},
+			expected: []string{"10.0.0.1"},
+		},
+		{
+			test:     "Dual stack",
+			phase:    v1.PodRunning,
+			podIP:    "10.0.0.1",
+			podIPs:   []string{"10.0.0.1", "2600:1f14::1"},
+			expected: []string{"10.0.0.1", "2600:1f14::1"},
+		},
+		{
+			test:     "Completed",
+			phase:    v1.PodSucceeded,
+			podIP:    "10.0.0.1",
+			podIPs:   []string{"10.0.0.1", "2600:1f14::1"},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range indexTests {
+		t.Run(tt.test, func(t *testing.T) {
+			pod := &v1.Pod{}
+			pod.Status.Phase = tt.phase
+			pod.Status.PodIP = tt.podIP
+			for _, ip := range tt.podIPs {
+				pod.Status.PodIPs = append(pod.Status.PodIPs, v1.PodIP{IP: ip})
+			}
+
+			resp, err := PodIPIndexFunc(pod)
+			if err != nil {
+				t.Errorf("Didn't expect error but recieved %s", err)
+				return
+			}
+			if !reflect.DeepEqual(resp, tt.expected) {
+				t.Errorf("Response [%v] did not equal expected [%v]", resp, tt.expected)
+			}
+		})
+	}
+}
+
+type prefetcherMock struct {
+	pods []string
+}
+
+func (p *prefetcherMock) Prefetch(pod *v1.Pod) {
+	p.pods = append(p.pods, pod.GetName())
+}
+
+func TestPodHandlerPrefetch(t *testing.T) {
+	newPod := func(phase v1.PodPhase, IPs ...string) *v1.Pod {
+		pod := &v1.Pod{}
+		pod.Name = "web"
+		pod.Status.Phase = phase
+		if len(IPs) > 0 {
+			pod.Status.PodIP = IPs[0]
+		}
+		for _, ip := range IPs {
+			pod.Status.PodIPs = append(pod.Status.PodIPs, v1.PodIP{IP: ip})
+		}
+		return pod
+	}
+
+	var prefetchTests = []struct {
+		test     string
+		oldPod   *v1.Pod
+		newPod   *v1.Pod
+		expected bool
+	}{
+		{
+			test:     "Add running pod",
+			newPod:   newPod(v1.PodRunning, "10.0.0.1"),
+			expected: true,
+		},
+		{
+			test:   "Add pending pod without IP",
+			newPod: newPod(v1.PodPending),
+		},
+		{
+			test:   "Add completed pod",
+			newPod: newPod(v1.PodSucceeded, "10.0.0.1"),
+		},
+		{
+			test:     "Update pod getting its IP",
+			oldPod:   newPod(v1.PodPending),
+			newPod:   newPod(v1.PodRunning, "10.0.0.1"),
+			expected: true,
+		},
+		{
+			test:   "Update pod keeping its IP",
+			oldPod: newPod(v1.PodRunning, "10.0.0.1"),
+			newPod: newPod(v1.PodRunning, "10.0.0.1"),
+		},
+		{
+			test:     "Update pod getting its IPv6 IP",
+			oldPod:   newPod(v1.PodRunning, "10.0.0.1"),
+			newPod:   newPod(v1.PodRunning, "10.0.0.1", "2600:1f14::1"),
+			expected: true,
+		},
+		{
+			test:   "Update pod completing",
+			oldPod: newPod(v1.PodRunning, "10.0.0.1"),
+			newPod: newPod(v1.PodSucceeded, "10.0.0.1"),
+		},
+	}
+
+	for _, tt := range prefetchTests {
+		t.Run(tt.test, func(t *testing.T) {
+			prefetcher := &prefetcherMock{}
+			handler := NewPodHandler("iam.amazonaws.com/role", prefetcher)
+			if tt.oldPod == nil {
+				handler.OnAdd(tt.newPod)
+			} else {
+				handler.OnUpdate(tt.oldPod, tt.newPod)
+			}
+			if prefetched := len(prefetcher.pods) == 1; prefetched != tt.expected {
+				t.Errorf("Expected prefetch [%t] for test but recieved [%v]", tt.expected, prefetcher.pods)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package kube2iam
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+)
+
+// IAMRoleBindingResource is the resource of the IAMRoleBinding custom resource definition.
+var IAMRoleBindingResource = schema.GroupVersionResource{
+	Group:    "kube2iam.io",
+	Version:  "v1alpha1",
+	Resource: "iamrolebindings",
+}
+
+// IAMRoleBinding grants the pods matched by its selector in the binding's namespace
+// the right to assume the listed roles.
+type IAMRoleBinding struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IAMRoleBindingSpec `json:"spec"`
+}
+
+// IAMRoleBindingSpec is the specification of an IAMRoleBinding.
+type IAMRoleBindingSpec struct {
+	// PodSelector selects the pods of the namespace the binding applies to, an empty selector matches all pods.
+	PodSelector metav1.LabelSelector `json:"podSelector"`
+	// Roles lists the role patterns the pods are allowed to assume, following the namespace restriction format.
+	Roles []string `json:"roles"`
+	// ExternalID is passed when assuming any of the roles granted by the binding.
+	ExternalID string `json:"externalID,omitempty"`
+}
+
+// IAMRoleBindingList is a list of IAMRoleBinding.
+type IAMRoleBindingList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []IAMRoleBinding `json:"items"`
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *IAMRoleBinding) DeepCopyInto(out *IAMRoleBinding) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.PodSelector.DeepCopyInto(&out.Spec.PodSelector)
+	if in.Spec.Roles != nil {
+		out.Spec.Roles = make([]string, len(in.Spec.Roles))
+		copy(out.Spec.Roles, in.Spec.Roles)
+	}
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *IAMRoleBinding) DeepCopyObject() runtime.Object {
+	out := &IAMRoleBinding{}
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *IAMRoleBindingList) DeepCopyObject() runtime.Object {
+	out := &IAMRoleBindingList{TypeMeta: in.TypeMeta}
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]IAMRoleBinding, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+	return out
+}
+
+// IAMRoleBindingFromUnstructured converts an object received from the dynamic client to an IAMRoleBinding.
+func IAMRoleBindingFromUnstructured(u *unstructured.Unstructured) (*IAMRoleBinding, error) {
+	rb := &IAMRoleBinding{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), rb); err != nil {
+		return nil, err
+	}
+	return rb, nil
+}
+
+// IAMRoleBindingListFromUnstructured converts a list received from the dynamic client to an IAMRoleBindingList.
+func IAMRoleBindingListFromUnstructured(u *unstructured.UnstructuredList) (*IAMRoleBindingList, error) {
+	list := &IAMRoleBindingList{Items: make([]IAMRoleBinding, 0, len(u.Items))}
+	list.SetResourceVersion(u.GetResourceVersion())
+	list.SetContinue(u.GetContinue())
+	for i := range u.Items {
+		rb, err := IAMRoleBindingFromUnstructured(&u.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items, *rb)
+	}
+	return list, nil
+}
+
+// RoleBindingRoles holds the role patterns of an IAMRoleBinding compiled from its spec.
+type RoleBindingRoles struct {
+	// ResourceVersion is the version of the binding the patterns were compiled from.
+	ResourceVersion string
+	// Roles are the compiled patterns of the roles of the binding, in order. Patterns that can't be compiled
+	// grant no role and are left out.
+	Roles []*RolePattern
+	// Invalid lists the errors of the patterns that couldn't be compiled.
+	Invalid []error
+}
+
+// RoleBindingHandler compiles the role patterns of IAMRoleBindings as they are added or updated in K8.
+type RoleBindingHandler struct {
+	format        string
+	normalize     func(string) string
+	recordWarning WarningRecorder
+
+	mutex sync.RWMutex
+	roles map[string]*RoleBindingRoles
+}
+
+func (h *RoleBindingHandler) roleBindingFields(rb *IAMRoleBinding) log.Fields {
+	return log.Fields{
+		"rb.name":      rb.GetName(),
+		"rb.namespace": rb.GetNamespace(),
+	}
+}
+
+// OnAdd is called when an IAMRoleBinding is added.
+func (h *RoleBindingHandler) OnAdd(obj interface{}) {
+	rb, ok := obj.(*IAMRoleBinding)
+	if !ok {
+		log.Errorf("Expected IAMRoleBinding but OnAdd handler received %+v", obj)
+		return
+	}
+
+	logger := log.WithFields(h.roleBindingFields(rb))
+	roles := h.update(rb, logger)
+	for _, pattern := range roles.Roles {
+		logger.WithField("rb.role", pattern.Pattern).Info("Discovered role on IAMRoleBinding (OnAdd)")
+	}
+}
+
+// OnUpdate is called when an IAMRoleBinding is modified.
+func (h *RoleBindingHandler) OnUpdate(oldObj, newObj interface{}) {
+	rb, ok := newObj.(*IAMRoleBinding)
+	if !ok {
+		log.Errorf("Expected IAMRoleBinding but OnUpdate handler received %+v %+v", oldObj, newObj)
+		return
+	}
+
+	// Resyncs deliver unchanged bindings, their patterns are already compiled and reported
+	if h.cached(rb) != nil {
+		return
+	}
+
+	logger := log.WithFields(h.roleBindingFields(rb))
+	roles := h.update(rb, logger)
+	for _, pattern := range roles.Roles {
+		logger.WithField("rb.role", pattern.Pattern).Info("Discovered role on IAMRoleBinding (OnUpdate)")
+	}
+}
+
+// OnDelete is called when an IAMRoleBinding is deleted.
+func (h *RoleBindingHandler) OnDelete(obj interface{}) {
+	rb, ok := obj.(*IAMRoleBinding)
+	if !ok {
+		deletedObj, dok := obj.(cache.DeletedFinalStateUnknown)
+		if dok {
+			rb, ok = deletedObj.Obj.(*IAMRoleBinding)
+		}
+	}
+
+	if !ok {
+		log.Errorf("Expected IAMRoleBinding but OnDelete handler received %+v", obj)
+		return
+	}
+	log.WithFields(h.roleBindingFields(rb)).Info("Deleting IAMRoleBinding (OnDelete)")
+
+	h.mutex.Lock()
+	delete(h.roles, roleBindingKey(rb))
+	h.mutex.Unlock()
+}
+
+// update compiles and caches the role patterns of a binding, reporting the invalid ones. A warning event is
+// recorded on the binding once per version, informers deliver the same version again when they relist.
+func (h *RoleBindingHandler) update(rb *IAMRoleBinding, logger *log.Entry) *RoleBindingRoles {
+	roles := h.compile(rb)
+	for _, err := range roles.Invalid {
+		logger.Errorf("Ignoring invalid role pattern: %s", err)
+	}
+	if h.recordWarning != nil && len(roles.Invalid) > 0 && h.cached(rb) == nil {
+		h.recordWarning(rb, EventReasonInvalidRolePattern, "Ignoring invalid role patterns: %s", joinErrors(roles.Invalid))
+	}
+
+	h.mutex.Lock()
+	h.roles[roleBindingKey(rb)] = roles
+	h.mutex.Unlock()
+	return roles
+}
+
+// cached returns the compiled role patterns of the binding if they are up to date.
+func (h *RoleBindingHandler) cached(rb *IAMRoleBinding) *RoleBindingRoles {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	roles, ok := h.roles[roleBindingKey(rb)]
+	if !ok || roles.ResourceVersion != rb.GetResourceVersion() {
+		return nil
+	}
+	return roles
+}
+
+func (h *RoleBindingHandler) compile(rb *IAMRoleBinding) *RoleBindingRoles {
+	roles := &RoleBindingRoles{ResourceVersion: rb.GetResourceVersion()}
+	for _, pattern := range rb.Spec.Roles {
+		p, err := CompileRolePattern(pattern, h.format, h.normalize)
+		if err != nil {
+			roles.Invalid = append(roles.Invalid, fmt.Errorf("pattern %s: %v", pattern, err))
+			continue
+		}
+		roles.Roles = append(roles.Roles, p)
+	}
+	return roles
+}
+
+// SetWarningRecorder sets the recorder of the warning events of bindings declaring invalid role patterns, it
+// must be called before the handler receives bindings.
+func (h *RoleBindingHandler) SetWarningRecorder(recordWarning WarningRecorder) {
+	h.recordWarning = recordWarning
+}
+
+// RolesByRoleBinding returns the compiled role patterns of a binding. The patterns are compiled on the fly
+// when the handler hasn't received the current version of the binding yet.
+func (h *RoleBindingHandler) RolesByRoleBinding(rb *IAMRoleBinding) *RoleBindingRoles {
+	if roles := h.cached(rb); roles != nil {
+		return roles
+	}
+	return h.compile(rb)
+}
+
+func roleBindingKey(rb *IAMRoleBinding) string {
+	return rb.GetNamespace() + "/" + rb.GetName()
+}
+
+// NewRoleBindingHandler returns a new IAMRoleBinding handler compiling the role patterns of the bindings
+// in format, normalized to full ARNs by normalize.
+func NewRoleBindingHandler(format string, normalize func(string) string) *RoleBindingHandler {
+	return &RoleBindingHandler{
+		format:    format,
+		normalize: normalize,
+		roles:     make(map[string]*RoleBindingRoles),
+	}
+}
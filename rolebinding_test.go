@@ -0,0 +1,109 @@
+package kube2iam
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestIAMRoleBindingFromUnstructured(t *testing.T) {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kube2iam.io/v1alpha1",
+		"kind":       "IAMRoleBinding",
+		"metadata": map[string]interface{}{
+			"name":      "web",
+			"namespace": "default",
+		},
+		"spec": map[string]interface{}{
+			"podSelector": map[string]interface{}{
+				"matchLabels": map[string]interface{}{"app": "web"},
+			},
+			"roles":      []interface{}{"web-*", "shared-role"},
+			"externalID": "external-id",
+		},
+	}}
+
+	rb, err := IAMRoleBindingFromUnstructured(u)
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	if rb.GetName() != "web" || rb.GetNamespace() != "default" {
+		t.Errorf("Expected default/web but received %s/%s", rb.GetNamespace(), rb.GetName())
+	}
+	if len(rb.Spec.Roles) != 2 {
+		t.Errorf("Expected roles length of [2] but received [%d]", len(rb.Spec.Roles))
+	}
+	if rb.Spec.PodSelector.MatchLabels["app"] != "web" {
+		t.Errorf("Expected pod selector app=web but received %+v", rb.Spec.PodSelector)
+	}
+	if rb.Spec.ExternalID != "external-id" {
+		t.Errorf("Expected external ID [external-id] but received [%s]", rb.Spec.ExternalID)
+	}
+
+	copied := rb.DeepCopyObject().(*IAMRoleBinding)
+	copied.Spec.Roles[0] = "changed"
+	if rb.Spec.Roles[0] != "web-*" {
+		t.Error("Expected DeepCopyObject to copy roles")
+	}
+}
+
+func TestRoleBindingHandler(t *testing.T) {
+	h := NewRoleBindingHandler("regexp", normalizeRole)
+
+	rb := &IAMRoleBinding{}
+	rb.Name = "web"
+	rb.Namespace = "default"
+	rb.ResourceVersion = "1"
+	rb.Spec.Roles = []string{"web-.*", "team-(b"}
+	events := 0
+	h.SetWarningRecorder(func(obj runtime.Object, reason, messageFmt string, args ...interface{}) {
+		if reason != EventReasonInvalidRolePattern {
+			t.Errorf("Expected reason [%s] but received [%s]", EventReasonInvalidRolePattern, reason)
+		}
+		events++
+	})
+	h.OnAdd(rb)
+
+	roles := h.RolesByRoleBinding(rb)
+	if len(roles.Roles) != 1 || roles.Roles[0].Pattern != "web-.*" {
+		t.Errorf("Expected role patterns [web-.*] but received %+v", roles.Roles)
+	}
+	if len(roles.Invalid) != 1 {
+		t.Errorf("Expected 1 invalid pattern but received %+v", roles.Invalid)
+	}
+
+	// A resync delivers the same version, the compiled patterns are kept
+	h.OnUpdate(rb, rb)
+	if h.RolesByRoleBinding(rb) != roles {
+		t.Error("Expected the compiled patterns to be kept on resync")
+	}
+
+	// A relist adds the same version again, the invalid patterns were already reported
+	h.OnAdd(rb)
+	if events != 1 {
+		t.Errorf("Expected 1 event for the invalid patterns but received %d", events)
+	}
+
+	updated := rb.DeepCopyObject().(*IAMRoleBinding)
+	updated.ResourceVersion = "2"
+	updated.Spec.Roles = []string{"worker-.*"}
+
+	// Versions not yet delivered to the handler are compiled on the fly
+	if roles := h.RolesByRoleBinding(updated); len(roles.Roles) != 1 || roles.Roles[0].Pattern != "worker-.*" {
+		t.Errorf("Expected role patterns [worker-.*] but received %+v", roles.Roles)
+	}
+
+	h.OnUpdate(rb, updated)
+	if h.cached(updated) == nil {
+		t.Error("Expected the updated binding patterns to be cached")
+	}
+	if events != 1 {
+		t.Errorf("Expected no event for the valid patterns but received %d", events-1)
+	}
+
+	h.OnDelete(updated)
+	if h.cached(updated) != nil {
+		t.Error("Expected the deleted binding patterns to be removed")
+	}
+}
@@ -0,0 +1,55 @@
+package kube2iam
+
+import (
+	"regexp"
+	"strings"
+
+	glob "github.com/ryanuber/go-glob"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// EventReasonInvalidRolePattern is the reason of the events recorded on the namespaces and IAMRoleBindings
+// declaring role patterns that can't be compiled.
+const EventReasonInvalidRolePattern = "InvalidRolePattern"
+
+// WarningRecorder records a warning event on a Kubernetes object.
+type WarningRecorder func(obj runtime.Object, reason, messageFmt string, args ...interface{})
+
+// RolePattern is a role pattern compiled according to the namespace restriction format.
+type RolePattern struct {
+	// Pattern is the pattern as written in the annotation.
+	Pattern    string
+	normalized string
+	re         *regexp.Regexp
+}
+
+// CompileRolePattern compiles a role pattern normalized to a full ARN by normalize, as a regexp
+// when format is regexp and as a glob otherwise.
+func CompileRolePattern(pattern, format string, normalize func(string) string) (*RolePattern, error) {
+	p := &RolePattern{Pattern: pattern, normalized: normalize(pattern)}
+	if strings.ToLower(format) == "regexp" {
+		re, err := regexp.Compile(p.normalized)
+		if err != nil {
+			return nil, err
+		}
+		p.re = re
+	}
+	return p, nil
+}
+
+// Match returns whether the role ARN matches the pattern.
+func (p *RolePattern) Match(roleARN string) bool {
+	if p.re != nil {
+		return p.re.MatchString(roleARN)
+	}
+	return glob.Glob(p.normalized, roleARN)
+}
+
+// joinErrors returns the messages of errs separated by semicolons.
+func joinErrors(errs []error) string {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,74 @@
+package kube2iam
+
+import (
+	"strings"
+	"testing"
+)
+
+func normalizeRole(role string) string {
+	if strings.HasPrefix(role, "arn:") {
+		return role
+	}
+	return "arn:aws:iam::123456789012:role/" + role
+}
+
+func TestRolePatternMatch(t *testing.T) {
+	var matchTests = []struct {
+		test           string
+		pattern        string
+		format         string
+		roleARN        string
+		expectError    bool
+		expectedResult bool
+	}{
+		{
+			test:           "Glob match",
+			pattern:        "team-a-*",
+			format:         "glob",
+			roleARN:        "arn:aws:iam::123456789012:role/team-a-reader",
+			expectedResult: true,
+		},
+		{
+			test:           "Glob no match",
+			pattern:        "team-a-*",
+			format:         "glob",
+			roleARN:        "arn:aws:iam::123456789012:role/team-b-reader",
+			expectedResult: false,
+		},
+		{
+			test:           "Full ARN pattern is not normalized",
+			pattern:        "arn:aws:iam::999999999999:role/*",
+			format:         "glob",
+			roleARN:        "arn:aws:iam::999999999999:role/team-a-reader",
+			expectedResult: true,
+		},
+		{
+			test:           "Regexp match",
+			pattern:        "team-(a|b)-.*",
+			format:         "RegExp",
+			roleARN:        "arn:aws:iam::123456789012:role/team-b-reader",
+			expectedResult: true,
+		},
+		{
+			test:        "Invalid regexp",
+			pattern:     "team-(a",
+			format:      "regexp",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range matchTests {
+		t.Run(tt.test, func(t *testing.T) {
+			p, err := CompileRolePattern(tt.pattern, tt.format, normalizeRole)
+			if tt.expectError != (err != nil) {
+				t.Fatalf("Expected error [%t] but recieved [%v]", tt.expectError, err)
+			}
+			if err != nil {
+				return
+			}
+			if resp := p.Match(tt.roleARN); resp != tt.expectedResult {
+				t.Errorf("Expected [%t] for test but recieved [%t]", tt.expectedResult, resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// ContainerCredentials represents the credentials response of the ECS container credentials endpoint,
+// as read by the AWS SDKs when AWS_CONTAINER_CREDENTIALS_FULL_URI is set.
+type ContainerCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	Expiration      string
+	RoleArn         string
+	SecretAccessKey string
+	Token           string
+}
+
+func (s *Server) containerCredentialsHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+	remoteIP := parseRemoteAddr(r.RemoteAddr)
+
+	// The SDKs send the value of AWS_CONTAINER_AUTHORIZATION_TOKEN as is in the Authorization header
+	if s.ContainerCredentialsToken != "" &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(s.ContainerCredentialsToken)) != 1 {
+		logger.Warn("Missing or invalid authorization token")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	roleMapping, externalID, pod, err := s.getRoleMapping(remoteIP)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	roleLogger := logger.WithFields(log.Fields{
+		"pod.iam.role": roleMapping.Role,
+		"ns.name":      roleMapping.Namespace,
+	})
+
+	credentials, err := s.assumeRole(pod, roleMapping, externalID, remoteIP)
+	if err != nil {
+		roleLogger.Errorf("Error assuming role %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	roleLogger.Debugf("retrieved credentials from sts endpoint: %s", s.iam.Endpoint)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&ContainerCredentials{
+		AccessKeyID:     credentials.AccessKeyID,
+		Expiration:      credentials.Expiration,
+		RoleArn:         roleMapping.Role,
+		SecretAccessKey: credentials.SecretAccessKey,
+		Token:           credentials.Token,
+	}); err != nil {
+		roleLogger.Errorf("Error sending json %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// startContainerCredentialsServer starts a HTTP server serving the ECS container credentials
+// endpoint on the container credentials port, sending the error it fails with to errCh.
+func (s *Server) startContainerCredentialsServer(errCh chan<- error) *http.Server {
+	r := mux.NewRouter()
+	r.Handle("/credentials", newAppHandler("containerCredentialsHandler", s.rateLimited(s.containerCredentialsHandler)))
+
+	srv := &http.Server{Addr: ":" + s.ContainerCredentialsPort, Handler: r}
+	go func() {
+		log.Infof("Listening for container credentials requests on port %s", s.ContainerCredentialsPort)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			errCh <- fmt.Errorf("error creating container credentials http server: %+v", err)
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/jtblin/kube2iam/iam"
+	"github.com/jtblin/kube2iam/k8s"
+	"github.com/jtblin/kube2iam/mappings"
+)
+
+const testBaseARN = "arn:aws:iam::123456789012:role/"
+
+// stsMock returns credentials for any role, or err when set.
+type stsMock struct {
+	stsiface.STSAPI
+	mu    sync.Mutex
+	err   error
+	roles []string
+}
+
+func (m *stsMock) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roles = append(m.roles, aws.StringValue(input.RoleArn))
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("access-key-id"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		SecretAccessKey: aws.String("secret-access-key"),
+		SessionToken:    aws.String("session-token"),
+	}}, nil
+}
+
+func (m *stsMock) assumedRoles() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.roles...)
+}
+
+func newTestPod(name, IP, role string) v1.Pod {
+	pod := v1.Pod{}
+	pod.Name = name
+	pod.Namespace = "default"
+	pod.Annotations = map[string]string{defaultIAMRoleKey: role}
+	pod.Status.PodIP = IP
+	pod.Status.Phase = v1.PodRunning
+	return pod
+}
+
+func newTestNamespace(name, allowedRoles string) v1.Namespace {
+	ns := v1.Namespace{}
+	ns.Name = name
+	ns.Annotations = map[string]string{defaultNamespaceKey: allowedRoles}
+	return ns
+}
+
+// newTestK8sClient returns a kubernetes client whose pod and namespace informers are synced with the objects
+// served by a fake API server.
+func newTestK8sClient(t *testing.T, namespaces []v1.Namespace, pods []v1.Pod) *k8s.Client {
+	done := make(chan struct{})
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("watch") == "true" {
+			w.WriteHeader(http.StatusOK)
+			select {
+			case <-done:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/namespaces") {
+			json.NewEncoder(w).Encode(&v1.NamespaceList{
+				TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "NamespaceList"},
+				ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+				Items:    namespaces,
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(&v1.PodList{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PodList"},
+			ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+			Items:    pods,
+		})
+	}))
+
+	client, err := k8s.NewClient(apiServer.URL, "token", "", false, false)
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	stopCh := make(chan struct{})
+	t.Cleanup(func() {
+		close(stopCh)
+		close(done)
+		apiServer.Close()
+	})
+	podSynced := client.WatchForPods(cache.ResourceEventHandlerFuncs{}, 0, stopCh)
+	namespaceSynced := client.WatchForNamespaces(cache.ResourceEventHandlerFuncs{}, 0, stopCh)
+	if !cache.WaitForCacheSync(stopCh, podSynced, namespaceSynced) {
+		t.Fatal("Unable to sync the pod and namespace informers")
+	}
+	return client
+}
+
+func TestContainerCredentialsHandler(t *testing.T) {
+	var containerTests = []struct {
+		test           string
+		authorization  string
+		remoteAddr     string
+		stsErr         error
+		expectedStatus int
+		expectedRoles  []string
+	}{
+		{
+			test:           "Missing token",
+			remoteAddr:     "10.0.0.1:43210",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			test:           "Invalid token",
+			authorization:  "other-token",
+			remoteAddr:     "10.0.0.1:43210",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			test:           "Unknown pod",
+			authorization:  "container-token",
+			remoteAddr:     "10.0.0.3:43210",
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			test:           "Role not allowed",
+			authorization:  "container-token",
+			remoteAddr:     "10.0.0.2:43210",
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			test:           "STS failure",
+			authorization:  "container-token",
+			remoteAddr:     "10.0.0.1:43210",
+			stsErr:         errors.New("AccessDenied"),
+			expectedStatus: http.StatusInternalServerError,
+			expectedRoles:  []string{testBaseARN + "team-a-reader"},
+		},
+		{
+			test:           "Credentials",
+			authorization:  "container-token",
+			remoteAddr:     "10.0.0.1:43210",
+			expectedStatus: http.StatusOK,
+			expectedRoles:  []string{testBaseARN + "team-a-reader"},
+		},
+	}
+
+	k := newTestK8sClient(t,
+		[]v1.Namespace{newTestNamespace("default", `["team-a-*"]`)},
+		[]v1.Pod{
+			newTestPod("allowed", "10.0.0.1", "team-a-reader"),
+			newTestPod("denied", "10.0.0.2", "team-b-reader"),
+		},
+	)
+	for _, tt := range containerTests {
+		t.Run(tt.test, func(t *testing.T) {
+			s := NewServer()
+			s.ContainerCredentialsToken = "container-token"
+			s.PodLookupTimeout = 10 * time.Millisecond
+			s.k8s = k
+			s.iam = iam.NewClient(testBaseARN, false, 0, 0)
+			mock := &stsMock{err: tt.stsErr}
+			s.iam.STS = mock
+			s.roleMapper = mappings.NewRoleMapper(newTestConfig(s), s.iam, s.k8s)
+
+			req := httptest.NewRequest(http.MethodGet, "/credentials", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+			s.containerCredentialsHandler(log.WithField("test", tt.test), rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("Expected status [%d] for test but recieved [%d]: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if roles := mock.assumedRoles(); len(roles) != len(tt.expectedRoles) || (len(roles) > 0 && roles[0] != tt.expectedRoles[0]) {
+				t.Errorf("Expected roles [%v] to be assumed but recieved [%v]", tt.expectedRoles, roles)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			credentials := &ContainerCredentials{}
+			if err := json.Unmarshal(rr.Body.Bytes(), credentials); err != nil {
+				t.Fatalf("Unable to decode response [%s]: %v", rr.Body.String(), err)
+			}
+			if credentials.AccessKeyID != "access-key-id" || credentials.SecretAccessKey != "secret-access-key" ||
+				credentials.Token != "session-token" || credentials.RoleArn != testBaseARN+"team-a-reader" {
+				t.Errorf("Unexpected credentials [%+v]", credentials)
+			}
+		})
+	}
+}
+
+func TestStartContainerCredentialsServerError(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	defer listener.Close()
+
+	s := NewServer()
+	s.ContainerCredentialsPort = strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	errCh := make(chan error, 1)
+	s.startContainerCredentialsServer(errCh)
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "container credentials") {
+			t.Errorf("Expected container credentials server error but recieved %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the error of the port in use to be reported")
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jtblin/kube2iam/mappings"
+)
+
+// DebugResponse is the response of the endpoints of the debug API.
+type DebugResponse struct {
+	APIVersion string      `json:"apiVersion"`
+	Items      interface{} `json:"items"`
+}
+
+const debugAPIVersion = "v1"
+
+// debugFilter returns the filter of a debug API request from its namespace, ip and role query parameters.
+func debugFilter(r *http.Request) mappings.DebugFilter {
+	query := r.URL.Query()
+	return mappings.DebugFilter{
+		Namespace: query.Get("namespace"),
+		IP:        query.Get("ip"),
+		Role:      query.Get("role"),
+	}
+}
+
+func writeDebugResponse(logger *log.Entry, w http.ResponseWriter, items interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&DebugResponse{APIVersion: debugAPIVersion, Items: items}); err != nil {
+		logger.Errorf("Error sending json %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) debugPodsHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+	writeDebugResponse(logger, w, s.roleMapper.DebugPods(debugFilter(r)))
+}
+
+func (s *Server) debugConflictsHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+	writeDebugResponse(logger, w, s.roleMapper.DebugConflicts(debugFilter(r)))
+}
+
+func (s *Server) debugNamespacesHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+	writeDebugResponse(logger, w, s.roleMapper.DebugNamespaces(debugFilter(r)))
+}
+
+func (s *Server) debugCacheHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+	writeDebugResponse(logger, w, s.roleMapper.DebugCache(debugFilter(r)))
+}
+
+func (s *Server) debugViolationsHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+	writeDebugResponse(logger, w, s.roleMapper.DebugViolations(debugFilter(r)))
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/jtblin/kube2iam/mappings"
+)
+
+func TestDebugNamespacesHandler(t *testing.T) {
+	var debugTests = []struct {
+		test          string
+		query         string
+		expectedItems int
+	}{
+		{
+			test:          "No filter",
+			expectedItems: 1,
+		},
+		{
+			test:          "Namespace filter",
+			query:         "?namespace=default",
+			expectedItems: 1,
+		},
+		{
+			test:          "Unknown namespace",
+			query:         "?namespace=other",
+			expectedItems: 0,
+		},
+	}
+
+	s := newTestWebhookServer(false, false)
+	for _, tt := range debugTests {
+		t.Run(tt.test, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.debugNamespacesHandler(log.WithField("test", tt.test), w, httptest.NewRequest(http.MethodGet, "/debug/v1/namespaces"+tt.query, nil))
+
+			response := struct {
+				APIVersion string            `json:"apiVersion"`
+				Items      []json.RawMessage `json:"items"`
+			}{}
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatalf("Didn't expect error but recieved %s", err)
+			}
+			if response.APIVersion != debugAPIVersion || len(response.Items) != tt.expectedItems {
+				t.Errorf("Expected [%d] items of version [%s] for test but recieved [%+v]", tt.expectedItems, debugAPIVersion, response)
+			}
+		})
+	}
+}
+
+func TestDebugViolationsHandler(t *testing.T) {
+	var debugTests = []struct {
+		test          string
+		query         string
+		expectedItems int
+	}{
+		{
+			test:          "No filter",
+			expectedItems: 1,
+		},
+		{
+			test:          "Role filter",
+			query:         "?role=team-b-*",
+			expectedItems: 1,
+		},
+		{
+			test:          "Unknown namespace",
+			query:         "?namespace=other",
+			expectedItems: 0,
+		},
+	}
+
+	s := newTestWebhookServer(false, true)
+	pod := &v1.Pod{}
+	pod.Name = "web"
+	pod.Namespace = "default"
+	pod.Annotations = map[string]string{s.IAMRoleKey: "team-b-reader"}
+	if _, err := s.roleMapper.GetRoleMappingForPod(pod, ""); err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	for _, tt := range debugTests {
+		t.Run(tt.test, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.debugViolationsHandler(log.WithField("test", tt.test), w, httptest.NewRequest(http.MethodGet, "/debug/v1/violations"+tt.query, nil))
+
+			response := struct {
+				APIVersion string               `json:"apiVersion"`
+				Items      []mappings.Violation `json:"items"`
+			}{}
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatalf("Didn't expect error but recieved %s", err)
+			}
+			if response.APIVersion != debugAPIVersion || len(response.Items) != tt.expectedItems {
+				t.Errorf("Expected [%d] items of version [%s] for test but recieved [%+v]", tt.expectedItems, debugAPIVersion, response)
+			}
+		})
+	}
+}
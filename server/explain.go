@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/jtblin/kube2iam/iam"
+	"github.com/jtblin/kube2iam/mappings"
+)
+
+// ExplainResponse is the response of the explain endpoint: the trace of the role of a pod along with the status
+// of the credentials cached for it.
+type ExplainResponse struct {
+	mappings.RoleExplanation
+	// Cache is only set for the pods allowed to assume their role.
+	Cache *iam.CacheStatus `json:"cache,omitempty"`
+}
+
+// explainHandler explains the role of the pod with the ip query parameter, or the namespace and name query
+// parameters. Only the pods of the node are known.
+func (s *Server) explainHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.ExplainToken)) != 1 {
+		logger.Warn("Missing or invalid explain token")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	var pod *v1.Pod
+	var err error
+	switch {
+	case query.Get("ip") != "":
+		pod, err = s.k8s.PodByIP(query.Get("ip"))
+	case query.Get("namespace") != "" && query.Get("name") != "":
+		pod, err = s.k8s.PodByName(query.Get("namespace"), query.Get("name"))
+	default:
+		http.Error(w, "expected either the ip or the namespace and name query parameters", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// The credentials of dual-stack pods are cached per IP, those of the queried IP are reported
+	response := &ExplainResponse{RoleExplanation: *s.roleMapper.Explain(pod, query.Get("ip"))}
+	// Denied pods are skipped as their role mapping would count as a violation in audit mode
+	if response.Allowed && response.Role != "" {
+		if roleMapping, err := s.roleMapper.GetRoleMappingForPod(pod, response.IP); err == nil {
+			status := s.iam.CacheStatus(roleMapping.Role, s.roleMapper.GetExternalIDMappingForPod(pod), roleMapping.IP, sessionOptions(roleMapping))
+			response.Cache = &status
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Errorf("Error sending json %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestExplainHandlerRequests(t *testing.T) {
+	var explainTests = []struct {
+		test           string
+		authorization  string
+		query          string
+		expectedStatus int
+	}{
+		{
+			test:           "Missing token",
+			query:          "?ip=10.0.0.1",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			test:           "Invalid token",
+			authorization:  "Bearer other-token",
+			query:          "?ip=10.0.0.1",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			test:           "Token without bearer scheme",
+			authorization:  "explain-token",
+			query:          "?ip=10.0.0.1",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			test:           "Missing pod",
+			authorization:  "Bearer explain-token",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			test:           "Namespace without name",
+			authorization:  "Bearer explain-token",
+			query:          "?namespace=default",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	s := NewServer()
+	s.ExplainToken = "explain-token"
+	for _, tt := range explainTests {
+		t.Run(tt.test, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/explain"+tt.query, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			s.explainHandler(log.WithField("test", tt.test), w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status [%d] for test but recieved [%d]: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"github.com/jtblin/kube2iam"
+	"github.com/jtblin/kube2iam/metrics"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Pods scheduled while the queue is full are not prefetched, their credentials are obtained on first request.
+const prefetchQueueSize = 1000
+
+// credentialsPrefetcher assumes the role of pods getting an IP on the node ahead of their first request,
+// using a bounded pool of workers so that a burst of pods doesn't flood STS.
+type credentialsPrefetcher struct {
+	server *Server
+	queue  chan *v1.Pod
+}
+
+// Prefetch queues the pod for prefetching. It never blocks as it is called from the pod informer.
+func (p *credentialsPrefetcher) Prefetch(pod *v1.Pod) {
+	select {
+	case p.queue <- pod:
+	default:
+		log.Debugf("Prefetch queue is full, not prefetching credentials for pod %s/%s", pod.GetNamespace(), pod.GetName())
+	}
+}
+
+// run starts workers prefetching the queued pods until stopCh is closed.
+func (p *credentialsPrefetcher) run(workers int, stopCh <-chan struct{}) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-stopCh:
+					return
+				case pod := <-p.queue:
+					p.prefetch(pod)
+				}
+			}
+		}()
+	}
+}
+
+func (p *credentialsPrefetcher) prefetch(pod *v1.Pod) {
+	s := p.server
+	// Pods using the host network share the node IP, and pods relying on the default role
+	// may never call AWS, their credentials are obtained on first request
+	if pod.Spec.HostNetwork || !s.roleMapper.RequestsRole(pod) {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{
+		"pod.name":      pod.GetName(),
+		"pod.namespace": pod.GetNamespace(),
+		"pod.status.ip": pod.Status.PodIP,
+	})
+	// Denied pods are skipped as their role mapping would count as a violation in audit mode, which must only
+	// be recorded when the pod requests credentials
+	if decision := s.roleMapper.ValidatePod(pod); !decision.Allowed || decision.Audited {
+		logger.Debugf("Not prefetching credentials: %s", decision.Reason)
+		return
+	}
+	roleMapping, err := s.roleMapper.GetRoleMappingForPod(pod, "")
+	if err != nil {
+		logger.Debugf("Not prefetching credentials: %+v", err)
+		return
+	}
+	externalID := s.roleMapper.GetExternalIDMappingForPod(pod)
+
+	// The session name depends on the IP the request comes from, dual-stack pods get credentials for each of them
+	for _, IP := range kube2iam.PodIPs(pod) {
+		ipLogger := logger.WithFields(log.Fields{"pod.iam.role": roleMapping.Role, "pod.status.ip": IP})
+		if err := s.iam.Prefetch(roleMapping.Role, externalID, IP, s.IAMRoleSessionTTL, sessionOptions(roleMapping)); err != nil {
+			metrics.IamPrefetchCount.WithLabelValues(metrics.IamResultFailure).Inc()
+			ipLogger.Warnf("Error prefetching credentials %+v", err)
+			continue
+		}
+		metrics.IamPrefetchCount.WithLabelValues(metrics.IamResultSuccess).Inc()
+		ipLogger.Debug("Prefetched credentials")
+	}
+}
+
+func newCredentialsPrefetcher(s *Server) *credentialsPrefetcher {
+	return &credentialsPrefetcher{
+		server: s,
+		queue:  make(chan *v1.Pod, prefetchQueueSize),
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/jtblin/kube2iam/iam"
+	"github.com/jtblin/kube2iam/mappings"
+)
+
+func newTestPrefetchServer(audit bool) (*Server, *stsMock) {
+	s := newTestWebhookServer(false, audit)
+	s.iam = iam.NewClient(testBaseARN, false, 0, 0)
+	mock := &stsMock{}
+	s.iam.STS = mock
+	return s, mock
+}
+
+func TestCredentialsPrefetch(t *testing.T) {
+	dualStack := newTestPod("dual-stack", "10.0.0.1", "team-a-reader")
+	dualStack.Status.PodIPs = []v1.PodIP{{IP: "10.0.0.1"}, {IP: "2600:1f14::1"}}
+	hostNetwork := newTestPod("host-network", "192.168.0.1", "team-a-reader")
+	hostNetwork.Spec.HostNetwork = true
+	noRole := newTestPod("no-role", "10.0.0.1", "")
+	noRole.Annotations = nil
+
+	var prefetchTests = []struct {
+		test          string
+		audit         bool
+		pod           v1.Pod
+		expectedIPs   []string
+		expectedRoles int
+	}{
+		{
+			test:          "Allowed role",
+			pod:           newTestPod("allowed", "10.0.0.1", "team-a-reader"),
+			expectedIPs:   []string{"10.0.0.1"},
+			expectedRoles: 1,
+		},
+		{
+			test:          "Dual-stack pod",
+			pod:           dualStack,
+			expectedIPs:   []string{"10.0.0.1", "2600:1f14::1"},
+			expectedRoles: 2,
+		},
+		{
+			test: "Role not allowed",
+			pod:  newTestPod("denied", "10.0.0.1", "team-b-reader"),
+		},
+		{
+			test:  "Role not allowed in audit mode",
+			audit: true,
+			pod:   newTestPod("denied", "10.0.0.1", "team-b-reader"),
+		},
+		{
+			test: "Host network",
+			pod:  hostNetwork,
+		},
+		{
+			test: "No role",
+			pod:  noRole,
+		},
+	}
+
+	for _, tt := range prefetchTests {
+		t.Run(tt.test, func(t *testing.T) {
+			s, mock := newTestPrefetchServer(tt.audit)
+			pod := tt.pod
+			newCredentialsPrefetcher(s).prefetch(&pod)
+
+			if roles := mock.assumedRoles(); len(roles) != tt.expectedRoles {
+				t.Errorf("Expected [%d] roles to be assumed but recieved [%v]", tt.expectedRoles, roles)
+			}
+			for _, IP := range tt.expectedIPs {
+				status := s.iam.CacheStatus(testBaseARN+"team-a-reader", "", IP, &iam.SessionOptions{})
+				if !status.Cached || !status.Prefetched {
+					t.Errorf("Expected credentials of %s to be prefetched but recieved [%+v]", IP, status)
+				}
+			}
+			if violations, _ := s.roleMapper.DumpDebugInfo()["namespaceRestrictionViolations"].([]mappings.Violation); len(violations) != 0 {
+				t.Errorf("Expected no violation to be recorded but recieved [%+v]", violations)
+			}
+		})
+	}
+}
+
+func TestCredentialsPrefetcherWorkers(t *testing.T) {
+	s, mock := newTestPrefetchServer(false)
+	p := newCredentialsPrefetcher(s)
+	for i := 1; i <= 10; i++ {
+		pod := newTestPod(fmt.Sprintf("web-%d", i), fmt.Sprintf("10.0.0.%d", i), "team-a-reader")
+		p.Prefetch(&pod)
+	}
+
+	// Pods queued before the workers start are prefetched once they do
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	p.run(3, stopCh)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mock.assumedRoles()) < 10 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if roles := mock.assumedRoles(); len(roles) != 10 {
+		t.Errorf("Expected [10] roles to be assumed but recieved [%d]", len(roles))
+	}
+}
+
+func TestCredentialsPrefetcherQueueFull(t *testing.T) {
+	s, mock := newTestPrefetchServer(false)
+	p := &credentialsPrefetcher{server: s, queue: make(chan *v1.Pod, 1)}
+	first := newTestPod("first", "10.0.0.1", "team-a-reader")
+	second := newTestPod("second", "10.0.0.2", "team-a-reader")
+
+	// The pod informer must never be blocked by a full queue
+	p.Prefetch(&first)
+	p.Prefetch(&second)
+	if len(p.queue) != 1 {
+		t.Fatalf("Expected [1] pod to be queued but recieved [%d]", len(p.queue))
+	}
+	if pod := <-p.queue; pod.GetName() != "first" {
+		t.Errorf("Expected pod first to be queued but recieved [%s]", pod.GetName())
+	}
+	if roles := mock.assumedRoles(); len(roles) != 0 {
+		t.Errorf("Expected no role to be assumed but recieved [%v]", roles)
+	}
+}
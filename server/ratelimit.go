@@ -0,0 +1,145 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+
+	"github.com/jtblin/kube2iam/metrics"
+)
+
+const (
+	// rateLimitIP and rateLimitGlobal name the limit exceeded by a request in metrics.
+	rateLimitIP     = "ip"
+	rateLimitGlobal = "global"
+
+	rateLimiterPurgeInterval = time.Minute
+)
+
+// rateLimiter limits the requests of each source IP with a token bucket, along with the requests of all IPs
+// with a global token bucket.
+type rateLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	global    *rate.Limiter
+	buckets   map[string]*ipBucket
+	nextPurge time.Time
+	now       func() time.Time
+	// namespaceOf returns the namespace of the pod with an IP, to label the metrics of throttled requests.
+	namespaceOf func(IP string) string
+}
+
+type ipBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newRateLimiter returns a rate limiter allowing limit requests per second from each IP with bursts of burst
+// requests, and globalLimit requests per second overall with bursts of globalBurst requests. A limit of 0
+// disables the matching buckets.
+func newRateLimiter(limit float64, burst int, globalLimit float64, globalBurst int) *rateLimiter {
+	l := &rateLimiter{
+		limit:   rate.Limit(limit),
+		burst:   burst,
+		buckets: make(map[string]*ipBucket),
+		now:     time.Now,
+	}
+	if globalLimit > 0 {
+		l.global = rate.NewLimiter(rate.Limit(globalLimit), globalBurst)
+	}
+	return l
+}
+
+// allow takes a token from the bucket of IP and from the global bucket. When either bucket is empty no token is
+// taken and it returns the limit exceeded along with the delay after which the request can be retried.
+func (l *rateLimiter) allow(IP string) (string, time.Duration) {
+	now := l.now()
+	var reservation *rate.Reservation
+	if limiter := l.bucket(IP, now); limiter != nil {
+		reservation = limiter.ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			reservation.CancelAt(now)
+			return rateLimitIP, delay
+		}
+	}
+
+	if l.global != nil {
+		globalReservation := l.global.ReserveN(now, 1)
+		if delay := globalReservation.DelayFrom(now); delay > 0 {
+			globalReservation.CancelAt(now)
+			// The request isn't served, give the token back to the IP
+			if reservation != nil {
+				reservation.CancelAt(now)
+			}
+			return rateLimitGlobal, delay
+		}
+	}
+	return "", 0
+}
+
+// bucket returns the limiter of IP, or nil if requests aren't limited per IP.
+func (l *rateLimiter) bucket(IP string, now time.Time) *rate.Limiter {
+	if l.limit <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.After(l.nextPurge) {
+		l.purge(now)
+		l.nextPurge = now.Add(rateLimiterPurgeInterval)
+	}
+
+	b, ok := l.buckets[IP]
+	if !ok {
+		b = &ipBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[IP] = b
+	}
+	b.lastSeen = now
+	return b.limiter
+}
+
+// purge removes the buckets of the IPs idle for long enough for their bucket to be full again, they are no
+// different from new buckets.
+func (l *rateLimiter) purge(now time.Time) {
+	refill := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+	for IP, b := range l.buckets {
+		if now.Sub(b.lastSeen) > refill {
+			delete(l.buckets, IP)
+		}
+	}
+}
+
+// rateLimited wraps a handler serving pods to refuse the requests exceeding the rate limits with
+// 429 Too Many Requests and a Retry-After header.
+func (s *Server) rateLimited(fn appHandlerFunc) appHandlerFunc {
+	return func(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+		if s.rateLimiter == nil {
+			fn(logger, w, r)
+			return
+		}
+
+		remoteIP := parseRemoteAddr(r.RemoteAddr)
+		limit, delay := s.rateLimiter.allow(remoteIP)
+		if limit == "" {
+			fn(logger, w, r)
+			return
+		}
+
+		namespace := ""
+		if s.rateLimiter.namespaceOf != nil {
+			namespace = s.rateLimiter.namespaceOf(remoteIP)
+		}
+		metrics.RateLimitedRequestCount.WithLabelValues(namespace, limit).Inc()
+		logger.WithField("ns.name", namespace).Debugf("Request exceeded the %s rate limit, retry in %s", limit, delay)
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	}
+}
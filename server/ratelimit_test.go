@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(1, 2, 10, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if limit, _ := l.allow("10.0.0.1"); limit != "" {
+			t.Fatalf("Expected request %d within the burst to be allowed but exceeded the %s limit", i, limit)
+		}
+	}
+	limit, delay := l.allow("10.0.0.1")
+	if limit != rateLimitIP || delay <= 0 || delay > time.Second {
+		t.Errorf("Expected the ip limit to be exceeded for up to 1s but recieved %s, %s", limit, delay)
+	}
+
+	// The global bucket has a single token left, refused requests don't take tokens from the IP bucket
+	if limit, _ := l.allow("10.0.0.2"); limit != "" {
+		t.Errorf("Expected request from another IP to be allowed but exceeded the %s limit", limit)
+	}
+	if limit, _ := l.allow("10.0.0.2"); limit != rateLimitGlobal {
+		t.Errorf("Expected the global limit to be exceeded but recieved %q", limit)
+	}
+	now = now.Add(100 * time.Millisecond)
+	if limit, _ := l.allow("10.0.0.2"); limit != "" {
+		t.Errorf("Expected request to be allowed once the global bucket refilled but exceeded the %s limit", limit)
+	}
+
+	now = now.Add(time.Second)
+	if limit, _ := l.allow("10.0.0.1"); limit != "" {
+		t.Errorf("Expected request to be allowed once the ip bucket refilled but exceeded the %s limit", limit)
+	}
+
+	now = now.Add(2 * rateLimiterPurgeInterval)
+	l.allow("10.0.0.3")
+	if _, ok := l.buckets["10.0.0.1"]; ok || len(l.buckets) != 1 {
+		t.Errorf("Expected the buckets of idle IPs to be purged but recieved %+v", l.buckets)
+	}
+}
+
+func TestRateLimitedHandler(t *testing.T) {
+	s := NewServer()
+	s.rateLimiter = newRateLimiter(1, 1, 0, 0)
+	s.rateLimiter.namespaceOf = func(IP string) string { return "default" }
+	handler := s.rateLimited(func(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+		write(logger, w, "ok")
+	})
+
+	var handlerTests = []struct {
+		test               string
+		remoteAddr         string
+		expectedStatus     int
+		expectedRetryAfter string
+	}{
+		{
+			test:           "Within the limit",
+			remoteAddr:     "10.0.0.1:1234",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			test:               "Above the limit",
+			remoteAddr:         "10.0.0.1:1234",
+			expectedStatus:     http.StatusTooManyRequests,
+			expectedRetryAfter: "1",
+		},
+		{
+			test:           "Another IP",
+			remoteAddr:     "10.0.0.2:1234",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range handlerTests {
+		t.Run(tt.test, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/latest/meta-data/iam/security-credentials/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			handler(log.WithField("test", tt.test), w, req)
+			if w.Code != tt.expectedStatus || w.Header().Get("Retry-After") != tt.expectedRetryAfter {
+				t.Errorf("Expected status [%d] with Retry-After [%s] for test but recieved [%d] with [%s]", tt.expectedStatus, tt.expectedRetryAfter, w.Code, w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,54 +10,64 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/cenk/backoff"
 	"github.com/gorilla/mux"
 	"github.com/jtblin/kube2iam"
 	"github.com/jtblin/kube2iam/iam"
+	"github.com/jtblin/kube2iam/iptables"
 	"github.com/jtblin/kube2iam/k8s"
 	"github.com/jtblin/kube2iam/mappings"
 	"github.com/jtblin/kube2iam/metrics"
 	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
 const (
 	defaultAppPort           = "8181"
+	defaultWebhookPort       = "8443"
 	defaultCacheSyncAttempts = 10
 	defaultIAMRoleKey        = "iam.amazonaws.com/role"
 	defaultIAMExternalID     = "iam.amazonaws.com/external-id"
+	defaultSessionPolicyKey  = "iam.amazonaws.com/session-policy"
+	defaultPolicyARNsKey     = "iam.amazonaws.com/session-policy-arns"
 	defaultLogLevel          = "info"
 	defaultLogFormat         = "text"
 
-	// Choosing the larger value for max elasped time will have the impact on downstream API latency
+	// Choosing the larger value for the pod lookup timeout will have the impact on downstream API latency
 	// The default EC2 metadata timeout is 1 second, hence choosing the value less than 1 second
 	// The downstream API will by default retries 3 times
-	defaultMaxElapsedTime = 500 * time.Millisecond
+	defaultPodLookupTimeout = 500 * time.Millisecond
 
 	defaultIAMRoleSessionTTL = 15 * time.Minute
 
-	// The max interval specifies the operation to be completed with in this time period
-	// The shared informer has to populate the cache with in this interval based on the Pod events
-	// If the Pod event is not received, the operation will error out and
-	// the exponential backoff will retry untill the max elasped time
-	defaultMaxInterval = 100 * time.Millisecond
+	// Credentials still in use are renewed this long before they expire from the cache,
+	// the default session TTL leaves them 10 minutes of validity
+	defaultIAMCacheRefreshWindow = 5 * time.Minute
+
+	defaultPrefetchWorkers = 5
 
 	defaultMetadataAddress            = "169.254.169.254"
+	defaultMetadataAddressIPv6        = "fd00:ec2::254"
 	defaultNamespaceKey               = "iam.amazonaws.com/allowed-roles"
+	defaultNamespaceDeniedKey         = "iam.amazonaws.com/denied-roles"
+	defaultNamespaceDefaultRoleKey    = "iam.amazonaws.com/default-role"
 	defaultCacheResyncPeriod          = 30 * time.Minute
 	defaultResolveDupIPs              = false
 	defaultNamespaceRestrictionFormat = "glob"
 	healthcheckInterval               = 30 * time.Second
+	defaultShutdownGracePeriod        = 15 * time.Second
+	defaultIMDSv2HopLimit             = 1
+	defaultIPTablesReconcileInterval  = 30 * time.Second
 	defaultStsVpcEndpoint             = ""
+	defaultRateLimitBurst             = 20
+	defaultGlobalRateLimitBurst       = 200
 )
 
-var tokenRouteRegexp = regexp.MustCompile("^/?[^/]+/api/token$")
-
 // Keeps track of the names of registered handlers for metric value/label initialization
 var registeredHandlerNames []string
 
@@ -66,36 +77,71 @@ type Server struct {
 	APIServer                  string
 	APIToken                   string
 	AppPort                    string
+	ContainerCredentialsPort   string
+	ContainerCredentialsToken  string
+	ExplainToken               string
+	RateLimit                  float64
+	RateLimitBurst             int
+	GlobalRateLimit            float64
+	GlobalRateLimitBurst       int
 	MetricsPort                string
 	BaseRoleARN                string
 	DefaultIAMRole             string
 	IAMRoleKey                 string
+	ServiceAccountRoleKey      string
+	SessionTags                []string
+	TransitiveSessionTags      []string
 	IAMExternalID              string
+	SessionPolicyKey           string
+	SessionPolicyARNsKey       string
 	IAMRoleSessionTTL          time.Duration
+	IAMCacheMaxEntries         int
+	IAMCacheRefreshWindow      time.Duration
+	PrefetchWorkers            int
 	MetadataAddress            string
-	HostInterface              string
+	MetadataAddressIPv6        string
+	HostInterfaces             []string
 	HostIP                     string
+	HostIPv6                   string
+	IMDSv2HopLimit             int
 	NodeName                   string
 	NamespaceKey               string
+	NamespaceDeniedKey         string
+	NamespaceDefaultRoleKey    string
 	CacheResyncPeriod          time.Duration
 	LogLevel                   string
 	LogFormat                  string
 	NamespaceRestrictionFormat string
+	AuthorizationPolicyFile    string
 	ResolveDupIPs              bool
 	UseRegionalStsEndpoint     bool
 	AddIPTablesRule            bool
+	RemoveIPTablesRule         bool
+	IPTablesReconcileInterval  time.Duration
+	IPTablesBackend            string
 	AutoDiscoverBaseArn        bool
 	AutoDiscoverDefaultRole    bool
 	Debug                      bool
+	IAMRoleBindings            bool
+	IMDSv2Required             bool
 	Insecure                   bool
 	NamespaceRestriction       bool
+	NamespaceRestrictionAudit  bool
+	WebhookPort                string
+	WebhookTLSCertFile         string
+	WebhookTLSKeyFile          string
+	WebhookWarnOnly            bool
+	RecordEvents               bool
 	Verbose                    bool
 	Version                    bool
 	iam                        *iam.Client
 	k8s                        *k8s.Client
 	roleMapper                 *mappings.RoleMapper
-	BackoffMaxElapsedTime      time.Duration
-	BackoffMaxInterval         time.Duration
+	tokens                     *tokenStore
+	upstreamToken              *upstreamTokenSource
+	rateLimiter                *rateLimiter
+	PodLookupTimeout           time.Duration
+	ShutdownGracePeriod        time.Duration
 	InstanceID                 string
 	HealthcheckFailReason      string
 	healthcheckTicker          *time.Ticker
@@ -172,65 +218,59 @@ func newAppHandler(name string, fn appHandlerFunc) *appHandler {
 }
 
 func parseRemoteAddr(addr string) string {
-	n := strings.IndexByte(addr, ':')
-	if n <= 1 {
+	hostname, _, err := net.SplitHostPort(addr)
+	if err != nil {
 		return ""
 	}
-	hostname := addr[0:n]
 	if net.ParseIP(hostname) == nil {
 		return ""
 	}
 	return hostname
 }
 
-func (s *Server) getRoleMapping(IP string) (*mappings.RoleMappingResult, error) {
-	var roleMapping *mappings.RoleMappingResult
-	var err error
-	operation := func() error {
-		roleMapping, err = s.roleMapper.GetRoleMapping(IP)
-		return err
+// getRoleMapping returns the role mapping and external ID of the pod with the IP along with the pod. The pod is
+// looked up once for both, waiting up to the pod lookup timeout for the informer to index a new pod.
+func (s *Server) getRoleMapping(IP string) (*mappings.RoleMappingResult, string, *v1.Pod, error) {
+	pod, err := s.k8s.WaitForPodByIP(IP, s.PodLookupTimeout)
+	if err != nil {
+		return nil, "", nil, err
 	}
 
-	expBackoff := backoff.NewExponentialBackOff()
-	expBackoff.MaxInterval = s.BackoffMaxInterval
-	expBackoff.MaxElapsedTime = s.BackoffMaxElapsedTime
-
-	err = backoff.Retry(operation, expBackoff)
+	roleMapping, err := s.roleMapper.GetRoleMappingForPod(pod, IP)
 	if err != nil {
-		return nil, err
+		var denied *mappings.RoleDeniedError
+		if errors.As(err, &denied) {
+			s.k8s.RecordPodWarning(pod, k8s.EventReasonIAMRoleDenied, "Role %s denied: %s", denied.Role, denied.Reason)
+		}
+		return nil, "", nil, err
 	}
 
-	return roleMapping, nil
+	return roleMapping, s.roleMapper.GetExternalIDMappingForPod(pod), pod, nil
 }
 
-func (s *Server) getExternalIDMapping(IP string) (string, error) {
-	var externalID string
-	var err error
-	operation := func() error {
-		externalID, err = s.roleMapper.GetExternalIDMapping(IP)
-		return err
-	}
-
-	expBackoff := backoff.NewExponentialBackOff()
-	expBackoff.MaxInterval = s.BackoffMaxInterval
-	expBackoff.MaxElapsedTime = s.BackoffMaxElapsedTime
-
-	err = backoff.Retry(operation, expBackoff)
+// assumeRole assumes the role of a pod, recording an event on the pod when STS fails.
+func (s *Server) assumeRole(pod *v1.Pod, roleMapping *mappings.RoleMappingResult, externalID, remoteIP string) (*iam.Credentials, error) {
+	credentials, err := s.iam.AssumeRole(roleMapping.Role, externalID, remoteIP, s.IAMRoleSessionTTL, sessionOptions(roleMapping))
 	if err != nil {
-		return "", err
+		s.k8s.RecordPodWarning(pod, k8s.EventReasonAssumeRoleFailed, "Unable to assume role %s (%s): %v", roleMapping.Role, iam.ErrorCode(err), err)
+		return nil, err
 	}
-
-	return externalID, nil
+	return credentials, nil
 }
 
-func (s *Server) beginPollHealthcheck(interval time.Duration) {
+func (s *Server) beginPollHealthcheck(interval time.Duration, stopCh <-chan struct{}) {
 	if s.healthcheckTicker == nil {
 		s.doHealthcheck()
 		s.healthcheckTicker = time.NewTicker(interval)
 		go func() {
+			defer s.healthcheckTicker.Stop()
 			for {
-				<-s.healthcheckTicker.C
-				s.doHealthcheck()
+				select {
+				case <-stopCh:
+					return
+				case <-s.healthcheckTicker.C:
+					s.doHealthcheck()
+				}
 			}
 		}()
 	}
@@ -309,10 +349,69 @@ func (s *Server) debugStoreHandler(logger *log.Entry, w http.ResponseWriter, r *
 	write(logger, w, string(o))
 }
 
+// checkMetadataToken validates the IMDSv2 session token sent with r, if any, against the token store.
+// Requests without a token are only accepted when IMDSv2 is not required.
+func (s *Server) checkMetadataToken(logger *log.Entry, w http.ResponseWriter, r *http.Request, remoteIP string) bool {
+	token := r.Header.Get(metadataTokenHeader)
+	if token == "" && !s.IMDSv2Required {
+		return true
+	}
+	if token == "" || !s.tokens.Validate(token, remoteIP) {
+		logger.Warn("Missing, expired or invalid metadata token")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (s *Server) tokenHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "EC2ws")
+	remoteIP := parseRemoteAddr(r.RemoteAddr)
+
+	// The metadata service refuses to issue tokens to requests that went through a proxy, this
+	// prevents open proxies and SSRF vulnerabilities in pods from being used to obtain a token
+	if r.Header.Get("X-Forwarded-For") != "" {
+		logger.Warn("Refusing to issue metadata token to forwarded request")
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	ttl, err := parseMetadataTokenTTL(r.Header.Get(metadataTokenTTLHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, err := s.tokens.Issue(remoteIP, ttl)
+	if err != nil {
+		logger.Errorf("Error generating metadata token %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if s.IMDSv2HopLimit > 0 {
+		if err := setHopLimit(r, s.IMDSv2HopLimit); err != nil {
+			logger.Errorf("Error setting metadata token hop limit %+v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The hop limit is an option of the socket, the connection is closed after the token response so that
+		// the responses of later requests kept alive on it, such as credentials, aren't sent with it
+		w.Header().Set("Connection", "close")
+	}
+
+	w.Header().Set(metadataTokenTTLHeader, strconv.Itoa(int(ttl.Seconds())))
+	w.Header().Set("Content-Type", "text/plain")
+	write(logger, w, token)
+}
+
 func (s *Server) securityCredentialsHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Server", "EC2ws")
 	remoteIP := parseRemoteAddr(r.RemoteAddr)
-	roleMapping, err := s.getRoleMapping(remoteIP)
+	if !s.checkMetadataToken(logger, w, r, remoteIP) {
+		return
+	}
+	roleMapping, _, _, err := s.getRoleMapping(remoteIP)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -330,16 +429,13 @@ func (s *Server) securityCredentialsHandler(logger *log.Entry, w http.ResponseWr
 func (s *Server) roleHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Server", "EC2ws")
 	remoteIP := parseRemoteAddr(r.RemoteAddr)
-
-	roleMapping, err := s.getRoleMapping(remoteIP)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !s.checkMetadataToken(logger, w, r, remoteIP) {
 		return
 	}
 
-	externalID, err := s.getExternalIDMapping(remoteIP)
+	roleMapping, externalID, pod, err := s.getRoleMapping(remoteIP)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -358,7 +454,7 @@ func (s *Server) roleHandler(logger *log.Entry, w http.ResponseWriter, r *http.R
 		return
 	}
 
-	credentials, err := s.iam.AssumeRole(wantedRoleARN, externalID, remoteIP, s.IAMRoleSessionTTL)
+	credentials, err := s.assumeRole(pod, roleMapping, externalID, remoteIP)
 	if err != nil {
 		roleLogger.Errorf("Error assuming role %+v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -373,10 +469,23 @@ func (s *Server) roleHandler(logger *log.Entry, w http.ResponseWriter, r *http.R
 }
 
 func (s *Server) reverseProxyHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
-	// Remove remoteaddr to prevent issues with new IMDSv2 to fail when x-forwarded-for header is present
-	// for more details please see: https://github.com/aws/aws-sdk-ruby/issues/2177 https://github.com/uswitch/kiam/issues/359
-	token := r.Header.Get("X-aws-ec2-metadata-token")
-	if (r.Method == http.MethodPut && tokenRouteRegexp.MatchString(r.URL.Path)) || (r.Method == http.MethodGet && token != "") {
+	remoteIP := parseRemoteAddr(r.RemoteAddr)
+	if !s.checkMetadataToken(logger, w, r, remoteIP) {
+		return
+	}
+
+	// Tokens held by pods are issued by kube2iam and mean nothing to the metadata service,
+	// swap them for a token of our own before forwarding the request
+	if r.Header.Get(metadataTokenHeader) != "" {
+		upstreamToken, err := s.upstreamToken.Token()
+		if err != nil {
+			logger.Errorf("Error getting metadata token from %s %+v", s.MetadataAddress, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		r.Header.Set(metadataTokenHeader, upstreamToken)
+		// Remove remoteaddr to prevent issues with new IMDSv2 to fail when x-forwarded-for header is present
+		// for more details please see: https://github.com/aws/aws-sdk-ruby/issues/2177 https://github.com/uswitch/kiam/issues/359
 		r.RemoteAddr = ""
 	}
 
@@ -385,87 +494,276 @@ func (s *Server) reverseProxyHandler(logger *log.Entry, w http.ResponseWriter, r
 	logger.WithField("metadata.url", s.MetadataAddress).Debug("Proxy ec2 metadata request")
 }
 
+// sessionOptions returns the optional session parameters requested for a role mapping.
+func sessionOptions(roleMapping *mappings.RoleMappingResult) *iam.SessionOptions {
+	return &iam.SessionOptions{
+		Tags:       roleMapping.SessionTags,
+		Policy:     roleMapping.Policy,
+		PolicyARNs: roleMapping.PolicyARNs,
+	}
+}
+
+func hasSessionTagKey(tagMappings []mappings.SessionTagMapping, key string) bool {
+	for _, m := range tagMappings {
+		if m.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
 func write(logger *log.Entry, w http.ResponseWriter, s string) {
 	if _, err := w.Write([]byte(s)); err != nil {
 		logger.Errorf("Error writing response: %+v", err)
 	}
 }
 
-// Run runs the specified Server.
-func (s *Server) Run(host, token, nodeName string, insecure bool) error {
-	k, err := k8s.NewClient(host, token, nodeName, insecure, s.ResolveDupIPs)
+// setupRoleMapper creates the IAM client and the role mapper from the configuration of the server.
+func (s *Server) setupRoleMapper() error {
+	sessionTagMappings, err := mappings.ParseSessionTagMappings(s.SessionTags)
 	if err != nil {
 		return err
 	}
-	s.k8s = k
-	s.iam = iam.NewClient(s.BaseRoleARN, s.UseRegionalStsEndpoint)
-	log.Debugln("Caches have been synced.  Proceeding with server.")
-	s.roleMapper = mappings.NewRoleMapper(s.IAMRoleKey, s.IAMExternalID, s.DefaultIAMRole, s.NamespaceRestriction, s.NamespaceKey, s.iam, s.k8s, s.NamespaceRestrictionFormat)
-	log.Debugf("Starting pod and namespace sync jobs with %s resync period", s.CacheResyncPeriod.String())
-	podSynched := s.k8s.WatchForPods(kube2iam.NewPodHandler(s.IAMRoleKey), s.CacheResyncPeriod)
-	namespaceSynched := s.k8s.WatchForNamespaces(kube2iam.NewNamespaceHandler(s.NamespaceKey), s.CacheResyncPeriod)
+	for _, key := range s.TransitiveSessionTags {
+		if !hasSessionTagKey(sessionTagMappings, key) {
+			return fmt.Errorf("transitive session tag %s is not a configured session tag", key)
+		}
+	}
+	var policy *mappings.AuthorizationPolicy
+	if s.AuthorizationPolicyFile != "" {
+		if policy, err = mappings.LoadAuthorizationPolicy(s.AuthorizationPolicyFile); err != nil {
+			return err
+		}
+		log.Infof("Authorizing roles with the %d rules of policy %s", len(policy.Rules), s.AuthorizationPolicyFile)
+	}
+	s.iam = iam.NewClient(s.BaseRoleARN, s.UseRegionalStsEndpoint, s.IAMCacheMaxEntries, s.IAMCacheRefreshWindow)
+	s.iam.TransitiveTagKeys = s.TransitiveSessionTags
+	s.roleMapper = mappings.NewRoleMapper(mappings.Config{
+		RoleKey:                    s.IAMRoleKey,
+		ServiceAccountRoleKey:      s.ServiceAccountRoleKey,
+		ExternalIDKey:              s.IAMExternalID,
+		SessionPolicyKey:           s.SessionPolicyKey,
+		SessionPolicyARNsKey:       s.SessionPolicyARNsKey,
+		DefaultRole:                s.DefaultIAMRole,
+		NamespaceRestriction:       s.NamespaceRestriction,
+		RoleBindings:               s.IAMRoleBindings,
+		Audit:                      s.NamespaceRestrictionAudit,
+		NamespaceKey:               s.NamespaceKey,
+		NamespaceDeniedKey:         s.NamespaceDeniedKey,
+		NamespaceDefaultRoleKey:    s.NamespaceDefaultRoleKey,
+		NamespaceRestrictionFormat: s.NamespaceRestrictionFormat,
+		SessionTagMappings:         sessionTagMappings,
+		Policy:                     policy,
+	}, s.iam, s.k8s)
+	return nil
+}
 
+// watchRoleSources starts the informers of the resources roles and namespace restrictions are read from.
+func (s *Server) watchRoleSources(stopCh <-chan struct{}) []cache.InformerSynced {
+	s.roleMapper.NamespaceHandler().SetWarningRecorder(s.k8s.RecordWarning)
+	s.roleMapper.RoleBindingHandler().SetWarningRecorder(s.k8s.RecordWarning)
+	namespaceSynched := s.k8s.WatchForNamespaces(s.roleMapper.NamespaceHandler(), s.CacheResyncPeriod, stopCh)
+	cacheSyncs := []cache.InformerSynced{namespaceSynched}
+	if s.ServiceAccountRoleKey != "" {
+		saSynched := s.k8s.WatchForServiceAccounts(kube2iam.NewServiceAccountHandler(s.ServiceAccountRoleKey), s.CacheResyncPeriod, stopCh)
+		cacheSyncs = append(cacheSyncs, saSynched)
+	}
+	if s.IAMRoleBindings {
+		rbSynched := s.k8s.WatchForRoleBindings(s.roleMapper.RoleBindingHandler(), s.CacheResyncPeriod, stopCh)
+		cacheSyncs = append(cacheSyncs, rbSynched)
+	}
+	return cacheSyncs
+}
+
+// waitForCacheSync waits for the informers to be synced, it returns false along with an error if they
+// failed to sync or a nil error if ctx was cancelled first.
+func waitForCacheSync(ctx context.Context, cacheSyncs []cache.InformerSynced) (bool, error) {
 	synced := false
-	for i := 0; i < defaultCacheSyncAttempts && !synced; i++ {
-		synced = cache.WaitForCacheSync(nil, podSynched, namespaceSynched)
+	for i := 0; i < defaultCacheSyncAttempts && !synced && ctx.Err() == nil; i++ {
+		synced = cache.WaitForCacheSync(ctx.Done(), cacheSyncs...)
 	}
 
+	if ctx.Err() != nil {
+		log.Info("Shutting down before caches were synced")
+		return false, nil
+	}
 	if !synced {
-		log.Fatalf("Attempted to wait for caches to be synced for %d however it is not done.  Giving up.", defaultCacheSyncAttempts)
+		return false, fmt.Errorf("attempted to wait for caches to be synced for %d however it is not done, giving up", defaultCacheSyncAttempts)
+	}
+	return true, nil
+}
+
+// Run runs the specified Server until ctx is cancelled. In-flight requests are then given
+// the shutdown grace period to complete before the informers are stopped.
+func (s *Server) Run(ctx context.Context, host, token, nodeName string, insecure bool) error {
+	k, err := k8s.NewClient(host, token, nodeName, insecure, s.ResolveDupIPs)
+	if err != nil {
+		return err
+	}
+	s.k8s = k
+	if err := s.setupRoleMapper(); err != nil {
+		return err
+	}
+	// Informers keep running while requests are drained, they are stopped once Run returns
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if s.RecordEvents {
+		s.k8s.StartRecordingEvents(stopCh)
+	}
+	s.tokens = newTokenStore()
+	s.upstreamToken = newUpstreamTokenSource(s.MetadataAddress)
+	if s.RateLimit > 0 || s.GlobalRateLimit > 0 {
+		s.rateLimiter = newRateLimiter(s.RateLimit, s.RateLimitBurst, s.GlobalRateLimit, s.GlobalRateLimitBurst)
+		s.rateLimiter.namespaceOf = s.k8s.PodNamespaceByIP
+	}
+	log.Debugln("Caches have been synced.  Proceeding with server.")
+	log.Debugf("Starting pod and namespace sync jobs with %s resync period", s.CacheResyncPeriod.String())
+	var prefetcher *credentialsPrefetcher
+	var podHandler *kube2iam.PodHandler
+	if s.PrefetchWorkers > 0 {
+		prefetcher = newCredentialsPrefetcher(s)
+		podHandler = kube2iam.NewPodHandler(s.IAMRoleKey, prefetcher)
 	} else {
-		log.Debugln("Caches have been synced.  Proceeding with server.")
+		podHandler = kube2iam.NewPodHandler(s.IAMRoleKey, nil)
+	}
+	podSynched := s.k8s.WatchForPods(podHandler, s.CacheResyncPeriod, stopCh)
+	cacheSyncs := append(s.watchRoleSources(stopCh), podSynched)
+
+	if synced, err := waitForCacheSync(ctx, cacheSyncs); !synced {
+		return err
 	}
+	log.Debugln("Caches have been synced.  Proceeding with server.")
 
 	// Begin healthchecking
-	s.beginPollHealthcheck(healthcheckInterval)
+	s.beginPollHealthcheck(healthcheckInterval, stopCh)
+
+	if s.IAMCacheRefreshWindow > 0 {
+		go s.iam.RunRefresher(stopCh)
+	}
+	// Pods queued before the caches were synced are only prefetched now that their service account and namespace are known
+	if prefetcher != nil {
+		prefetcher.run(s.PrefetchWorkers, stopCh)
+	}
 
 	r := mux.NewRouter()
-	securityHandler := newAppHandler("securityCredentialsHandler", s.securityCredentialsHandler)
+	securityHandler := newAppHandler("securityCredentialsHandler", s.rateLimited(s.securityCredentialsHandler))
 
 	if s.Debug {
 		// This is a potential security risk if enabled in some clusters, hence the flag
 		r.Handle("/debug/store", newAppHandler("debugStoreHandler", s.debugStoreHandler))
+		r.Handle("/debug/v1/pods", newAppHandler("debugPodsHandler", s.debugPodsHandler)).Methods(http.MethodGet)
+		r.Handle("/debug/v1/conflicts", newAppHandler("debugConflictsHandler", s.debugConflictsHandler)).Methods(http.MethodGet)
+		r.Handle("/debug/v1/namespaces", newAppHandler("debugNamespacesHandler", s.debugNamespacesHandler)).Methods(http.MethodGet)
+		r.Handle("/debug/v1/cache", newAppHandler("debugCacheHandler", s.debugCacheHandler)).Methods(http.MethodGet)
+		r.Handle("/debug/v1/violations", newAppHandler("debugViolationsHandler", s.debugViolationsHandler)).Methods(http.MethodGet)
 	}
+	r.Handle("/{version}/api/token", newAppHandler("tokenHandler", s.rateLimited(s.tokenHandler))).Methods(http.MethodPut)
 	r.Handle("/{version}/meta-data/iam/security-credentials", securityHandler)
 	r.Handle("/{version}/meta-data/iam/security-credentials/", securityHandler)
 	r.Handle(
 		"/{version}/meta-data/iam/security-credentials/{role:.*}",
-		newAppHandler("roleHandler", s.roleHandler))
+		newAppHandler("roleHandler", s.rateLimited(s.roleHandler)))
 	r.Handle("/healthz", newAppHandler("healthHandler", s.healthHandler))
+	if s.ExplainToken != "" {
+		r.Handle("/explain", newAppHandler("explainHandler", s.explainHandler)).Methods(http.MethodGet)
+	}
+
+	// Each listener reports the error it fails with, the first one stops the server
+	errCh := make(chan error, 3)
+	var servers []*http.Server
+	if s.ContainerCredentialsPort != "" {
+		servers = append(servers, s.startContainerCredentialsServer(errCh))
+	}
 
 	if s.MetricsPort == s.AppPort {
 		r.Handle("/metrics", metrics.GetHandler())
 	} else {
-		metrics.StartMetricsServer(s.MetricsPort)
+		servers = append(servers, metrics.StartMetricsServer(s.MetricsPort, errCh))
 	}
 
 	// This has to be registered last so that it catches fall-throughs
-	r.Handle("/{path:.*}", newAppHandler("reverseProxyHandler", s.reverseProxyHandler))
+	r.Handle("/{path:.*}", newAppHandler("reverseProxyHandler", s.rateLimited(s.reverseProxyHandler)))
+
+	srv := &http.Server{
+		Addr:    ":" + s.AppPort,
+		Handler: r,
+		// Keep track of the connection so the hop limit of token responses can be adjusted
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+	}
+
+	servers = append(servers, srv)
+
+	go func() {
+		log.Infof("Listening on port %s", s.AppPort)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			errCh <- fmt.Errorf("error creating kube2iam http server: %+v", err)
+		}
+	}()
 
-	log.Infof("Listening on port %s", s.AppPort)
-	if err := http.ListenAndServe(":"+s.AppPort, r); err != nil {
-		log.Fatalf("Error creating kube2iam http server: %+v", err)
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
 	}
+
+	log.Infof("Shutting down, waiting up to %s for in-flight requests to complete", s.ShutdownGracePeriod)
+	s.shutdown(servers)
 	return nil
 }
 
+// shutdown stops the servers from accepting new connections and waits for their in-flight requests
+// to complete, up to the shutdown grace period.
+func (s *Server) shutdown(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownGracePeriod)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Errorf("Error shutting down http server on %s: %+v", srv.Addr, err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
+
 // NewServer will create a new Server with default values.
 func NewServer() *Server {
 	return &Server{
 		AppPort:                    defaultAppPort,
+		WebhookPort:                defaultWebhookPort,
 		MetricsPort:                defaultAppPort,
-		BackoffMaxElapsedTime:      defaultMaxElapsedTime,
+		PodLookupTimeout:           defaultPodLookupTimeout,
+		ShutdownGracePeriod:        defaultShutdownGracePeriod,
+		IMDSv2HopLimit:             defaultIMDSv2HopLimit,
+		IPTablesReconcileInterval:  defaultIPTablesReconcileInterval,
+		IPTablesBackend:            iptables.BackendAuto,
 		IAMRoleKey:                 defaultIAMRoleKey,
 		IAMExternalID:              defaultIAMExternalID,
-		BackoffMaxInterval:         defaultMaxInterval,
+		SessionPolicyKey:           defaultSessionPolicyKey,
+		SessionPolicyARNsKey:       defaultPolicyARNsKey,
 		LogLevel:                   defaultLogLevel,
 		LogFormat:                  defaultLogFormat,
 		MetadataAddress:            defaultMetadataAddress,
+		MetadataAddressIPv6:        defaultMetadataAddressIPv6,
 		NamespaceKey:               defaultNamespaceKey,
+		NamespaceDeniedKey:         defaultNamespaceDeniedKey,
+		NamespaceDefaultRoleKey:    defaultNamespaceDefaultRoleKey,
 		CacheResyncPeriod:          defaultCacheResyncPeriod,
 		ResolveDupIPs:              defaultResolveDupIPs,
 		NamespaceRestrictionFormat: defaultNamespaceRestrictionFormat,
 		HealthcheckFailReason:      "Healthcheck not yet performed",
 		IAMRoleSessionTTL:          defaultIAMRoleSessionTTL,
+		IAMCacheMaxEntries:         iam.DefaultCacheMaxEntries,
+		IAMCacheRefreshWindow:      defaultIAMCacheRefreshWindow,
+		PrefetchWorkers:            defaultPrefetchWorkers,
+		RecordEvents:               true,
+		RateLimitBurst:             defaultRateLimitBurst,
+		GlobalRateLimitBurst:       defaultGlobalRateLimitBurst,
 	}
 }
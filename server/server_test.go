@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jtblin/kube2iam/iam"
+	"github.com/jtblin/kube2iam/k8s"
+	"github.com/jtblin/kube2iam/mappings"
+)
+
+func TestParseRemoteAddr(t *testing.T) {
+	var addrTests = []struct {
+		test     string
+		addr     string
+		expected string
+	}{
+		{
+			test:     "IPv4",
+			addr:     "10.0.0.1:43210",
+			expected: "10.0.0.1",
+		},
+		{
+			test:     "IPv6",
+			addr:     "[2600:1f14::1]:43210",
+			expected: "2600:1f14::1",
+		},
+		{
+			test:     "No port",
+			addr:     "10.0.0.1",
+			expected: "",
+		},
+		{
+			test:     "Hostname",
+			addr:     "localhost:43210",
+			expected: "",
+		},
+		{
+			test:     "Empty",
+			addr:     "",
+			expected: "",
+		},
+	}
+
+	for _, tt := range addrTests {
+		t.Run(tt.test, func(t *testing.T) {
+			if resp := parseRemoteAddr(tt.addr); resp != tt.expected {
+				t.Errorf("Response [%s] did not equal expected [%s]", resp, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWatchRoleSources(t *testing.T) {
+	var watchTests = []struct {
+		test                   string
+		saRoleKey              string
+		expectedServiceAccount bool
+	}{
+		{
+			test: "Service account role key not set",
+		},
+		{
+			test:                   "Service account role key set",
+			saRoleKey:              "eks.amazonaws.com/role-arn",
+			expectedServiceAccount: true,
+		},
+	}
+
+	apiServer := httptest.NewServer(http.NotFoundHandler())
+	defer apiServer.Close()
+	for _, tt := range watchTests {
+		t.Run(tt.test, func(t *testing.T) {
+			client, err := k8s.NewClient(apiServer.URL, "token", "", false, false)
+			if err != nil {
+				t.Fatalf("Didn't expect error but recieved %s", err)
+			}
+			s := NewServer()
+			s.ServiceAccountRoleKey = tt.saRoleKey
+			s.k8s = client
+			config := newTestConfig(s)
+			config.ServiceAccountRoleKey = tt.saRoleKey
+			s.roleMapper = mappings.NewRoleMapper(config, &iam.Client{BaseARN: "arn:aws:iam::123456789012:role/"}, client)
+
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			s.watchRoleSources(stopCh)
+			// Service accounts are only cached when their role is read, the lookup fails when they aren't watched
+			if _, err := client.ServiceAccountByName("default", "web"); (err.Error() != "service accounts are not being watched") != tt.expectedServiceAccount {
+				t.Errorf("Expected service accounts to be watched [%t] but recieved [%s]", tt.expectedServiceAccount, err)
+			}
+		})
+	}
+}
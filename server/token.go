@@ -0,0 +1,197 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	metadataTokenHeader    = "X-aws-ec2-metadata-token"
+	metadataTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+	maxMetadataTokenTTL    = 6 * time.Hour
+	metadataTokenBytes     = 48
+	// maxMetadataTokensPerIP caps the live tokens of a pod so that a misbehaving client can't grow the store
+	// without bounds, the oldest token of the pod is evicted when a new one is issued.
+	maxMetadataTokensPerIP = 100
+
+	// Tokens kube2iam requests from the real metadata service for proxied requests are
+	// renewed this long before they expire.
+	upstreamTokenTTL         = 6 * time.Hour
+	upstreamTokenRenewWindow = 5 * time.Minute
+)
+
+type connContextKey struct{}
+
+// sessionToken is an IMDSv2 session token issued by kube2iam and bound to the IP of the pod that requested it.
+type sessionToken struct {
+	ip        string
+	expiresAt time.Time
+}
+
+// tokenStore issues and validates the IMDSv2 session tokens handed out to pods.
+type tokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]sessionToken
+	// byIP lists the tokens issued to each IP, oldest first.
+	byIP      map[string][]string
+	nextPurge time.Time
+}
+
+func newTokenStore() *tokenStore {
+	return &tokenStore{tokens: make(map[string]sessionToken), byIP: make(map[string][]string)}
+}
+
+// Issue returns a new token bound to ip that is valid for ttl.
+func (t *tokenStore) Issue(ip string, ttl time.Duration) (string, error) {
+	b := make([]byte, metadataTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.URLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.After(t.nextPurge) {
+		// Expired tokens are only ever looked up by misbehaving clients, sweep them lazily
+		for k, v := range t.tokens {
+			if now.After(v.expiresAt) {
+				delete(t.tokens, k)
+			}
+		}
+		for k := range t.byIP {
+			t.compact(k, now)
+		}
+		t.nextPurge = now.Add(time.Minute)
+	}
+
+	if len(t.byIP[ip]) >= maxMetadataTokensPerIP {
+		t.compact(ip, now)
+	}
+	if tokens := t.byIP[ip]; len(tokens) >= maxMetadataTokensPerIP {
+		delete(t.tokens, tokens[0])
+		t.byIP[ip] = tokens[1:]
+	}
+	t.tokens[token] = sessionToken{ip: ip, expiresAt: now.Add(ttl)}
+	t.byIP[ip] = append(t.byIP[ip], token)
+	return token, nil
+}
+
+// compact removes the tokens of ip that expired or were removed from the store.
+func (t *tokenStore) compact(ip string, now time.Time) {
+	var live []string
+	for _, token := range t.byIP[ip] {
+		if st, ok := t.tokens[token]; ok && !now.After(st.expiresAt) {
+			live = append(live, token)
+		}
+	}
+	if len(live) == 0 {
+		delete(t.byIP, ip)
+		return
+	}
+	t.byIP[ip] = live
+}
+
+// Validate returns true if token was issued to ip and has not expired.
+func (t *tokenStore) Validate(token, ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.tokens[token]
+	if !ok {
+		return false
+	}
+	if time.Now().After(st.expiresAt) {
+		delete(t.tokens, token)
+		return false
+	}
+	return st.ip == ip
+}
+
+// parseMetadataTokenTTL validates the TTL requested by the client the same way the EC2 metadata service does.
+func parseMetadataTokenTTL(value string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s header %q", metadataTokenTTLHeader, value)
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if ttl < time.Second || ttl > maxMetadataTokenTTL {
+		return 0, fmt.Errorf("%s must be between 1 and %d seconds", metadataTokenTTLHeader, int(maxMetadataTokenTTL.Seconds()))
+	}
+	return ttl, nil
+}
+
+// upstreamTokenSource fetches and caches an IMDSv2 token from the real metadata service
+// so requests proxied on behalf of pods keep working when the instance requires IMDSv2.
+type upstreamTokenSource struct {
+	mu        sync.Mutex
+	address   string
+	client    *http.Client
+	token     string
+	expiresAt time.Time
+}
+
+func newUpstreamTokenSource(address string) *upstreamTokenSource {
+	return &upstreamTokenSource{address: address, client: &http.Client{Timeout: time.Second}}
+}
+
+// Token returns a valid upstream token, requesting a new one when the cached token is about to expire.
+func (u *upstreamTokenSource) Token() (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.token != "" && time.Now().Add(upstreamTokenRenewWindow).Before(u.expiresAt) {
+		return u.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://%s/latest/api/token", u.address), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(metadataTokenTTLHeader, strconv.Itoa(int(upstreamTokenTTL.Seconds())))
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error getting metadata token, got status: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	u.token = string(body)
+	u.expiresAt = time.Now().Add(upstreamTokenTTL)
+	return u.token, nil
+}
+
+// setHopLimit sets the IP TTL (or IPv6 hop limit) of the packets sent on the connection serving r,
+// mirroring the PUT response hop limit of the EC2 metadata service.
+func setHopLimit(r *http.Request, hopLimit int) error {
+	conn, ok := r.Context().Value(connContextKey{}).(*net.TCPConn)
+	if !ok {
+		return fmt.Errorf("unable to find tcp connection for request")
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TTL
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS
+	}
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, opt, hopLimit)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestTokenStoreValidate(t *testing.T) {
+	store := newTokenStore()
+	token, err := store.Issue("10.0.0.1", time.Minute)
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	expired, err := store.Issue("10.0.0.1", -time.Second)
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+
+	var validateTests = []struct {
+		test     string
+		token    string
+		ip       string
+		expected bool
+	}{
+		{
+			test:     "Valid token, same IP",
+			token:    token,
+			ip:       "10.0.0.1",
+			expected: true,
+		},
+		{
+			test:     "Valid token, different IP",
+			token:    token,
+			ip:       "10.0.0.2",
+			expected: false,
+		},
+		{
+			test:     "Expired token",
+			token:    expired,
+			ip:       "10.0.0.1",
+			expected: false,
+		},
+		{
+			test:     "Unknown token",
+			token:    "unknown",
+			ip:       "10.0.0.1",
+			expected: false,
+		},
+	}
+
+	for _, tt := range validateTests {
+		t.Run(tt.test, func(t *testing.T) {
+			if resp := store.Validate(tt.token, tt.ip); resp != tt.expected {
+				t.Errorf("Expected [%t] for test but recieved [%t]", tt.expected, resp)
+			}
+		})
+	}
+}
+
+func TestTokenStoreMaxTokensPerIP(t *testing.T) {
+	store := newTokenStore()
+	other, err := store.Issue("10.0.0.2", time.Minute)
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	var tokens []string
+	for i := 0; i <= maxMetadataTokensPerIP; i++ {
+		token, err := store.Issue("10.0.0.1", time.Minute)
+		if err != nil {
+			t.Fatalf("Didn't expect error but recieved %s", err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	if store.Validate(tokens[0], "10.0.0.1") {
+		t.Error("Expected the oldest token of the IP to be evicted")
+	}
+	if !store.Validate(tokens[1], "10.0.0.1") || !store.Validate(tokens[maxMetadataTokensPerIP], "10.0.0.1") {
+		t.Error("Expected the newest tokens of the IP to be valid")
+	}
+	if !store.Validate(other, "10.0.0.2") {
+		t.Error("Expected the token of another IP to be valid")
+	}
+	if len(store.tokens) != maxMetadataTokensPerIP+1 {
+		t.Errorf("Expected [%d] tokens in the store but recieved [%d]", maxMetadataTokensPerIP+1, len(store.tokens))
+	}
+}
+
+func TestParseMetadataTokenTTL(t *testing.T) {
+	var ttlTests = []struct {
+		test        string
+		value       string
+		expected    time.Duration
+		expectError bool
+	}{
+		{
+			test:        "Missing header",
+			value:       "",
+			expectError: true,
+		},
+		{
+			test:        "Not a number",
+			value:       "abc",
+			expectError: true,
+		},
+		{
+			test:        "Zero",
+			value:       "0",
+			expectError: true,
+		},
+		{
+			test:        "Above maximum",
+			value:       "21601",
+			expectError: true,
+		},
+		{
+			test:     "Minimum",
+			value:    "1",
+			expected: time.Second,
+		},
+		{
+			test:     "Maximum",
+			value:    "21600",
+			expected: 6 * time.Hour,
+		},
+	}
+
+	for _, tt := range ttlTests {
+		t.Run(tt.test, func(t *testing.T) {
+			resp, err := parseMetadataTokenTTL(tt.value)
+			if tt.expectError && err == nil {
+				t.Error("Expected error however didn't recieve one")
+				return
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Didn't expect error but recieved %s", err)
+				return
+			}
+			if resp != tt.expected {
+				t.Errorf("Response [%s] did not equal expected [%s]", resp, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTokenHandlerHopLimit(t *testing.T) {
+	s := NewServer()
+	if s.IMDSv2HopLimit != defaultIMDSv2HopLimit {
+		t.Errorf("Expected default hop limit [%d] but recieved [%d]", defaultIMDSv2HopLimit, s.IMDSv2HopLimit)
+	}
+	s.tokens = newTokenStore()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.tokenHandler(log.NewEntry(log.StandardLogger()), w, r)
+	}))
+	srv.Config.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, connContextKey{}, c)
+	}
+	srv.Start()
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/latest/api/token", nil)
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	req.Header.Set(metadataTokenTTLHeader, "60")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Didn't expect error but recieved %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status [200] but recieved [%d]", resp.StatusCode)
+	}
+	// The connection carries the hop limit of the token response, it mustn't be reused for other responses
+	if !resp.Close {
+		t.Error("Expected the connection to be closed after the token response")
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/jtblin/kube2iam/k8s"
+	"github.com/jtblin/kube2iam/metrics"
+)
+
+// admissionReview is the v1beta1 AdmissionReview, with the warnings of responses supported since Kubernetes 1.19.
+type admissionReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *v1beta1.AdmissionRequest `json:"request,omitempty"`
+	Response        *admissionResponse        `json:"response,omitempty"`
+}
+
+type admissionResponse struct {
+	v1beta1.AdmissionResponse
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+func (s *Server) validatePodHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+	review := &admissionReview{}
+	if err := json.NewDecoder(r.Body).Decode(review); err != nil || review.Request == nil {
+		http.Error(w, "Invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = s.validatePod(logger, review.Request)
+	review.Request = nil
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		logger.Errorf("Error sending json %+v", err)
+	}
+}
+
+// validatePod checks the role of a pod being created, or whose role annotation is being updated, with the
+// role mapper. Pods that won't be given their role are rejected, or admitted with a warning in warn only mode.
+func (s *Server) validatePod(logger *log.Entry, req *v1beta1.AdmissionRequest) *admissionResponse {
+	response := &admissionResponse{AdmissionResponse: v1beta1.AdmissionResponse{UID: req.UID, Allowed: true}}
+	if req.Kind.Kind != "Pod" || req.SubResource != "" || (req.Operation != v1beta1.Create && req.Operation != v1beta1.Update) {
+		return response
+	}
+
+	pod := &v1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusBadRequest,
+			Reason:  metav1.StatusReasonBadRequest,
+			Message: fmt.Sprintf("kube2iam: unable to decode pod: %v", err),
+		}
+		return response
+	}
+	// Pods being created only get their namespace from the request
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+	// Pods on the host network don't go through kube2iam
+	if pod.Spec.HostNetwork {
+		return response
+	}
+
+	if req.Operation == v1beta1.Update {
+		// Pods already running must not be blocked from unrelated updates, e.g. the removal of finalizers
+		oldPod := &v1.Pod{}
+		if err := json.Unmarshal(req.OldObject.Raw, oldPod); err == nil && oldPod.GetAnnotations()[s.IAMRoleKey] == pod.GetAnnotations()[s.IAMRoleKey] {
+			return response
+		}
+	}
+
+	decision := s.roleMapper.ValidatePod(pod)
+	if decision.Allowed && !decision.Audited {
+		return response
+	}
+
+	name := pod.GetName()
+	if name == "" {
+		name = pod.GetGenerateName()
+	}
+	logger = logger.WithFields(log.Fields{
+		"pod.name":      name,
+		"pod.namespace": pod.GetNamespace(),
+	})
+	message := fmt.Sprintf("kube2iam: %s", decision.Reason)
+
+	if decision.Audited {
+		logger.Warnf("Admitting pod that would be denied its role in audit mode: %s", decision.Reason)
+		response.Warnings = []string{message + " (credentials are issued in audit mode)"}
+		response.AuditAnnotations = map[string]string{"role-violation": decision.Reason}
+		return response
+	}
+	if s.WebhookWarnOnly {
+		logger.Warnf("Admitting pod that won't be given its role: %s", decision.Reason)
+		response.Warnings = []string{message}
+		response.AuditAnnotations = map[string]string{"role-violation": decision.Reason}
+		return response
+	}
+
+	logger.Infof("Rejecting pod that won't be given its role: %s", decision.Reason)
+	response.Allowed = false
+	response.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusForbidden,
+		Reason:  metav1.StatusReasonForbidden,
+		Message: message,
+	}
+	return response
+}
+
+func (s *Server) webhookHealthHandler(logger *log.Entry, w http.ResponseWriter, r *http.Request) {
+	write(logger, w, "ok")
+}
+
+// RunWebhook runs a validating admission webhook checking the role of pods with the role mapper until ctx is
+// cancelled, so that pods requesting a role they won't be given are rejected when they are created.
+func (s *Server) RunWebhook(ctx context.Context, host, token string, insecure bool) error {
+	k, err := k8s.NewClient(host, token, "", insecure, false)
+	if err != nil {
+		return err
+	}
+	s.k8s = k
+	if err := s.setupRoleMapper(); err != nil {
+		return err
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	if synced, err := waitForCacheSync(ctx, s.watchRoleSources(stopCh)); !synced {
+		return err
+	}
+	log.Debugln("Caches have been synced.  Proceeding with webhook.")
+
+	r := mux.NewRouter()
+	r.Handle("/validate", newAppHandler("validatePodHandler", s.validatePodHandler)).Methods(http.MethodPost)
+	r.Handle("/healthz", newAppHandler("webhookHealthHandler", s.webhookHealthHandler))
+
+	srv := &http.Server{
+		Addr:    ":" + s.WebhookPort,
+		Handler: r,
+	}
+	// Each listener reports the error it fails with, the first one stops the webhook
+	errCh := make(chan error, 2)
+	servers := []*http.Server{srv, metrics.StartMetricsServer(s.MetricsPort, errCh)}
+
+	go func() {
+		log.Infof("Webhook listening on port %s", s.WebhookPort)
+		if err := srv.ListenAndServeTLS(s.WebhookTLSCertFile, s.WebhookTLSKeyFile); err != http.ErrServerClosed {
+			errCh <- fmt.Errorf("error creating kube2iam webhook server: %+v", err)
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Infof("Shutting down, waiting up to %s for in-flight requests to complete", s.ShutdownGracePeriod)
+	s.shutdown(servers)
+	return nil
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/jtblin/kube2iam"
+	"github.com/jtblin/kube2iam/iam"
+	"github.com/jtblin/kube2iam/mappings"
+)
+
+type storeMock struct {
+	namespace *v1.Namespace
+}
+
+func (k *storeMock) ListPodIPs() []string {
+	return nil
+}
+func (k *storeMock) ListPods() []*v1.Pod {
+	return nil
+}
+func (k *storeMock) PodByIP(string) (*v1.Pod, error) {
+	return nil, fmt.Errorf("pod isn't present")
+}
+func (k *storeMock) ListNamespaces() []string {
+	return []string{k.namespace.GetName()}
+}
+func (k *storeMock) NamespaceByName(ns string) (*v1.Namespace, error) {
+	if ns == k.namespace.GetName() {
+		return k.namespace, nil
+	}
+	return nil, fmt.Errorf("namespace isn't present")
+}
+func (k *storeMock) ServiceAccountByName(ns, name string) (*v1.ServiceAccount, error) {
+	return nil, fmt.Errorf("service account isn't present")
+}
+func (k *storeMock) RoleBindingsByNamespace(ns string) ([]*kube2iam.IAMRoleBinding, error) {
+	return nil, nil
+}
+
+// newTestConfig returns the configuration of a role mapper restricting roles with the annotation keys of s.
+func newTestConfig(s *Server) mappings.Config {
+	return mappings.Config{
+		RoleKey:                    s.IAMRoleKey,
+		ExternalIDKey:              s.IAMExternalID,
+		NamespaceRestriction:       true,
+		NamespaceKey:               s.NamespaceKey,
+		NamespaceDeniedKey:         s.NamespaceDeniedKey,
+		NamespaceDefaultRoleKey:    s.NamespaceDefaultRoleKey,
+		NamespaceRestrictionFormat: s.NamespaceRestrictionFormat,
+	}
+}
+
+func newTestWebhookServer(warnOnly, audit bool) *Server {
+	s := NewServer()
+	s.WebhookWarnOnly = warnOnly
+	ns := &v1.Namespace{}
+	ns.Name = "default"
+	ns.Annotations = map[string]string{defaultNamespaceKey: `["team-a-*"]`}
+	config := newTestConfig(s)
+	config.Audit = audit
+	s.roleMapper = mappings.NewRoleMapper(config, &iam.Client{BaseARN: "arn:aws:iam::123456789012:role/"}, &storeMock{namespace: ns})
+	return s
+}
+
+func podAdmissionReview(operation v1beta1.Operation, role, oldRole string) []byte {
+	newPod := func(role string) runtime.RawExtension {
+		pod := &v1.Pod{}
+		pod.GenerateName = "web-"
+		pod.Annotations = map[string]string{defaultIAMRoleKey: role}
+		raw, _ := json.Marshal(pod)
+		return runtime.RawExtension{Raw: raw}
+	}
+
+	review := &admissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+		Request: &v1beta1.AdmissionRequest{
+			UID:       "uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: "default",
+			Operation: operation,
+			Object:    newPod(role),
+		},
+	}
+	if operation == v1beta1.Update {
+		review.Request.OldObject = newPod(oldRole)
+	}
+	body, _ := json.Marshal(review)
+	return body
+}
+
+func TestValidatePodHandler(t *testing.T) {
+	var webhookTests = []struct {
+		test             string
+		warnOnly         bool
+		audit            bool
+		operation        v1beta1.Operation
+		role             string
+		oldRole          string
+		expectedAllowed  bool
+		expectedWarnings int
+	}{
+		{
+			test:            "Create with allowed role",
+			operation:       v1beta1.Create,
+			role:            "team-a-reader",
+			expectedAllowed: true,
+		},
+		{
+			test:            "Create with role not allowed",
+			operation:       v1beta1.Create,
+			role:            "team-b-reader",
+			expectedAllowed: false,
+		},
+		{
+			test:             "Create with role not allowed in warn only mode",
+			warnOnly:         true,
+			operation:        v1beta1.Create,
+			role:             "team-b-reader",
+			expectedAllowed:  true,
+			expectedWarnings: 1,
+		},
+		{
+			test:             "Create with role not allowed in audit mode",
+			audit:            true,
+			operation:        v1beta1.Create,
+			role:             "team-b-reader",
+			expectedAllowed:  true,
+			expectedWarnings: 1,
+		},
+		{
+			test:            "Create with allowed role in audit mode",
+			audit:           true,
+			operation:       v1beta1.Create,
+			role:            "team-a-reader",
+			expectedAllowed: true,
+		},
+		{
+			test:            "Update with unchanged role not allowed",
+			operation:       v1beta1.Update,
+			role:            "team-b-reader",
+			oldRole:         "team-b-reader",
+			expectedAllowed: true,
+		},
+		{
+			test:            "Update changing role to one not allowed",
+			operation:       v1beta1.Update,
+			role:            "team-b-reader",
+			oldRole:         "team-a-reader",
+			expectedAllowed: false,
+		},
+	}
+
+	for _, tt := range webhookTests {
+		t.Run(tt.test, func(t *testing.T) {
+			s := newTestWebhookServer(tt.warnOnly, tt.audit)
+			req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(podAdmissionReview(tt.operation, tt.role, tt.oldRole)))
+			rr := httptest.NewRecorder()
+			s.validatePodHandler(log.WithField("test", tt.test), rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status [%d] for test but recieved [%d]", http.StatusOK, rr.Code)
+			}
+			review := &admissionReview{}
+			if err := json.Unmarshal(rr.Body.Bytes(), review); err != nil || review.Response == nil {
+				t.Fatalf("Unable to decode response [%s]: %v", rr.Body.String(), err)
+			}
+			if review.Response.UID != "uid" {
+				t.Errorf("Expected UID [uid] for test but recieved [%s]", review.Response.UID)
+			}
+			if review.Response.Allowed != tt.expectedAllowed {
+				t.Errorf("Expected allowed [%t] for test but recieved [%+v]", tt.expectedAllowed, review.Response)
+			}
+			if len(review.Response.Warnings) != tt.expectedWarnings {
+				t.Errorf("Expected [%d] warnings for test but recieved [%v]", tt.expectedWarnings, review.Response.Warnings)
+			}
+		})
+	}
+}
+
+func TestValidatePodHandlerInvalidReview(t *testing.T) {
+	s := newTestWebhookServer(false, false)
+	req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader([]byte("{")))
+	rr := httptest.NewRecorder()
+	s.validatePodHandler(log.WithField("test", "invalid"), rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status [%d] but recieved [%d]", http.StatusBadRequest, rr.Code)
+	}
+}
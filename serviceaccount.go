@@ -0,0 +1,62 @@
+package kube2iam
+
+import (
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ServiceAccountHandler outputs change events from K8.
+type ServiceAccountHandler struct {
+	iamRoleKey string
+}
+
+func (h *ServiceAccountHandler) serviceAccountFields(sa *v1.ServiceAccount) log.Fields {
+	return log.Fields{
+		"sa.name":      sa.GetName(),
+		"sa.namespace": sa.GetNamespace(),
+		"sa.iam.role":  sa.GetAnnotations()[h.iamRoleKey],
+	}
+}
+
+// OnAdd is called when a service account is added.
+func (h *ServiceAccountHandler) OnAdd(obj interface{}) {
+	sa, ok := obj.(*v1.ServiceAccount)
+	if !ok {
+		log.Errorf("Expected ServiceAccount but OnAdd handler received %+v", obj)
+		return
+	}
+	log.WithFields(h.serviceAccountFields(sa)).Debug("ServiceAccount OnAdd")
+}
+
+// OnUpdate is called when a service account is modified.
+func (h *ServiceAccountHandler) OnUpdate(oldObj, newObj interface{}) {
+	sa, ok := newObj.(*v1.ServiceAccount)
+	if !ok {
+		log.Errorf("Expected ServiceAccount but OnUpdate handler received %+v %+v", oldObj, newObj)
+		return
+	}
+	log.WithFields(h.serviceAccountFields(sa)).Debug("ServiceAccount OnUpdate")
+}
+
+// OnDelete is called when a service account is deleted.
+func (h *ServiceAccountHandler) OnDelete(obj interface{}) {
+	sa, ok := obj.(*v1.ServiceAccount)
+	if !ok {
+		deletedObj, dok := obj.(cache.DeletedFinalStateUnknown)
+		if dok {
+			sa, ok = deletedObj.Obj.(*v1.ServiceAccount)
+		}
+	}
+
+	if !ok {
+		log.Errorf("Expected ServiceAccount but OnDelete handler received %+v", obj)
+		return
+	}
+	log.WithFields(h.serviceAccountFields(sa)).Debug("ServiceAccount OnDelete")
+}
+
+// NewServiceAccountHandler constructs a service account handler given the relevant IAM Role Key
+func NewServiceAccountHandler(iamRoleKey string) *ServiceAccountHandler {
+	return &ServiceAccountHandler{iamRoleKey: iamRoleKey}
+}